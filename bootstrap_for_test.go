@@ -75,12 +75,16 @@ func removeTestDb() {
 }
 
 func createTestDb() (*sql.DB, error) {
-	if isFileExists(TEST_DB_NAME) {
-		if err := os.Remove(TEST_DB_NAME); err != nil {
+	return createDb(TEST_DB_NAME)
+}
+
+func createDb(filename string) (*sql.DB, error) {
+	if isFileExists(filename) {
+		if err := os.Remove(filename); err != nil {
 			return nil, fmt.Errorf("Can't remove previous test data: %s", err.Error())
 		}
 	}
-	db, err := sql.Open("sqlite3", TEST_DB_NAME)
+	db, err := sql.Open("sqlite3", filename)
 	if err != nil {
 		return nil, err
 	}
@@ -98,6 +102,47 @@ func createTestDb() (*sql.DB, error) {
 	   		created DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP);`},
 
 		ldbl.Migration{Up: `ALTER TABLE users ADD COLUMN images_cnt INTEGER NOT NULL DEFAULT '0';`},
+
+		ldbl.Migration{Up: `CREATE UNIQUE INDEX users_email ON users (email);`},
+
+		ldbl.Migration{Up: `ALTER TABLE images ADD COLUMN version INTEGER NOT NULL DEFAULT '0';`},
+
+		ldbl.Migration{Up: `ALTER TABLE images ADD COLUMN description TEXT NULL;`},
+
+		ldbl.Migration{Up: `ALTER TABLE images ADD COLUMN rating INTEGER NULL;`},
+
+		ldbl.Migration{Up: `ALTER TABLE images ADD COLUMN meta TEXT NULL;`},
+
+		ldbl.Migration{Up: `ALTER TABLE images ADD COLUMN status VARCHAR(32) NULL;`},
+
+		ldbl.Migration{Up: `ALTER TABLE images ADD COLUMN duration INTEGER NULL;`},
+
+		ldbl.Migration{Up: `ALTER TABLE images ADD COLUMN price VARCHAR(32) NULL;`},
+
+		ldbl.Migration{Up: `CREATE TABLE settings (
+	   		uuid VARCHAR(36) PRIMARY KEY,
+	   		name VARCHAR(255) NOT NULL,
+	   		value TEXT NOT NULL DEFAULT '');`},
+
+		ldbl.Migration{Up: `CREATE TABLE image_tags (
+	   		images_id INTEGER NOT NULL,
+	   		tag VARCHAR(64) NOT NULL,
+	   		weight INTEGER NOT NULL DEFAULT '0',
+	   		PRIMARY KEY (images_id, tag));`},
+
+		ldbl.Migration{Up: `CREATE TABLE tag_votes (
+	   		id INTEGER PRIMARY KEY AUTOINCREMENT,
+	   		images_id INTEGER NOT NULL,
+	   		tag VARCHAR(64) NOT NULL,
+	   		users_id INTEGER NOT NULL);`},
+
+		ldbl.Migration{Up: `ALTER TABLE users ADD COLUMN deleted_at DATETIME NULL;`},
+
+		ldbl.Migration{Up: `ALTER TABLE images ADD COLUMN deleted_at DATETIME NULL;`},
+
+		ldbl.Migration{Up: `ALTER TABLE images ADD COLUMN updated DATETIME NULL;`},
+
+		ldbl.Migration{Up: `ALTER TABLE settings ADD COLUMN version INTEGER NOT NULL DEFAULT '0';`},
 	})
 	if err := migr.Update(db); err != nil {
 		return nil, err
@@ -9,7 +9,7 @@ import (
 type ItemsCache struct {
 	sync.RWMutex
 	OptionalLogger
-	data       map[string]map[uint64]Loadable
+	data       map[string]map[string]Loadable
 	itemsCount int
 	maxSize    int
 	logger     *log.Logger
@@ -18,14 +18,19 @@ type ItemsCache struct {
 func NewItemsCache(maxSize int) *ItemsCache {
 	c := &ItemsCache{maxSize: maxSize}
 	c.LogPrefix = "Cache"
-	c.data = make(map[string]map[uint64]Loadable)
+	c.data = make(map[string]map[string]Loadable)
 	return c
 }
 
+// Partially loaded items are not cached (and evict cached full versions of them, as they could be changed).
 func (c *ItemsCache) Add(item Loadable) {
 	if c.maxSize == 0 {
 		return
 	}
+	if isPartiallyLoaded(item) {
+		c.Remove(item)
+		return
+	}
 	cname := item.CollectionName()
 	c.Lock()
 	defer c.Unlock()
@@ -33,14 +38,24 @@ func (c *ItemsCache) Add(item Loadable) {
 		c.init()
 	}
 	if _, set := c.data[cname]; !set {
-		c.data[cname] = make(map[uint64]Loadable)
+		c.data[cname] = make(map[string]Loadable)
 	}
-	c.data[cname][item.Id()] = item
+	key := keyOf(item)
+	c.data[cname][key.String()] = item
 	c.itemsCount++
-	c.Log("%s#%d cached", item.CollectionName(), item.Id())
+	c.Log("%s#%s cached", item.CollectionName(), key)
 }
 
 func (c *ItemsCache) Lookup(forItem Loadable, id uint64) bool {
+	return c.lookup(forItem, Key{id})
+}
+
+// Same as Lookup(), but for items with non-integer or composite keys
+func (c *ItemsCache) LookupKey(forItem Keyed, key Key) bool {
+	return c.lookup(forItem, key)
+}
+
+func (c *ItemsCache) lookup(forItem Loadable, key Key) bool {
 	if c.maxSize == 0 {
 		return false
 	}
@@ -50,13 +65,17 @@ func (c *ItemsCache) Lookup(forItem Loadable, id uint64) bool {
 	if _, set := c.data[cname]; !set {
 		return false
 	}
-	if result, found := c.data[cname][id]; found {
+	if result, found := c.data[cname][key.String()]; found {
 		if result == nil {
 			return false
 		}
 		if result, canLoadFields := result.(Storable); canLoadFields {
-			forItem.Fill(id, result.Fields())
-			c.Log("Hit: %s#%d", forItem.CollectionName(), forItem.Id())
+			if keyed, isKeyed := forItem.(Keyed); isKeyed {
+				keyed.FillKey(keyOf(result), result.Fields())
+			} else {
+				forItem.Fill(result.Id(), result.Fields())
+			}
+			c.Log("Hit: %s#%s", forItem.CollectionName(), key)
 			return true
 		}
 	}
@@ -73,9 +92,10 @@ func (c *ItemsCache) Remove(item Loadable) {
 	if _, set := c.data[cname]; !set {
 		return
 	}
-	if _, found := c.data[cname][item.Id()]; found {
-		c.data[cname][item.Id()] = nil
-		c.Log("%s#%d removed", item.CollectionName(), item.Id())
+	key := keyOf(item)
+	if _, found := c.data[cname][key.String()]; found {
+		c.data[cname][key.String()] = nil
+		c.Log("%s#%s removed", item.CollectionName(), key)
 	}
 }
 
@@ -86,7 +106,7 @@ func (c *ItemsCache) Clear() {
 }
 
 func (c *ItemsCache) init() {
-	c.data = make(map[string]map[uint64]Loadable)
+	c.data = make(map[string]map[string]Loadable)
 	c.itemsCount = 0
 	c.Log("All items cleared")
 }
@@ -0,0 +1,26 @@
+package ldbl
+
+import (
+	"time"
+)
+
+// Source of current time for storages (used for timestamps of items, see Timestamped & SoftDeletable).
+// It can be replaced (see DispatchedStorage.SetClock()), so time is deterministic in tests.
+// All times, written by storages (timestamps & times of deletion), must be got from the same clock.
+type Clock interface {
+	Now() time.Time
+}
+
+// Clock, that returns current system time
+type SystemClock struct{}
+
+func (c SystemClock) Now() time.Time {
+	return time.Now()
+}
+
+// Adapter, that allows usage of ordinary func as Clock
+type ClockFunc func() time.Time
+
+func (f ClockFunc) Now() time.Time {
+	return f()
+}
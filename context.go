@@ -0,0 +1,188 @@
+package ldbl
+
+import (
+	"context"
+	"database/sql"
+)
+
+// Helpers below are used for calling storages, that may not support contexts:
+// if given storage implements StorageContext, context-aware method will be called.
+
+func saveWithContext(ctx context.Context, s Storage, item Storable) error {
+	if sc, ok := s.(StorageContext); ok {
+		return sc.SaveContext(ctx, item)
+	}
+	return s.Save(item)
+}
+
+func loadWithContext(ctx context.Context, s Storage, to Loadable, id uint64) error {
+	if sc, ok := s.(StorageContext); ok {
+		return sc.LoadContext(ctx, to, id)
+	}
+	return s.Load(to, id)
+}
+
+func deleteWithContext(ctx context.Context, s Storage, item Loadable) error {
+	if sc, ok := s.(StorageContext); ok {
+		return sc.DeleteContext(ctx, item)
+	}
+	return s.Delete(item)
+}
+
+func selectWithContext(ctx context.Context, s Storage, proto Loadable, results *[]Loadable, order Orderer, skip int, condition string, args ...interface{}) error {
+	if sc, ok := s.(StorageContext); ok {
+		return sc.SelectContext(ctx, proto, results, order, skip, condition, args...)
+	}
+	return s.Select(proto, results, order, skip, condition, args...)
+}
+
+// Uses options only if storage supports them (see TransactionalStorageOptions)
+func transactionWithOptions(ctx context.Context, s TransactionalStorage, opts *sql.TxOptions, f func(t Transaction) error) error {
+	if so, ok := s.(TransactionalStorageOptions); ok && opts != nil {
+		return so.TransactionWithOptionsContext(ctx, opts, f)
+	}
+	return transactionWithContext(ctx, s, f)
+}
+
+func transactionWithContext(ctx context.Context, s TransactionalStorage, f func(t Transaction) error) error {
+	if sc, ok := s.(TransactionalStorageContext); ok {
+		return sc.TransactionContext(ctx, f)
+	}
+	return s.Transaction(f)
+}
+
+func saveAllWithContext(ctx context.Context, s BatchStorage, items []Storable) error {
+	if sc, ok := s.(interface {
+		SaveAllContext(ctx context.Context, items []Storable) error
+	}); ok {
+		return sc.SaveAllContext(ctx, items)
+	}
+	return s.SaveAll(items)
+}
+
+func upsertWithContext(ctx context.Context, s UpsertStorage, item Storable, conflictFields ...string) error {
+	if sc, ok := s.(interface {
+		UpsertContext(ctx context.Context, item Storable, conflictFields ...string) error
+	}); ok {
+		return sc.UpsertContext(ctx, item, conflictFields...)
+	}
+	return s.Upsert(item, conflictFields...)
+}
+
+func selectIterWithContext(ctx context.Context, s IterableStorage, proto Loadable, order Orderer, skip, limit int, condition string, args ...interface{}) (Cursor, error) {
+	if sc, ok := s.(interface {
+		SelectIterContext(ctx context.Context, proto Loadable, order Orderer, skip, limit int, condition string, args ...interface{}) (Cursor, error)
+	}); ok {
+		return sc.SelectIterContext(ctx, proto, order, skip, limit, condition, args...)
+	}
+	return s.SelectIter(proto, order, skip, limit, condition, args...)
+}
+
+func countWithContext(ctx context.Context, s AggregatingStorage, proto Loadable, condition string, args ...interface{}) (int64, error) {
+	if sc, ok := s.(interface {
+		CountContext(ctx context.Context, proto Loadable, condition string, args ...interface{}) (int64, error)
+	}); ok {
+		return sc.CountContext(ctx, proto, condition, args...)
+	}
+	return s.Count(proto, condition, args...)
+}
+
+func existsWithContext(ctx context.Context, s AggregatingStorage, proto Loadable, condition string, args ...interface{}) (bool, error) {
+	if sc, ok := s.(interface {
+		ExistsContext(ctx context.Context, proto Loadable, condition string, args ...interface{}) (bool, error)
+	}); ok {
+		return sc.ExistsContext(ctx, proto, condition, args...)
+	}
+	return s.Exists(proto, condition, args...)
+}
+
+func aggregateWithContext(ctx context.Context, s AggregatingStorage, proto Loadable, fn AggregateFunc, field string, condition string, args ...interface{}) (float64, error) {
+	if sc, ok := s.(interface {
+		AggregateContext(ctx context.Context, proto Loadable, fn AggregateFunc, field string, condition string, args ...interface{}) (float64, error)
+	}); ok {
+		return sc.AggregateContext(ctx, proto, fn, field, condition, args...)
+	}
+	return s.Aggregate(proto, fn, field, condition, args...)
+}
+
+// Loads item by key; if storage is not able to do this, items with single integer key are loaded with Load()
+func loadByKeyWithContext(ctx context.Context, s Storage, to Keyed, key Key) error {
+	if sc, ok := s.(interface {
+		LoadByKeyContext(ctx context.Context, to Keyed, key Key) error
+	}); ok {
+		return sc.LoadByKeyContext(ctx, to, key)
+	}
+	if ks, ok := s.(KeyedStorage); ok {
+		return ks.LoadByKey(to, key)
+	}
+	if len(key) == 1 {
+		if id, isInt := uint64Value(key[0]); isInt {
+			return loadWithContext(ctx, s, to, id)
+		}
+	}
+	return newError(ErrNotSupported, "Storage %T is not able to load items by key", s)
+}
+
+// Restores soft-deleted item; returns ErrNotSupported, if storage doesn't support soft deletion
+func restoreWithContext(ctx context.Context, s Storage, item SoftDeletable) error {
+	if sc, ok := s.(interface {
+		RestoreContext(ctx context.Context, item SoftDeletable) error
+	}); ok {
+		return sc.RestoreContext(ctx, item)
+	}
+	if sd, ok := s.(SoftDeleteStorage); ok {
+		return sd.Restore(item)
+	}
+	return newError(ErrNotSupported, "Storage %T is not able to restore items", s)
+}
+
+// Removes item permanently; storages, that don't support soft deletion, just delete it
+func purgeWithContext(ctx context.Context, s Storage, item Loadable) error {
+	if sc, ok := s.(interface {
+		PurgeContext(ctx context.Context, item Loadable) error
+	}); ok {
+		return sc.PurgeContext(ctx, item)
+	}
+	if sd, ok := s.(SoftDeleteStorage); ok {
+		return sd.Purge(item)
+	}
+	return deleteWithContext(ctx, s, item)
+}
+
+// Returns storage as Transaction. Storages, that don't support transactions, are wrapped
+// to autocommitTransaction: every their operation is commited immediately.
+func asTransaction(s Storage) Transaction {
+	if t, ok := s.(Transaction); ok {
+		return t
+	}
+	return &autocommitTransaction{s}
+}
+
+// Transaction of storage, that doesn't support them
+type autocommitTransaction struct {
+	Storage
+}
+
+// Changes are already commited, so f is called immediately
+func (t *autocommitTransaction) OnCommit(f func()) {
+	f()
+}
+
+// Changes are never rolled back, so f is never called
+func (t *autocommitTransaction) OnRollback(f func()) {}
+
+func (t *autocommitTransaction) SaveContext(ctx context.Context, item Storable) error {
+	return saveWithContext(ctx, t.Storage, item)
+}
+
+func (t *autocommitTransaction) LoadContext(ctx context.Context, to Loadable, id uint64) error {
+	return loadWithContext(ctx, t.Storage, to, id)
+}
+
+func (t *autocommitTransaction) DeleteContext(ctx context.Context, item Loadable) error {
+	return deleteWithContext(ctx, t.Storage, item)
+}
+
+func (t *autocommitTransaction) SelectContext(ctx context.Context, proto Loadable, results *[]Loadable, order Orderer, skip int, condition string, args ...interface{}) error {
+	return selectWithContext(ctx, t.Storage, proto, results, order, skip, condition, args...)
+}
@@ -0,0 +1,180 @@
+package ldbl
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// FieldConverter converts values of some Go type to DB representation and back.
+// Converters are used for fields, which initial values (returned by FieldsStruct()) are of registered type;
+// and for values of registered types, returned by Fields().
+type FieldConverter interface {
+	// Returns new pointer for scanning column value into
+	ScanTarget() interface{}
+	// Converts scanned value (pointer, returned by ScanTarget()) to field's value.
+	// Nil result means NULL: field will keep it's initial value.
+	FromDB(target interface{}) (interface{}, error)
+	// Converts field's value to the value, that could be passed to DB driver
+	ToDB(value interface{}) (interface{}, error)
+}
+
+var converters = struct {
+	sync.RWMutex
+	byType map[reflect.Type]FieldConverter
+}{byType: make(map[reflect.Type]FieldConverter)}
+
+var scannerType = reflect.TypeOf((*sql.Scanner)(nil)).Elem()
+
+func init() {
+	RegisterConverter(time.Duration(0), DurationConverter{})
+}
+
+// Registers converter for all values of the same type, as given example value has
+func RegisterConverter(example interface{}, c FieldConverter) {
+	converters.Lock()
+	defer converters.Unlock()
+	converters.byType[reflect.TypeOf(example)] = c
+}
+
+func converterFor(value interface{}) (FieldConverter, bool) {
+	if value == nil {
+		return nil, false
+	}
+	converters.RLock()
+	defer converters.RUnlock()
+	c, found := converters.byType[reflect.TypeOf(value)]
+	return c, found
+}
+
+// Converts field's value to the value, that will be passed to DB driver
+func toDbValue(value interface{}) (interface{}, error) {
+	if c, found := converterFor(value); found {
+		return c.ToDB(value)
+	}
+	return value, nil
+}
+
+// Returns placeholder for scanning column with given converter
+func converterScanTarget(c FieldConverter) (interface{}, scannedValue) {
+	p := c.ScanTarget()
+	return p, func() (interface{}, bool, error) {
+		value, err := c.FromDB(p)
+		return value, value != nil, err
+	}
+}
+
+// Returns placeholder for scanning column to the value of pointer type, or type, that implements sql.Scanner.
+// Returns false, if proto is not of such type.
+func reflectScanTarget(proto interface{}) (interface{}, scannedValue, bool) {
+	t := reflect.TypeOf(proto)
+	if t == nil {
+		return nil, nil, false
+	}
+	// NULL will be scanned as nil pointer, other values - to the value of pointed type
+	isPtr := t.Kind() == reflect.Ptr
+	if !isPtr && !reflect.PtrTo(t).Implements(scannerType) {
+		return nil, nil, false
+	}
+	p := reflect.New(t)
+	return p.Interface(), func() (interface{}, bool, error) {
+		return p.Elem().Interface(), true, nil
+	}, true
+}
+
+// Stores time.Duration as integer count of nanoseconds
+type DurationConverter struct{}
+
+func (c DurationConverter) ScanTarget() interface{} {
+	return new(sql.NullInt64)
+}
+
+func (c DurationConverter) FromDB(target interface{}) (interface{}, error) {
+	v := target.(*sql.NullInt64)
+	if !v.Valid {
+		return nil, nil
+	}
+	return time.Duration(v.Int64), nil
+}
+
+func (c DurationConverter) ToDB(value interface{}) (interface{}, error) {
+	return int64(value.(time.Duration)), nil
+}
+
+// Stores values (structs, maps, slices) as JSON text
+type JSONConverter struct {
+	t reflect.Type
+}
+
+// Creates converter for values of the same type, as given example value has.
+// Converter must be registered for using (see RegisterConverter()).
+func NewJSONConverter(example interface{}) *JSONConverter {
+	return &JSONConverter{t: reflect.TypeOf(example)}
+}
+
+func (c *JSONConverter) ScanTarget() interface{} {
+	return new([]byte)
+}
+
+func (c *JSONConverter) FromDB(target interface{}) (interface{}, error) {
+	data := *(target.(*[]byte))
+	if data == nil {
+		return nil, nil
+	}
+	p := reflect.New(c.t)
+	if err := json.Unmarshal(data, p.Interface()); err != nil {
+		return nil, err
+	}
+	return p.Elem().Interface(), nil
+}
+
+func (c *JSONConverter) ToDB(value interface{}) (interface{}, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+// Stores enumerable values by their names
+type EnumConverter struct {
+	byName  map[string]interface{}
+	byValue map[interface{}]string
+}
+
+// Creates converter for enum with given values (map keys are names of values, that are stored in DB).
+// All values must be of the same type; converter must be registered for it (see RegisterConverter()).
+func NewEnumConverter(values map[string]interface{}) *EnumConverter {
+	c := &EnumConverter{byName: values, byValue: make(map[interface{}]string, len(values))}
+	for name, value := range values {
+		c.byValue[value] = name
+	}
+	return c
+}
+
+func (c *EnumConverter) ScanTarget() interface{} {
+	return new(sql.NullString)
+}
+
+func (c *EnumConverter) FromDB(target interface{}) (interface{}, error) {
+	v := target.(*sql.NullString)
+	if !v.Valid {
+		return nil, nil
+	}
+	value, known := c.byName[v.String]
+	if !known {
+		return nil, fmt.Errorf("Unknown enum value: '%s'", v.String)
+	}
+	return value, nil
+}
+
+func (c *EnumConverter) ToDB(value interface{}) (interface{}, error) {
+	name, known := c.byValue[value]
+	if !known {
+		return nil, fmt.Errorf("Unknown enum value: %v", value)
+	}
+	return name, nil
+}
@@ -0,0 +1,86 @@
+package ldbl
+
+import (
+	"database/sql"
+)
+
+// Cursor over rows of SQL query result. Every row is filled to the new clone of prototype item.
+type sqlCursor struct {
+	storage  *SqlStorage
+	rows     *sql.Rows
+	columns  []string
+	selected []string // columns, requested by caller (nil if all of them)
+	proto    Loadable
+	limit    int // -1 means "no limit"
+	count    int
+	item     Loadable
+	err      error
+}
+
+func (c *sqlCursor) Next() bool {
+	if c.err != nil || c.rows == nil {
+		return false
+	}
+	if c.limit != -1 && c.count >= c.limit {
+		return false
+	}
+	if !c.rows.Next() {
+		c.err = c.rows.Err()
+		return false
+	}
+	clone := c.proto.Clone()
+	if err := c.storage.fillFromRow(c.rows, c.columns, clone); err != nil {
+		c.err = err
+		return false
+	}
+	markLoadedFields(clone, c.selected)
+	c.item = clone
+	c.count++
+	return true
+}
+
+func (c *sqlCursor) Item() Loadable {
+	return c.item
+}
+
+func (c *sqlCursor) Err() error {
+	return c.err
+}
+
+func (c *sqlCursor) Close() error {
+	if c.rows == nil {
+		return nil
+	}
+	return c.rows.Close()
+}
+
+// Cursor over already loaded items. Used for storages, that can't stream results.
+type sliceCursor struct {
+	items []Loadable
+	pos   int
+}
+
+func (c *sliceCursor) Next() bool {
+	if c.pos >= len(c.items) {
+		return false
+	}
+	c.pos++
+	return true
+}
+
+func (c *sliceCursor) Item() Loadable {
+	if c.pos == 0 {
+		return nil
+	}
+	return c.items[c.pos-1]
+}
+
+func (c *sliceCursor) Err() error {
+	return nil
+}
+
+func (c *sliceCursor) Close() error {
+	c.items = nil
+	c.pos = 0
+	return nil
+}
@@ -0,0 +1,412 @@
+package ldbl
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Dialect describes differences in SQL syntax of DB engines.
+// All queries are built with '?' placeholders and backend-neutral clauses,
+// and then adjusted by dialect of storage (or migrator), that performs them.
+type Dialect interface {
+	// Name of dialect (for logging)
+	Name() string
+	// Quotes identifier (name of table or column)
+	Quote(identifier string) string
+	// Converts query with '?' placeholders to form, that is supported by DB driver
+	Rebind(query string) string
+	// Returns clause for limiting results; limit <= 0 means "no limit"
+	LimitOffset(limit, offset int) string
+	// Returns clause, that will be added to INSERT query for getting id of created entry.
+	// Empty string means that sql.Result.LastInsertId() must be used instead.
+	ReturningId(pkName string) string
+	// Returns VALUES part of INSERT query for entry without fields
+	EmptyInsertValues() string
+	// Returns true, if ids of entries, created by one multi-row INSERT query, are consecutive (when LastInsertId()
+	// is used). Otherwise such entries are inserted one by one, because their ids can't be got.
+	ConsecutiveBatchIds() bool
+	// Returns id of first entry, created by multi-row INSERT query (when LastInsertId() is used)
+	BatchFirstId(lastInsertId int64, rowsCnt int) int64
+	// Max count of placeholders, allowed in one query
+	MaxParams() int
+	// Returns clause, that turns INSERT query to "insert or update" one:
+	// on conflict by conflictColumns, updateColumns of existing entry will be replaced with inserted values.
+	UpsertClause(conflictColumns, updateColumns []string) string
+	// Returns definition (for CREATE TABLE) of auto incremented integer primary key column
+	AutoIncrementPK(column string) string
+	// Returns column type (for CREATE TABLE) for storing date & time
+	DateTimeType() string
+	// Returns true for errors, after which operation could succeed, if it will be repeated
+	// (like deadlocks or serialization failures); see RetryPolicy
+	IsTransientError(err error) bool
+	// Returns true for errors of unique constraint violation, along with names of violated fields
+	// (nil, if DB doesn't report them); see UniqueViolationError
+	UniqueViolation(err error) (fields []string, isViolation bool)
+}
+
+// Implemented by storages, that builds queries with some Dialect
+type DialectProvider interface {
+	Dialect() Dialect
+}
+
+// Dialect used by default (by NewSqlStorage(), NewMigrator() & SqlQuery.Query())
+var DefaultDialect Dialect = SQLiteDialect{}
+
+// Dialect for SQLite databases
+type SQLiteDialect struct{}
+
+// Dialect for MySQL (and MariaDB) databases
+type MySQLDialect struct {
+	// Set it, if innodb_autoinc_lock_mode is 0 or 1, and auto_increment_increment is 1: then ids of rows,
+	// inserted by one query, are consecutive, and new items are saved by SaveAll() with multi-row INSERT queries
+	ConsecutiveAutoIncrement bool
+}
+
+// Dialect for PostgreSQL databases
+type PostgresDialect struct{}
+
+func (d SQLiteDialect) Name() string {
+	return "sqlite"
+}
+
+func (d SQLiteDialect) Quote(identifier string) string {
+	return quoteWith(identifier, "`")
+}
+
+func (d SQLiteDialect) Rebind(query string) string {
+	return query
+}
+
+func (d SQLiteDialect) LimitOffset(limit, offset int) string {
+	if limit <= 0 {
+		if offset <= 0 {
+			return ""
+		}
+		limit = -1
+	}
+	if offset <= 0 {
+		return fmt.Sprintf("LIMIT %d", limit)
+	}
+	return fmt.Sprintf("LIMIT %d OFFSET %d", limit, offset)
+}
+
+func (d SQLiteDialect) ReturningId(pkName string) string {
+	return ""
+}
+
+func (d SQLiteDialect) EmptyInsertValues() string {
+	return "DEFAULT VALUES"
+}
+
+// SQLite inserts rows of one query sequentially, under exclusive lock
+func (d SQLiteDialect) ConsecutiveBatchIds() bool {
+	return true
+}
+
+// SQLite returns id of last inserted row
+func (d SQLiteDialect) BatchFirstId(lastInsertId int64, rowsCnt int) int64 {
+	return lastInsertId - int64(rowsCnt) + 1
+}
+
+func (d SQLiteDialect) MaxParams() int {
+	return 999
+}
+
+func (d SQLiteDialect) UpsertClause(conflictColumns, updateColumns []string) string {
+	return onConflictClause(d, conflictColumns, updateColumns, "excluded")
+}
+
+func (d SQLiteDialect) AutoIncrementPK(column string) string {
+	return d.Quote(column) + " INTEGER PRIMARY KEY AUTOINCREMENT"
+}
+
+func (d SQLiteDialect) DateTimeType() string {
+	return "DATETIME"
+}
+
+// SQLITE_BUSY & SQLITE_LOCKED errors
+func (d SQLiteDialect) IsTransientError(err error) bool {
+	return errorMatches(err, func(e error) bool {
+		msg := e.Error()
+		return strings.Contains(msg, "database is locked") ||
+			strings.Contains(msg, "database table is locked") ||
+			strings.Contains(msg, "SQLITE_BUSY")
+	})
+}
+
+// SQLite reports violated columns like "UNIQUE constraint failed: users.email"
+func (d SQLiteDialect) UniqueViolation(err error) (fields []string, isViolation bool) {
+	isViolation = errorMatches(err, func(e error) bool {
+		msg := e.Error()
+		const prefix = "UNIQUE constraint failed: "
+		pos := strings.Index(msg, prefix)
+		if pos < 0 {
+			return false
+		}
+		for _, column := range strings.Split(msg[pos+len(prefix):], ",") {
+			column = strings.TrimSpace(column)
+			fields = append(fields, column[strings.LastIndex(column, ".")+1:])
+		}
+		return true
+	})
+	return fields, isViolation
+}
+
+func (d MySQLDialect) Name() string {
+	return "mysql"
+}
+
+func (d MySQLDialect) Quote(identifier string) string {
+	return quoteWith(identifier, "`")
+}
+
+func (d MySQLDialect) Rebind(query string) string {
+	return query
+}
+
+func (d MySQLDialect) LimitOffset(limit, offset int) string {
+	if limit <= 0 {
+		if offset <= 0 {
+			return ""
+		}
+		// MySQL has no syntax for offset without limit, so max possible value is used
+		return fmt.Sprintf("LIMIT %d, 18446744073709551615", offset)
+	}
+	if offset <= 0 {
+		return fmt.Sprintf("LIMIT %d", limit)
+	}
+	return fmt.Sprintf("LIMIT %d, %d", offset, limit)
+}
+
+func (d MySQLDialect) ReturningId(pkName string) string {
+	return ""
+}
+
+func (d MySQLDialect) EmptyInsertValues() string {
+	return "() VALUES ()"
+}
+
+// Ids could have gaps with "interleaved" lock mode (default since MySQL 8) or increment other than 1
+func (d MySQLDialect) ConsecutiveBatchIds() bool {
+	return d.ConsecutiveAutoIncrement
+}
+
+// MySQL returns id of first inserted row
+func (d MySQLDialect) BatchFirstId(lastInsertId int64, rowsCnt int) int64 {
+	return lastInsertId
+}
+
+func (d MySQLDialect) MaxParams() int {
+	return 65535
+}
+
+// MySQL doesn't allow to specify conflicting columns: any unique key is checked
+func (d MySQLDialect) UpsertClause(conflictColumns, updateColumns []string) string {
+	if len(updateColumns) == 0 && len(conflictColumns) > 0 {
+		// no-op update, just for skipping error on duplicate
+		column := d.Quote(conflictColumns[0])
+		return fmt.Sprintf("ON DUPLICATE KEY UPDATE %s=%s", column, column)
+	}
+	sets := make([]string, 0, len(updateColumns))
+	for _, column := range updateColumns {
+		sets = append(sets, fmt.Sprintf("%s=VALUES(%s)", d.Quote(column), d.Quote(column)))
+	}
+	return "ON DUPLICATE KEY UPDATE " + strings.Join(sets, ", ")
+}
+
+func (d MySQLDialect) AutoIncrementPK(column string) string {
+	return d.Quote(column) + " INTEGER PRIMARY KEY AUTO_INCREMENT"
+}
+
+func (d MySQLDialect) DateTimeType() string {
+	return "DATETIME"
+}
+
+// Deadlocks (1213) & lock wait timeouts (1205)
+func (d MySQLDialect) IsTransientError(err error) bool {
+	return errorMatches(err, func(e error) bool {
+		msg := e.Error()
+		return strings.HasPrefix(msg, "Error 1213") || strings.HasPrefix(msg, "Error 1205")
+	})
+}
+
+// MySQL reports only name of violated index, so fields are not returned
+func (d MySQLDialect) UniqueViolation(err error) (fields []string, isViolation bool) {
+	return nil, errorMatches(err, func(e error) bool {
+		return strings.HasPrefix(e.Error(), "Error 1062")
+	})
+}
+
+func (d PostgresDialect) Name() string {
+	return "postgres"
+}
+
+func (d PostgresDialect) Quote(identifier string) string {
+	return quoteWith(identifier, `"`)
+}
+
+// Replaces '?' placeholders with numbered ones ($1, $2, ...).
+// Question marks inside of quoted strings & identifiers are left as is.
+func (d PostgresDialect) Rebind(query string) string {
+	var b strings.Builder
+	b.Grow(len(query) + 8)
+	n := 0
+	var quote rune
+	for _, r := range query {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"':
+			quote = r
+		case r == '?':
+			n++
+			fmt.Fprintf(&b, "$%d", n)
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func (d PostgresDialect) LimitOffset(limit, offset int) string {
+	parts := make([]string, 0, 2)
+	if limit > 0 {
+		parts = append(parts, fmt.Sprintf("LIMIT %d", limit))
+	}
+	if offset > 0 {
+		parts = append(parts, fmt.Sprintf("OFFSET %d", offset))
+	}
+	return strings.Join(parts, " ")
+}
+
+func (d PostgresDialect) ReturningId(pkName string) string {
+	return "RETURNING " + d.Quote(pkName)
+}
+
+func (d PostgresDialect) EmptyInsertValues() string {
+	return "DEFAULT VALUES"
+}
+
+// Not used, because ids are returned by RETURNING clause
+func (d PostgresDialect) ConsecutiveBatchIds() bool {
+	return false
+}
+
+// Not used, because ids are returned by RETURNING clause
+func (d PostgresDialect) BatchFirstId(lastInsertId int64, rowsCnt int) int64 {
+	return lastInsertId
+}
+
+func (d PostgresDialect) MaxParams() int {
+	return 65535
+}
+
+func (d PostgresDialect) UpsertClause(conflictColumns, updateColumns []string) string {
+	return onConflictClause(d, conflictColumns, updateColumns, "EXCLUDED")
+}
+
+func (d PostgresDialect) AutoIncrementPK(column string) string {
+	return d.Quote(column) + " SERIAL PRIMARY KEY"
+}
+
+func (d PostgresDialect) DateTimeType() string {
+	return "TIMESTAMP"
+}
+
+// Serialization failures (40001) & deadlocks (40P01)
+func (d PostgresDialect) IsTransientError(err error) bool {
+	return errorMatches(err, func(e error) bool {
+		if coded, ok := e.(interface{ SQLState() string }); ok {
+			code := coded.SQLState()
+			return code == "40001" || code == "40P01"
+		}
+		msg := e.Error()
+		return strings.Contains(msg, "SQLSTATE 40001") || strings.Contains(msg, "SQLSTATE 40P01")
+	})
+}
+
+// Fields are returned, if error message contains details like "Key (email)=(...) already exists"
+func (d PostgresDialect) UniqueViolation(err error) (fields []string, isViolation bool) {
+	isViolation = errorMatches(err, func(e error) bool {
+		msg := e.Error()
+		if coded, ok := e.(interface{ SQLState() string }); ok {
+			if coded.SQLState() != "23505" {
+				return false
+			}
+		} else if !strings.Contains(msg, "SQLSTATE 23505") && !strings.Contains(msg, "duplicate key value violates unique constraint") {
+			return false
+		}
+		if start := strings.Index(msg, "Key ("); start >= 0 {
+			if end := strings.Index(msg[start:], ")="); end >= 0 {
+				for _, column := range strings.Split(msg[start+len("Key ("):start+end], ",") {
+					fields = append(fields, strings.Trim(strings.TrimSpace(column), `"`))
+				}
+			}
+		}
+		return true
+	})
+	return fields, isViolation
+}
+
+// Checks error and all errors, wrapped by it
+func errorMatches(err error, match func(e error) bool) bool {
+	for ; err != nil; err = errors.Unwrap(err) {
+		if match(err) {
+			return true
+		}
+	}
+	return false
+}
+
+// Builds "ON CONFLICT ... DO UPDATE" clause (SQLite & PostgreSQL syntax)
+func onConflictClause(d Dialect, conflictColumns, updateColumns []string, excluded string) string {
+	conflicts := make([]string, 0, len(conflictColumns))
+	for _, column := range conflictColumns {
+		conflicts = append(conflicts, d.Quote(column))
+	}
+	clause := fmt.Sprintf("ON CONFLICT (%s)", strings.Join(conflicts, ", "))
+	if len(updateColumns) == 0 {
+		return clause + " DO NOTHING"
+	}
+	sets := make([]string, 0, len(updateColumns))
+	for _, column := range updateColumns {
+		sets = append(sets, fmt.Sprintf("%s=%s.%s", d.Quote(column), excluded, d.Quote(column)))
+	}
+	return clause + " DO UPDATE SET " + strings.Join(sets, ", ")
+}
+
+func quoteWith(identifier, quote string) string {
+	return quote + strings.Replace(identifier, quote, quote+quote, -1) + quote
+}
+
+// Joins non-empty parts of query with spaces
+func joinSql(parts ...string) string {
+	nonEmpty := make([]string, 0, len(parts))
+	for _, p := range parts {
+		if p != "" {
+			nonEmpty = append(nonEmpty, p)
+		}
+	}
+	return strings.Join(nonEmpty, " ")
+}
+
+// Quotes all given identifiers and joins them with commas
+func quoteAll(d Dialect, identifiers []string) string {
+	quoted := make([]string, 0, len(identifiers))
+	for _, identifier := range identifiers {
+		quoted = append(quoted, d.Quote(identifier))
+	}
+	return strings.Join(quoted, ", ")
+}
+
+// Builds condition for matching all given columns with placeholders' values
+func equalsCondition(d Dialect, columns []string) string {
+	conditions := make([]string, 0, len(columns))
+	for _, column := range columns {
+		conditions = append(conditions, d.Quote(column)+"=?")
+	}
+	return strings.Join(conditions, " AND ")
+}
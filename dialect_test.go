@@ -0,0 +1,141 @@
+package ldbl_test
+
+import (
+	"errors"
+	"fmt"
+	"ldbl"
+	"testing"
+	"time"
+)
+
+func TestDialectQueries(t *testing.T) {
+	query := ldbl.
+		Select(&Image{}).
+		Where("filename LIKE ? AND filesize>?", "kitty%", 1024).
+		OrderBy("filesize", ldbl.ASC).
+		Limit(10).
+		Offset(20)
+	equals(t,
+		"SELECT * FROM `images` WHERE filename LIKE ? AND filesize>? ORDER BY filesize ASC LIMIT 10 OFFSET 20",
+		query.QueryFor(ldbl.SQLiteDialect{}))
+	equals(t,
+		"SELECT * FROM `images` WHERE filename LIKE ? AND filesize>? ORDER BY filesize ASC LIMIT 20, 10",
+		query.QueryFor(ldbl.MySQLDialect{}))
+	equals(t,
+		`SELECT * FROM "images" WHERE filename LIKE $1 AND filesize>$2 ORDER BY filesize ASC LIMIT 10 OFFSET 20`,
+		ldbl.PostgresDialect{}.Rebind(query.QueryFor(ldbl.PostgresDialect{})))
+
+	// Selected columns (primary key is selected always)
+	equals(t,
+		"SELECT `id`, `filename` FROM `images` WHERE id=?",
+		ldbl.Select(&Image{}).Columns("filename").Where("id=?", 1).QueryFor(ldbl.SQLiteDialect{}))
+
+	// No condition, ordering & limits
+	equals(t, "SELECT * FROM `images`", ldbl.Select(&Image{}).QueryFor(ldbl.SQLiteDialect{}))
+	equals(t, `SELECT * FROM "images"`, ldbl.Select(&Image{}).QueryFor(ldbl.PostgresDialect{}))
+
+	// Offset without limit
+	equals(t, "SELECT * FROM `images` LIMIT -1 OFFSET 5", ldbl.Select(&Image{}).Offset(5).QueryFor(ldbl.SQLiteDialect{}))
+	equals(t, "SELECT * FROM `images` LIMIT 5, 18446744073709551615", ldbl.Select(&Image{}).Offset(5).QueryFor(ldbl.MySQLDialect{}))
+	equals(t, `SELECT * FROM "images" OFFSET 5`, ldbl.Select(&Image{}).Offset(5).QueryFor(ldbl.PostgresDialect{}))
+}
+
+func TestDialectSyntax(t *testing.T) {
+	sqlite, mysql, pg := ldbl.SQLiteDialect{}, ldbl.MySQLDialect{}, ldbl.PostgresDialect{}
+
+	equals(t, "`weird``name`", sqlite.Quote("weird`name"))
+	equals(t, `"weird""name"`, pg.Quote(`weird"name`))
+
+	equals(t, "SELECT * FROM t WHERE a=? AND b='?'", mysql.Rebind("SELECT * FROM t WHERE a=? AND b='?'"))
+	equals(t, `SELECT * FROM t WHERE a=$1 AND b='?' AND "c?"=$2`, pg.Rebind(`SELECT * FROM t WHERE a=? AND b='?' AND "c?"=?`))
+
+	equals(t, "", sqlite.ReturningId("id"))
+	equals(t, "", mysql.ReturningId("id"))
+	equals(t, `RETURNING "id"`, pg.ReturningId("id"))
+
+	equals(t, "DEFAULT VALUES", sqlite.EmptyInsertValues())
+	equals(t, "() VALUES ()", mysql.EmptyInsertValues())
+	equals(t, "DEFAULT VALUES", pg.EmptyInsertValues())
+
+	equals(t, "`id` INTEGER PRIMARY KEY AUTOINCREMENT", sqlite.AutoIncrementPK("id"))
+	equals(t, "`id` INTEGER PRIMARY KEY AUTO_INCREMENT", mysql.AutoIncrementPK("id"))
+	equals(t, `"id" SERIAL PRIMARY KEY`, pg.AutoIncrementPK("id"))
+}
+
+func TestDialectUpsertClause(t *testing.T) {
+	conflict := []string{"email"}
+	update := []string{"images_cnt", "created"}
+	equals(t,
+		"ON CONFLICT (`email`) DO UPDATE SET `images_cnt`=excluded.`images_cnt`, `created`=excluded.`created`",
+		ldbl.SQLiteDialect{}.UpsertClause(conflict, update))
+	equals(t,
+		"ON DUPLICATE KEY UPDATE `images_cnt`=VALUES(`images_cnt`), `created`=VALUES(`created`)",
+		ldbl.MySQLDialect{}.UpsertClause(conflict, update))
+	equals(t,
+		`ON CONFLICT ("email") DO UPDATE SET "images_cnt"=EXCLUDED."images_cnt", "created"=EXCLUDED."created"`,
+		ldbl.PostgresDialect{}.UpsertClause(conflict, update))
+	equals(t, `ON CONFLICT ("email") DO NOTHING`, ldbl.PostgresDialect{}.UpsertClause(conflict, nil))
+}
+
+type sqlStateError string
+
+func (e sqlStateError) Error() string {
+	return "pq: test error"
+}
+func (e sqlStateError) SQLState() string {
+	return string(e)
+}
+
+func TestDialectTransientErrors(t *testing.T) {
+	sqlite, mysql, pg := ldbl.SQLiteDialect{}, ldbl.MySQLDialect{}, ldbl.PostgresDialect{}
+
+	assert(t, sqlite.IsTransientError(errors.New("database is locked")), "SQLITE_BUSY must be transient")
+	assert(t, sqlite.IsTransientError(fmt.Errorf("Saving failed: %w", errors.New("database table is locked"))), "Wrapped errors must be checked")
+	assert(t, !sqlite.IsTransientError(errors.New("no such table: users")), "Syntax errors must not be transient")
+	assert(t, !sqlite.IsTransientError(nil), "nil must not be transient")
+
+	assert(t, mysql.IsTransientError(errors.New("Error 1213: Deadlock found when trying to get lock")), "Deadlock must be transient")
+	assert(t, mysql.IsTransientError(errors.New("Error 1205: Lock wait timeout exceeded")), "Lock wait timeout must be transient")
+	assert(t, !mysql.IsTransientError(errors.New("Error 1062: Duplicate entry")), "Duplicates must not be transient")
+
+	assert(t, pg.IsTransientError(sqlStateError("40001")), "Serialization failure must be transient")
+	assert(t, pg.IsTransientError(sqlStateError("40P01")), "Deadlock must be transient")
+	assert(t, pg.IsTransientError(errors.New("ERROR: deadlock detected (SQLSTATE 40P01)")), "Deadlock must be transient")
+	assert(t, !pg.IsTransientError(sqlStateError("23505")), "Unique violation must not be transient")
+}
+
+func TestDialectBatchIds(t *testing.T) {
+	assert(t, ldbl.SQLiteDialect{}.ConsecutiveBatchIds(), "SQLite must insert rows with consecutive ids")
+	assert(t, !ldbl.MySQLDialect{}.ConsecutiveBatchIds(), "MySQL must not rely on consecutive ids by default")
+	assert(t, ldbl.MySQLDialect{ConsecutiveAutoIncrement: true}.ConsecutiveBatchIds(), "Consecutive ids must be enabled by option")
+}
+
+func TestDialectUniqueViolations(t *testing.T) {
+	sqlite, mysql, pg := ldbl.SQLiteDialect{}, ldbl.MySQLDialect{}, ldbl.PostgresDialect{}
+
+	fields, isViolation := sqlite.UniqueViolation(fmt.Errorf("Saving failed: %w", errors.New("UNIQUE constraint failed: image_tags.images_id, image_tags.tag")))
+	assert(t, isViolation, "Wrapped unique violation must be recognized")
+	equals(t, []string{"images_id", "tag"}, fields)
+	_, isViolation = sqlite.UniqueViolation(errors.New("NOT NULL constraint failed: users.email"))
+	assert(t, !isViolation, "Other constraints must not be recognized as unique violation")
+
+	fields, isViolation = mysql.UniqueViolation(errors.New("Error 1062: Duplicate entry 'me@safron.su' for key 'users_email'"))
+	assert(t, isViolation, "Duplicate entry must be recognized")
+	equals(t, []string(nil), fields)
+
+	_, isViolation = pg.UniqueViolation(sqlStateError("23505"))
+	assert(t, isViolation, "SQLSTATE 23505 must be recognized")
+	_, isViolation = pg.UniqueViolation(sqlStateError("40001"))
+	assert(t, !isViolation, "Serialization failure must not be recognized as unique violation")
+	fields, isViolation = pg.UniqueViolation(errors.New(`ERROR: duplicate key value violates unique constraint "users_email" Key (email)=(me@safron.su) already exists. (SQLSTATE 23505)`))
+	assert(t, isViolation, "Unique violation must be recognized by message")
+	equals(t, []string{"email"}, fields)
+}
+
+func TestExponentialBackoff(t *testing.T) {
+	backoff := ldbl.ExponentialBackoff(10*time.Millisecond, 50*time.Millisecond)
+	equals(t, 10*time.Millisecond, backoff(2))
+	equals(t, 20*time.Millisecond, backoff(3))
+	equals(t, 40*time.Millisecond, backoff(4))
+	equals(t, 50*time.Millisecond, backoff(5))
+}
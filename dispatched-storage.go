@@ -1,9 +1,14 @@
 package ldbl
 
 import (
+	"context"
+	"database/sql"
+	"errors"
 	"fmt"
 	"log"
+	"strings"
 	"sync"
+	"time"
 )
 
 const (
@@ -15,11 +20,20 @@ const (
 	UPDATED = "updated"
 	CREATE  = "create"
 	CREATED = "created"
+	// triggers of soft-deleted items (see SoftDeletable)
+	RESTORE  = "restore"
+	RESTORED = "restored"
+	PURGE    = "purge"
+	PURGED   = "purged"
 )
 
 // Describes trigger handler func
 type Handler func(item Loadable, t Transaction) error
 
+// Describes context-aware trigger handler func.
+// Context passed to it is the one, given to operation that pulled the trigger.
+type HandlerContext func(ctx context.Context, item Loadable, t Transaction) error
+
 // Extended storage component.
 // It wrapped around basic storage, and gives rich abilities for controlling all data manipulation processes,
 // such as: triggering events; creating, managing and checking relations; caching items.
@@ -29,13 +43,18 @@ type DispatchedStorage struct {
 	storage         Storage
 	relations       map[string]map[RelationType][]*Relation
 	cache           *ItemsCache
-	triggers        map[string][]Handler
+	triggers        map[string][]HandlerContext
+	validations     map[string][]*ValidationRules
+	uniques         map[string][][]string
 	transactSupport bool
+	retries         *RetryPolicy
+	clock           Clock
 }
 
 type TransactionWrapper struct {
-	t Transaction
-	s *DispatchedStorage
+	t   Transaction
+	s   *DispatchedStorage
+	ctx context.Context
 }
 
 // Use this func for creating new instances of DispatchedStorage.
@@ -45,27 +64,131 @@ func NewDispatchedStorage(s Storage) *DispatchedStorage {
 		storage:         s,
 		relations:       make(map[string]map[RelationType][]*Relation),
 		cache:           NewItemsCache(100),
-		triggers:        make(map[string][]Handler),
+		triggers:        make(map[string][]HandlerContext),
+		validations:     make(map[string][]*ValidationRules),
+		uniques:         make(map[string][][]string),
 		transactSupport: transactSupport,
+		clock:           SystemClock{},
 	}
 	ds.LogPrefix = "Dispatcher"
 	return ds
 }
 
 func (w *TransactionWrapper) Save(item Storable) error {
-	return w.s.save(item, w)
+	return w.s.save(w.ctx, item, w)
+}
+
+func (w *TransactionWrapper) SaveAll(items []Storable) error {
+	return w.s.saveAll(w.ctx, items, w)
+}
+
+func (w *TransactionWrapper) Upsert(item Storable, conflictFields ...string) error {
+	return w.s.upsert(w.ctx, item, conflictFields, w)
 }
 
 func (w *TransactionWrapper) Delete(item Loadable) error {
-	return w.s.delete(item, w)
+	return w.s.delete(w.ctx, item, w)
+}
+
+func (w *TransactionWrapper) Restore(item SoftDeletable) error {
+	return w.s.restore(w.ctx, item, w)
+}
+
+func (w *TransactionWrapper) Purge(item Loadable) error {
+	return w.s.purge(w.ctx, item, w)
 }
 
 func (w *TransactionWrapper) Load(to Loadable, id uint64) error {
-	return w.t.Load(to, id)
+	return loadWithContext(w.ctx, w.t, to, id)
+}
+
+func (w *TransactionWrapper) LoadByKey(to Keyed, key Key) error {
+	return loadByKeyWithContext(w.ctx, w.t, to, key)
 }
 
 func (w *TransactionWrapper) Select(proto Loadable, results *[]Loadable, order Orderer, skip int, condition string, args ...interface{}) error {
-	return w.t.Select(proto, results, order, skip, condition, args...)
+	return selectWithContext(w.ctx, w.t, proto, results, order, skip, condition, args...)
+}
+
+func (w *TransactionWrapper) SaveContext(ctx context.Context, item Storable) error {
+	return w.withContext(ctx).Save(item)
+}
+
+func (w *TransactionWrapper) DeleteContext(ctx context.Context, item Loadable) error {
+	return w.withContext(ctx).Delete(item)
+}
+
+func (w *TransactionWrapper) RestoreContext(ctx context.Context, item SoftDeletable) error {
+	return w.withContext(ctx).Restore(item)
+}
+
+func (w *TransactionWrapper) PurgeContext(ctx context.Context, item Loadable) error {
+	return w.withContext(ctx).Purge(item)
+}
+
+func (w *TransactionWrapper) LoadContext(ctx context.Context, to Loadable, id uint64) error {
+	return w.withContext(ctx).Load(to, id)
+}
+
+func (w *TransactionWrapper) LoadByKeyContext(ctx context.Context, to Keyed, key Key) error {
+	return w.withContext(ctx).LoadByKey(to, key)
+}
+
+func (w *TransactionWrapper) SelectContext(ctx context.Context, proto Loadable, results *[]Loadable, order Orderer, skip int, condition string, args ...interface{}) error {
+	return w.withContext(ctx).Select(proto, results, order, skip, condition, args...)
+}
+
+// Callback is called after commit of underlying transaction
+func (w *TransactionWrapper) OnCommit(f func()) {
+	w.t.OnCommit(f)
+}
+
+// Callback is called after rollback of underlying transaction
+func (w *TransactionWrapper) OnRollback(f func()) {
+	w.t.OnRollback(f)
+}
+
+// Performs nested transaction (if underlying storage supports them), so handlers can make
+// isolated part of work: when f returns error, only its changes are rolled back.
+func (w *TransactionWrapper) Transaction(f func(t Transaction) error) error {
+	return w.TransactionContext(w.ctx, f)
+}
+
+func (w *TransactionWrapper) TransactionContext(ctx context.Context, f func(t Transaction) error) error {
+	transactional, isTransactional := w.t.(TransactionalStorage)
+	if !isTransactional {
+		return f(w.withContext(ctx))
+	}
+	err := transactionWithContext(ctx, transactional, func(t Transaction) error {
+		return f(&TransactionWrapper{t: t, s: w.s, ctx: ctx})
+	})
+	if err != nil {
+		// items, saved by rolled back nested transaction, could be already cached
+		w.s.cache.Clear()
+	}
+	return err
+}
+
+func (w *TransactionWrapper) withContext(ctx context.Context) *TransactionWrapper {
+	return &TransactionWrapper{t: w.t, s: w.s, ctx: ctx}
+}
+
+// Sets policy of retrying Save() & Delete(), failed with transient errors (nil disables retries).
+// Whole operation (including triggers) is re-run on every attempt. Note, that retries should be enabled
+// either for DispatchedStorage, or for underlying storage (to not multiply count of attempts).
+func (s *DispatchedStorage) SetRetryPolicy(policy *RetryPolicy) *DispatchedStorage {
+	s.retries = policy
+	return s
+}
+
+// Sets source of time, which is used for filling timestamps of items (see Timestamped).
+// Clock is passed to underlying storage too (if it's ClockedStorage), so times of soft deletion are got from it.
+func (s *DispatchedStorage) SetClock(c Clock) *DispatchedStorage {
+	s.clock = c
+	if clocked, ok := s.storage.(ClockedStorage); ok {
+		clocked.UseClock(c)
+	}
+	return s
 }
 
 //TODO: doc
@@ -81,35 +204,176 @@ func (s *DispatchedStorage) SetLogger(logger *log.Logger) *DispatchedStorage {
 }
 
 func (s *DispatchedStorage) Save(item Storable) error {
+	return s.SaveContext(context.Background(), item)
+}
+
+func (s *DispatchedStorage) SaveContext(ctx context.Context, item Storable) error {
+	s.Lock()
+	defer s.Unlock()
+	state := saveItemState(item)
+	return retry(ctx, s.retries, s.dialect(), &s.OptionalLogger, func() error {
+		state.restore()
+		return s.performWithTransaction(ctx, nil, func(t Transaction) error {
+			err := s.save(ctx, item, &TransactionWrapper{s: s, t: t, ctx: ctx})
+			if err != nil {
+				s.cache.Clear() //TODO: needs a better decision? (problem: if transaction was rolled back, it can make items in cache outdated)
+			}
+			return err
+		})
+	})
+}
+
+// Saves all given items inside of one transaction. Triggers are pulled for every item,
+// but items are stored with one batch operation, if underlying storage supports it (see BatchStorage).
+func (s *DispatchedStorage) SaveAll(items []Storable) error {
+	return s.SaveAllContext(context.Background(), items)
+}
+
+func (s *DispatchedStorage) SaveAllContext(ctx context.Context, items []Storable) error {
 	s.Lock()
 	defer s.Unlock()
-	return s.performWithTransaction(func(t Transaction) error {
-		err := s.save(item, &TransactionWrapper{s: s, t: t})
+	return s.performWithTransaction(ctx, nil, func(t Transaction) error {
+		err := s.saveAll(ctx, items, &TransactionWrapper{s: s, t: t, ctx: ctx})
 		if err != nil {
-			s.cache.Clear() //TODO: needs a better decision? (problem: if transaction was rolled back, it can make items in cache outdated)
+			s.cache.Clear()
 		}
 		return err
 	})
 }
 
+// Inserts item, or updates existing one with the same values of conflictFields (see UpsertStorage).
+// Existing entry is looked up before saving, so CREATE or UPDATE triggers are pulled accordingly.
+func (s *DispatchedStorage) Upsert(item Storable, conflictFields ...string) error {
+	return s.UpsertContext(context.Background(), item, conflictFields...)
+}
+
+func (s *DispatchedStorage) UpsertContext(ctx context.Context, item Storable, conflictFields ...string) error {
+	s.Lock()
+	defer s.Unlock()
+	return s.performWithTransaction(ctx, nil, func(t Transaction) error {
+		err := s.upsert(ctx, item, conflictFields, &TransactionWrapper{s: s, t: t, ctx: ctx})
+		if err != nil {
+			s.cache.Clear()
+		}
+		return err
+	})
+}
+
+// Runs f inside of one transaction (if underlying storage supports them).
+// Operations made with given Transaction are dispatched as usual (triggers are pulled, relations are checked).
+func (s *DispatchedStorage) Transaction(f func(t Transaction) error) error {
+	return s.TransactionWithOptionsContext(context.Background(), nil, f)
+}
+
+func (s *DispatchedStorage) TransactionContext(ctx context.Context, f func(t Transaction) error) error {
+	return s.TransactionWithOptionsContext(ctx, nil, f)
+}
+
+// Same as Transaction(), but with isolation level & read-only mode, given by opts.
+// Options are ignored, if underlying storage doesn't support them (see TransactionalStorageOptions).
+func (s *DispatchedStorage) TransactionWithOptions(opts *sql.TxOptions, f func(t Transaction) error) error {
+	return s.TransactionWithOptionsContext(context.Background(), opts, f)
+}
+
+func (s *DispatchedStorage) TransactionWithOptionsContext(ctx context.Context, opts *sql.TxOptions, f func(t Transaction) error) error {
+	s.Lock()
+	defer s.Unlock()
+	return s.performWithTransaction(ctx, opts, func(t Transaction) error {
+		err := f(&TransactionWrapper{s: s, t: t, ctx: ctx})
+		if err != nil {
+			s.cache.Clear()
+		}
+		return err
+	})
+}
+
+// Deletes item along with items, related to it (by HAS_MANY relations).
+// If item is SoftDeletable, it's only marked as deleted, and so are related SoftDeletable items,
+// while related items, that can't be soft-deleted, are kept untouched.
 func (s *DispatchedStorage) Delete(item Loadable) error {
+	return s.DeleteContext(context.Background(), item)
+}
+
+func (s *DispatchedStorage) DeleteContext(ctx context.Context, item Loadable) error {
 	s.Lock()
 	defer s.Unlock()
-	return s.performWithTransaction(func(t Transaction) error {
-		err := s.delete(item, &TransactionWrapper{s: s, t: t})
+	state := saveItemState(item)
+	return retry(ctx, s.retries, s.dialect(), &s.OptionalLogger, func() error {
+		state.restore()
+		return s.performWithTransaction(ctx, nil, func(t Transaction) error {
+			err := s.delete(ctx, item, &TransactionWrapper{s: s, t: t, ctx: ctx})
+			if err != nil {
+				s.cache.Clear() //TODO: needs a better decision? (problem: if transaction was rolled back, it can make items in cache outdated)
+			}
+			return err
+		})
+	})
+}
+
+// Restores soft-deleted item (see SoftDeletable) along with related items, that were deleted together with it
+// (i.e. in the same transaction). Related items, deleted separately, are kept deleted.
+// Related parent items are checked, as on saving.
+func (s *DispatchedStorage) Restore(item SoftDeletable) error {
+	return s.RestoreContext(context.Background(), item)
+}
+
+func (s *DispatchedStorage) RestoreContext(ctx context.Context, item SoftDeletable) error {
+	s.Lock()
+	defer s.Unlock()
+	return s.performWithTransaction(ctx, nil, func(t Transaction) error {
+		err := s.restore(ctx, item, &TransactionWrapper{s: s, t: t, ctx: ctx})
+		if err != nil {
+			s.cache.Clear()
+		}
+		return err
+	})
+}
+
+// Deletes item permanently (even if it's SoftDeletable), along with all related items (including soft-deleted ones)
+func (s *DispatchedStorage) Purge(item Loadable) error {
+	return s.PurgeContext(context.Background(), item)
+}
+
+func (s *DispatchedStorage) PurgeContext(ctx context.Context, item Loadable) error {
+	s.Lock()
+	defer s.Unlock()
+	return s.performWithTransaction(ctx, nil, func(t Transaction) error {
+		err := s.purge(ctx, item, &TransactionWrapper{s: s, t: t, ctx: ctx})
 		if err != nil {
-			s.cache.Clear() //TODO: needs a better decision? (problem: if transaction was rolled back, it can make items in cache outdated)
+			s.cache.Clear()
 		}
 		return err
 	})
 }
 
 func (s *DispatchedStorage) Load(to Loadable, id uint64) error {
+	return s.LoadContext(context.Background(), to, id)
+}
+
+func (s *DispatchedStorage) LoadContext(ctx context.Context, to Loadable, id uint64) error {
 	if found := s.cache.Lookup(to, id); found {
 		return nil
 	}
 	s.RLock()
-	err := s.storage.Load(to, id)
+	err := loadWithContext(ctx, s.storage, to, id)
+	s.RUnlock()
+	if err == nil {
+		s.cache.Add(to)
+	}
+	return err
+}
+
+// Loads item with non-integer or composite key (see Keyed)
+func (s *DispatchedStorage) LoadByKey(to Keyed, key Key) error {
+	return s.LoadByKeyContext(context.Background(), to, key)
+}
+
+func (s *DispatchedStorage) LoadByKeyContext(ctx context.Context, to Keyed, key Key) error {
+	if found := s.cache.LookupKey(to, key); found {
+		return nil
+	}
+	s.RLock()
+	err := loadByKeyWithContext(ctx, s.storage, to, key)
 	s.RUnlock()
 	if err == nil {
 		s.cache.Add(to)
@@ -118,9 +382,81 @@ func (s *DispatchedStorage) Load(to Loadable, id uint64) error {
 }
 
 func (s *DispatchedStorage) Select(proto Loadable, results *[]Loadable, order Orderer, skip int, condition string, args ...interface{}) error {
+	return s.SelectContext(context.Background(), proto, results, order, skip, condition, args...)
+}
+
+func (s *DispatchedStorage) SelectContext(ctx context.Context, proto Loadable, results *[]Loadable, order Orderer, skip int, condition string, args ...interface{}) error {
+	s.RLock()
+	defer s.RUnlock()
+	return selectWithContext(ctx, s.storage, proto, results, order, skip, condition, args...)
+}
+
+// Returns count of items, that match condition. If underlying storage is not able to count items
+// (see AggregatingStorage), they are selected and counted.
+func (s *DispatchedStorage) Count(proto Loadable, condition string, args ...interface{}) (int64, error) {
+	return s.CountContext(context.Background(), proto, condition, args...)
+}
+
+func (s *DispatchedStorage) CountContext(ctx context.Context, proto Loadable, condition string, args ...interface{}) (int64, error) {
+	s.RLock()
+	defer s.RUnlock()
+	if aggregating, ok := s.storage.(AggregatingStorage); ok {
+		return countWithContext(ctx, aggregating, proto, condition, args...)
+	}
+	results := make([]Loadable, 0)
+	if err := selectWithContext(ctx, s.storage, proto, &results, nil, 0, condition, args...); err != nil {
+		return 0, err
+	}
+	return int64(len(results)), nil
+}
+
+// Returns true, if there is at least one item, that matches condition
+func (s *DispatchedStorage) Exists(proto Loadable, condition string, args ...interface{}) (bool, error) {
+	return s.ExistsContext(context.Background(), proto, condition, args...)
+}
+
+func (s *DispatchedStorage) ExistsContext(ctx context.Context, proto Loadable, condition string, args ...interface{}) (bool, error) {
+	if aggregating, ok := s.storage.(AggregatingStorage); ok {
+		s.RLock()
+		defer s.RUnlock()
+		return existsWithContext(ctx, aggregating, proto, condition, args...)
+	}
+	cnt, err := s.CountContext(ctx, proto, condition, args...)
+	return cnt > 0, err
+}
+
+// Returns value of aggregate function over field of items, that match condition.
+// Returns ErrNotSupported, if underlying storage is not able to aggregate items (see AggregatingStorage).
+func (s *DispatchedStorage) Aggregate(proto Loadable, fn AggregateFunc, field string, condition string, args ...interface{}) (float64, error) {
+	return s.AggregateContext(context.Background(), proto, fn, field, condition, args...)
+}
+
+func (s *DispatchedStorage) AggregateContext(ctx context.Context, proto Loadable, fn AggregateFunc, field string, condition string, args ...interface{}) (float64, error) {
+	s.RLock()
+	defer s.RUnlock()
+	if aggregating, ok := s.storage.(AggregatingStorage); ok {
+		return aggregateWithContext(ctx, aggregating, proto, fn, field, condition, args...)
+	}
+	return 0, newError(ErrNotSupported, "Storage %T is not able to aggregate items", s.storage)
+}
+
+// Returns cursor for iterating over selected items (see IterableStorage).
+// If underlying storage is not able to stream items, they will be selected all at once.
+// Limit <= 0 means "no limit".
+func (s *DispatchedStorage) SelectIter(proto Loadable, order Orderer, skip, limit int, condition string, args ...interface{}) (Cursor, error) {
 	s.RLock()
 	defer s.RUnlock()
-	return s.storage.Select(proto, results, order, skip, condition, args...)
+	if iterable, ok := s.storage.(IterableStorage); ok {
+		return iterable.SelectIter(proto, order, skip, limit, condition, args...)
+	}
+	if limit < 0 {
+		limit = 0
+	}
+	results := make([]Loadable, 0, limit)
+	if err := s.storage.Select(proto, &results, order, skip, condition, args...); err != nil {
+		return nil, err
+	}
+	return &sliceCursor{items: results}, nil
 }
 
 //TODO: doc
@@ -134,18 +470,48 @@ func (s *DispatchedStorage) RegisterRelation(relation *Relation) *DispatchedStor
 
 //TODO: doc
 func (s *DispatchedStorage) RegisterHandler(forItem Collectioned, triggerName string, h Handler) *DispatchedStorage {
+	return s.RegisterHandlerContext(forItem, triggerName, func(ctx context.Context, item Loadable, t Transaction) error {
+		return h(item, t)
+	})
+}
+
+// Same as RegisterHandler, but handler will receive context of operation, that pulled the trigger.
+func (s *DispatchedStorage) RegisterHandlerContext(forItem Collectioned, triggerName string, h HandlerContext) *DispatchedStorage {
 	fullName := forItem.CollectionName() + "." + triggerName
 	if _, inited := s.triggers[fullName]; !inited {
-		s.triggers[fullName] = make([]Handler, 0)
+		s.triggers[fullName] = make([]HandlerContext, 0)
 	}
 	s.triggers[fullName] = append(s.triggers[fullName], h)
 	s.Log("Handler added: %s.%s", forItem.CollectionName(), triggerName)
 	return s
 }
 
+// Registers rules of validation of collection's items. Items are validated on saving, before SAVE trigger;
+// if some of rules failed, saving returns ValidationErrors.
+func (s *DispatchedStorage) RegisterValidation(forItem Collectioned, rules *ValidationRules) *DispatchedStorage {
+	cname := forItem.CollectionName()
+	s.validations[cname] = append(s.validations[cname], rules)
+	s.Log("Validation rules added: %s", cname)
+	return s
+}
+
+// Registers unique constraint: combination of values of fields must be unique in collection.
+// Before saving, conflicting entry is looked up in the same transaction; if it's found, UniqueViolationError is returned.
+// For stored items constraint is checked only when some of fields are changed.
+func (s *DispatchedStorage) RegisterUnique(forItem Collectioned, fields ...string) *DispatchedStorage {
+	cname := forItem.CollectionName()
+	s.uniques[cname] = append(s.uniques[cname], fields)
+	s.Log("Unique constraint added: %s (%s)", cname, strings.Join(fields, ", "))
+	return s
+}
+
 //TODO: doc
 func (s *DispatchedStorage) PullTrigger(forItem Loadable, triggerName string) error {
-	return s.pullTrigger(forItem, triggerName, nil)
+	return s.PullTriggerContext(context.Background(), forItem, triggerName)
+}
+
+func (s *DispatchedStorage) PullTriggerContext(ctx context.Context, forItem Loadable, triggerName string) error {
+	return s.pullTrigger(ctx, forItem, triggerName, nil)
 }
 
 //TODO: implement
@@ -153,8 +519,8 @@ func (s *DispatchedStorage) PullTrigger(forItem Loadable, triggerName string) er
 func (s *DispatchedStorage) LoadSubitem(forItem, subitemProto Loadable, results *[]Loadable) error {
 	rel := s.lookupRelationBetween(forItem, subitemProto, HAS_ONE)
 	if rel == nil {
-		//TODO: custom error type
-		return fmt.Errorf(
+		return newError(
+			ErrRelationNotRegistered,
 			"No registered relation of type 'HAS_ONE' beetween '%s' & '%s'",
 			forItem.CollectionName(),
 			subitemProto.CollectionName())
@@ -167,26 +533,33 @@ func (s *DispatchedStorage) LoadSubitem(forItem, subitemProto Loadable, results
 func (s *DispatchedStorage) LoadSubitems(forItem, subitemProto Loadable, results *[]Loadable) error {
 	rel := s.lookupRelationBetween(forItem, subitemProto, HAS_MANY)
 	if rel == nil {
-		//TODO: custom error type
-		return fmt.Errorf(
+		return newError(
+			ErrRelationNotRegistered,
 			"No registered relation of type 'HAS_MANY' beetween '%s' & '%s'",
 			forItem.CollectionName(),
 			subitemProto.CollectionName())
 	}
-	cond := fmt.Sprintf("`%s`.`%s`=?", rel.To.CollectionName(), rel.ForeignKey)
-	return s.Select(subitemProto, results, nil, 0, cond, forItem.Id())
+	cond := s.fkCondition(rel)
+	return s.Select(subitemProto, results, nil, 0, cond, keyOf(forItem)...)
 }
 
 //TODO: doc
 func (s *DispatchedStorage) LoadParentItem(forItem, parentItem Loadable) error {
 	rel := s.lookupRelationBetween(forItem, parentItem, BELONGS_TO)
 	if rel == nil {
-		//TODO: custom error type
-		return fmt.Errorf(
+		return newError(
+			ErrRelationNotRegistered,
 			"No registered relation of type 'BELONGS_TO' beetween '%s' & '%s'",
 			forItem.CollectionName(),
 			parentItem.CollectionName())
 	}
+	if keyed, isKeyed := parentItem.(Keyed); isKeyed {
+		key, err := loadFkKey(forItem, rel)
+		if err != nil {
+			return err
+		}
+		return s.LoadByKey(keyed, key)
+	}
 	id, err := loadFkValue(forItem, rel)
 	if err != nil {
 		return err
@@ -194,14 +567,14 @@ func (s *DispatchedStorage) LoadParentItem(forItem, parentItem Loadable) error {
 	return s.Load(parentItem, id)
 }
 
-func (s *DispatchedStorage) performWithTransaction(f func(t Transaction) error) error {
+func (s *DispatchedStorage) performWithTransaction(ctx context.Context, opts *sql.TxOptions, f func(t Transaction) error) error {
 	if s.transactSupport {
-		return s.storage.(TransactionalStorage).Transaction(f)
+		return transactionWithOptions(ctx, s.storage.(TransactionalStorage), opts, f)
 	}
-	return f(s.storage.(Transaction))
+	return f(asTransaction(s.storage))
 }
 
-func (s *DispatchedStorage) pullTrigger(forItem Loadable, triggerName string, t Transaction) error {
+func (s *DispatchedStorage) pullTrigger(ctx context.Context, forItem Loadable, triggerName string, t Transaction) error {
 	fullName := forItem.CollectionName() + "." + triggerName
 	s.Log("Trigger '%s' pulled", fullName)
 	if _, inited := s.triggers[fullName]; !inited {
@@ -209,10 +582,10 @@ func (s *DispatchedStorage) pullTrigger(forItem Loadable, triggerName string, t
 	}
 	transaction := t
 	if transaction == nil {
-		transaction = s.storage.(Transaction)
+		transaction = asTransaction(s.storage)
 	}
 	for _, handler := range s.triggers[fullName] {
-		if err := handler(forItem, transaction); err != nil {
+		if err := handler(ctx, forItem, transaction); err != nil {
 			return err
 		}
 	}
@@ -249,66 +622,418 @@ func (s *DispatchedStorage) registerRelation(relation *Relation) {
 	s.Log("Relation added (%d): %s --> %s", relation.Type, relation.From.CollectionName(), relation.To.CollectionName())
 }
 
-func (s *DispatchedStorage) save(item Storable, t *TransactionWrapper) error {
+func (s *DispatchedStorage) save(ctx context.Context, item Storable, t *TransactionWrapper) error {
+	postTrigger, err := s.beforeSave(ctx, item, t)
+	if err != nil {
+		return err
+	}
+	if err := saveWithContext(ctx, t.t, item); err != nil {
+		s.evictIfStale(item, err)
+		return err
+	}
+	return s.afterSave(ctx, item, postTrigger, t)
+}
+
+func (s *DispatchedStorage) saveAll(ctx context.Context, items []Storable, t *TransactionWrapper) error {
+	postTriggers := make([]string, len(items))
+	for i, item := range items {
+		postTrigger, err := s.beforeSave(ctx, item, t)
+		if err != nil {
+			return err
+		}
+		postTriggers[i] = postTrigger
+	}
+	if batchStorage, ok := t.t.(BatchStorage); ok {
+		if err := saveAllWithContext(ctx, batchStorage, items); err != nil {
+			return err
+		}
+	} else {
+		for _, item := range items {
+			if err := saveWithContext(ctx, t.t, item); err != nil {
+				return err
+			}
+		}
+	}
+	for i, item := range items {
+		if err := s.afterSave(ctx, item, postTriggers[i], t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *DispatchedStorage) upsert(ctx context.Context, item Storable, conflictFields []string, t *TransactionWrapper) error {
+	// existence of entry is checked (not guessed by id), so CREATE or UPDATE triggers are pulled correctly
+	var exists bool
+	if len(conflictFields) > 0 {
+		existing, err := s.lookupByFields(ctx, item, conflictFields, t)
+		if err != nil {
+			return err
+		}
+		exists = existing != nil
+		if _, isKeyed := item.(Keyed); exists && !isKeyed && item.Id() == 0 {
+			// item becomes an existing one
+			item.Fill(existing.Id(), item.Fields())
+		}
+	} else {
+		var err error
+		if exists, err = s.existsByKey(ctx, item, t); err != nil {
+			return err
+		}
+	}
+	postTrigger, err := s.beforeSaveOf(ctx, item, exists, t)
+	if err != nil {
+		return err
+	}
+	if upserter, ok := t.t.(UpsertStorage); ok {
+		err = upsertWithContext(ctx, upserter, item, conflictFields...)
+	} else {
+		err = saveWithContext(ctx, t.t, item)
+	}
+	if err != nil {
+		s.evictIfStale(item, err)
+		return err
+	}
+	return s.afterSave(ctx, item, postTrigger, t)
+}
+
+// Looks up (inside of transaction) item of the same collection, that has the same values of given fields.
+// Returns nil, if there is no such item.
+func (s *DispatchedStorage) lookupByFields(ctx context.Context, item Storable, fields []string, t *TransactionWrapper) (Loadable, error) {
+	itemFields := item.Fields()
+	args := make([]interface{}, 0, len(fields))
+	for _, field := range fields {
+		value, present := itemFields[field]
+		if !present {
+			return nil, newError(ErrMissingField, "Can't lookup %s: no value for field '%s'", item.CollectionName(), field)
+		}
+		dbValue, err := toDbValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s.%s: %w", item.CollectionName(), field, err)
+		}
+		args = append(args, dbValue)
+	}
+	args = append(args, WithDeleted())
+	results := make([]Loadable, 0, 1)
+	if err := selectWithContext(ctx, t.t, item, &results, nil, 0, equalsCondition(s.dialect(), fields), args...); err != nil {
+		return nil, err
+	}
+	if len(results) == 0 {
+		return nil, nil
+	}
+	return results[0], nil
+}
+
+// Validates item, checks unique constraints & relations, pulls triggers before item saving. Returns name of trigger, that must be pulled after saving.
+func (s *DispatchedStorage) beforeSave(ctx context.Context, item Storable, t *TransactionWrapper) (string, error) {
+	exists, err := s.isStored(ctx, item, t)
+	if err != nil {
+		return "", err
+	}
+	return s.beforeSaveOf(ctx, item, exists, t)
+}
+
+// Same as beforeSave(), but it's known, whether item is already stored
+func (s *DispatchedStorage) beforeSaveOf(ctx context.Context, item Storable, exists bool, t *TransactionWrapper) (string, error) {
 	preTrigger := CREATE
 	postTrigger := CREATED
-	if item.Id() > 0 {
+	if exists {
 		preTrigger = UPDATE
 		postTrigger = UPDATED
 	}
-	if err := s.checkRelated(item); err != nil {
+	s.fillTimestamps(item, !exists)
+	if err := s.validate(ctx, item, !exists, t); err != nil {
+		return "", err
+	}
+	if err := s.checkUnique(ctx, item, !exists, t); err != nil {
+		return "", err
+	}
+	if err := s.checkRelated(ctx, item); err != nil {
+		return "", err
+	}
+	if err := s.pullTrigger(ctx, item, SAVE, t); err != nil {
+		return "", err
+	}
+	if err := s.pullTrigger(ctx, item, preTrigger, t); err != nil {
+		return "", err
+	}
+	return postTrigger, nil
+}
+
+// Checks registered validation rules & Validate() of item. Returns ValidationErrors, if item is not valid.
+func (s *DispatchedStorage) validate(ctx context.Context, item Storable, isNew bool, t *TransactionWrapper) error {
+	var errs ValidationErrors
+	for _, rules := range s.validations[item.CollectionName()] {
+		failed, unique := rules.validate(item)
+		errs = append(errs, failed...)
+		for _, rule := range unique {
+			if !isNew && !isAnyFieldChanged(item, rule.fields) {
+				continue
+			}
+			conflicting, err := s.conflictingItem(ctx, item, rule.fields, t)
+			if err != nil {
+				return err
+			}
+			if conflicting != nil {
+				errs = append(errs, FieldError{
+					Field:   strings.Join(rule.fields, ","),
+					Rule:    RuleUnique,
+					Message: fmt.Sprintf("Value is not unique (entry %s#%s has the same)", item.CollectionName(), keyOf(conflicting)),
+				})
+			}
+		}
+	}
+	if validatable, isValidatable := item.(Validatable); isValidatable {
+		if err := validatable.Validate(); err != nil {
+			errs = append(errs, validationErrorsOf(err)...)
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// Checks registered unique constraints (see RegisterUnique())
+func (s *DispatchedStorage) checkUnique(ctx context.Context, item Storable, isNew bool, t *TransactionWrapper) error {
+	for _, fields := range s.uniques[item.CollectionName()] {
+		if !areFieldsKnown(item, fields) || (!isNew && !isAnyFieldChanged(item, fields)) {
+			continue
+		}
+		conflicting, err := s.conflictingItem(ctx, item, fields, t)
+		if err != nil {
+			return err
+		}
+		if conflicting != nil {
+			return &UniqueViolationError{Collection: item.CollectionName(), Fields: fields}
+		}
+	}
+	return nil
+}
+
+// Looks up (inside of transaction) stored item, other than given one, that has the same values of fields.
+// Soft-deleted items are looked up too, as they are still stored. Returns nil, if there is no such item.
+func (s *DispatchedStorage) conflictingItem(ctx context.Context, item Storable, fields []string, t *TransactionWrapper) (Loadable, error) {
+	args := make([]interface{}, 0, len(fields)+1)
+	for _, field := range fields {
+		dbValue, err := toDbValue(validatedValue(item, field))
+		if err != nil {
+			return nil, fmt.Errorf("%s.%s: %w", item.CollectionName(), field, err)
+		}
+		args = append(args, dbValue)
+	}
+	args = append(args, WithDeleted())
+	results := make([]Loadable, 0, 2)
+	if err := selectWithContext(ctx, t.t, item, &results, nil, 0, equalsCondition(s.dialect(), fields), args...); err != nil {
+		return nil, err
+	}
+	for _, found := range results {
+		if keyOf(found).String() != keyOf(item).String() {
+			return found, nil
+		}
+	}
+	return nil, nil
+}
+
+// Sets times of creation (for new item) & update of Timestamped item
+func (s *DispatchedStorage) fillTimestamps(item Storable, isNew bool) {
+	timestamped, isTimestamped := item.(Timestamped)
+	setter, isSetter := item.(FieldsSetter)
+	if !isTimestamped || !isSetter {
+		return
+	}
+	now := s.clock.Now()
+	if field := timestamped.CreatedField(); field != "" && isNew && isEmptyTime(item.Fields()[field]) {
+		setter.SetField(field, now)
+	}
+	if field := timestamped.UpdatedField(); field != "" {
+		setter.SetField(field, now)
+	}
+}
+
+func isEmptyTime(v interface{}) bool {
+	switch t := v.(type) {
+	case nil:
+		return true
+	case time.Time:
+		return t.IsZero()
+	case *time.Time:
+		return t == nil || t.IsZero()
+	}
+	return false
+}
+
+// Returns true, if item is already stored. Keys of Keyed items are assigned by client,
+// so existence of such items is checked inside of transaction.
+func (s *DispatchedStorage) isStored(ctx context.Context, item Storable, t *TransactionWrapper) (bool, error) {
+	if _, isKeyed := item.(Keyed); !isKeyed {
+		return item.Id() > 0, nil
+	}
+	return s.existsByKey(ctx, item, t)
+}
+
+// Looks up (inside of transaction) entry with the same primary key, as item has (soft-deleted entries are looked up too)
+func (s *DispatchedStorage) existsByKey(ctx context.Context, item Storable, t *TransactionWrapper) (bool, error) {
+	key := keyOf(item)
+	if key.IsZero() {
+		return false, nil
+	}
+	args := make([]interface{}, 0, len(key)+1)
+	for i, v := range key {
+		dbValue, err := toDbValue(v)
+		if err != nil {
+			return false, fmt.Errorf("%s.%s: %w", item.CollectionName(), keyNamesOf(item)[i], err)
+		}
+		args = append(args, dbValue)
+	}
+	args = append(args, WithDeleted())
+	results := make([]Loadable, 0, 1)
+	if err := selectWithContext(ctx, t.t, item, &results, nil, 0, equalsCondition(s.dialect(), keyNamesOf(item)), args...); err != nil {
+		return false, err
+	}
+	return len(results) > 0, nil
+}
+
+func (s *DispatchedStorage) afterSave(ctx context.Context, item Storable, postTrigger string, t *TransactionWrapper) error {
+	if err := s.pullTrigger(ctx, item, postTrigger, t); err != nil {
 		return err
 	}
-	if err := s.pullTrigger(item, SAVE, t); err != nil {
+	if err := s.pullTrigger(ctx, item, SAVED, t); err != nil {
 		return err
 	}
-	if err := s.pullTrigger(item, preTrigger, t); err != nil {
+	s.cache.Add(item)
+	return nil
+}
+
+func (s *DispatchedStorage) delete(ctx context.Context, item Loadable, t *TransactionWrapper) error {
+	if err := s.pullTrigger(ctx, item, DELETE, t); err != nil {
 		return err
 	}
-	if err := t.t.Save(item); err != nil {
-		return nil
+	if err := s.deleteRelated(ctx, item, t); err != nil {
+		return err
 	}
-	if err := s.pullTrigger(item, postTrigger, t); err != nil {
+	s.cache.Remove(item)
+	if err := deleteWithContext(ctx, t.t, item); err != nil {
+		s.evictIfStale(item, err)
 		return err
 	}
-	if err := s.pullTrigger(item, SAVED, t); err != nil {
+	if err := s.pullTrigger(ctx, item, DELETED, t); err != nil {
 		return err
 	}
-	s.cache.Add(item)
 	return nil
 }
 
-func (s *DispatchedStorage) delete(item Loadable, t *TransactionWrapper) error {
-	if err := s.pullTrigger(item, DELETE, t); err != nil {
+func (s *DispatchedStorage) restore(ctx context.Context, item SoftDeletable, t *TransactionWrapper) error {
+	if err := s.checkRelated(ctx, item); err != nil {
 		return err
 	}
-	if err := s.deleteRelated(item, t); err != nil {
+	return s.restoreWithRelated(ctx, item, t)
+}
+
+// Restores item and related items, that were deleted at the same time with it
+func (s *DispatchedStorage) restoreWithRelated(ctx context.Context, item SoftDeletable, t *TransactionWrapper) error {
+	if err := s.pullTrigger(ctx, item, RESTORE, t); err != nil {
 		return err
 	}
-	s.cache.Remove(item)
-	if err := t.t.Delete(item); err != nil {
+	// related items are restored first, while time of item's deletion is still stored
+	if err := s.restoreRelated(ctx, item, t); err != nil {
 		return err
 	}
-	if err := s.pullTrigger(item, DELETED, t); err != nil {
+	if err := restoreWithContext(ctx, t.t, item); err != nil {
+		s.evictIfStale(item, err)
 		return err
 	}
+	return s.pullTrigger(ctx, item, RESTORED, t)
+}
+
+func (s *DispatchedStorage) purge(ctx context.Context, item Loadable, t *TransactionWrapper) error {
+	if err := s.pullTrigger(ctx, item, PURGE, t); err != nil {
+		return err
+	}
+	if err := s.purgeRelated(ctx, item, t); err != nil {
+		return err
+	}
+	s.cache.Remove(item)
+	if err := purgeWithContext(ctx, t.t, item); err != nil {
+		s.evictIfStale(item, err)
+		return err
+	}
+	return s.pullTrigger(ctx, item, PURGED, t)
+}
+
+// Removes item from cache, if error says that it's outdated
+func (s *DispatchedStorage) evictIfStale(item Loadable, err error) {
+	if errors.Is(err, ErrStaleObject) {
+		s.cache.Remove(item)
+	}
+}
+
+// Deletes related items. Soft deletion is cascaded only to SoftDeletable items, so it could be undone.
+func (s *DispatchedStorage) deleteRelated(ctx context.Context, forItem Loadable, t *TransactionWrapper) error {
+	_, softOnly := forItem.(SoftDeletable)
+	return s.forRelated(ctx, forItem, nil, softOnly, func(subitem Loadable) error {
+		return s.delete(ctx, subitem, t)
+	})
+}
+
+// Restores related items, that have the same time of deletion as forItem (so they were deleted along with it)
+func (s *DispatchedStorage) restoreRelated(ctx context.Context, forItem SoftDeletable, t *TransactionWrapper) error {
+	rels := s.getRelationsOfType(forItem, HAS_MANY)
+	if rels == nil {
+		return nil
+	}
+	d := s.dialect()
+	deletedAt := fmt.Sprintf(
+		"(SELECT %s FROM %s WHERE %s)",
+		d.Quote(forItem.DeletedField()), d.Quote(forItem.CollectionName()), equalsCondition(d, keyNamesOf(forItem)))
+	key := keyOf(forItem)
+	for _, rel := range rels {
+		softDeletable, isSoft := rel.To.(SoftDeletable)
+		if !isSoft {
+			continue
+		}
+		results := make([]Loadable, 0)
+		cond := fmt.Sprintf("%s AND %s.%s=%s", s.fkCondition(rel), d.Quote(rel.To.CollectionName()), d.Quote(softDeletable.DeletedField()), deletedAt)
+		args := append(append(append([]interface{}{}, key...), key...), OnlyDeleted())
+		if err := selectWithContext(ctx, t.t, rel.To, &results, nil, 0, cond, args...); err != nil {
+			return err
+		}
+		for _, subitem := range results {
+			if err := s.restoreWithRelated(ctx, subitem.(SoftDeletable), t); err != nil {
+				return err
+			}
+		}
+	}
 	return nil
 }
 
-func (s *DispatchedStorage) deleteRelated(forItem Loadable, t *TransactionWrapper) error {
+// Purges all related items, including soft-deleted ones
+func (s *DispatchedStorage) purgeRelated(ctx context.Context, forItem Loadable, t *TransactionWrapper) error {
+	return s.forRelated(ctx, forItem, []interface{}{WithDeleted()}, false, func(subitem Loadable) error {
+		return s.purge(ctx, subitem, t)
+	})
+}
+
+// Calls f for every item, related to forItem with HAS_MANY relations.
+// If softOnly is set, relations to items, that aren't SoftDeletable, are skipped.
+func (s *DispatchedStorage) forRelated(ctx context.Context, forItem Loadable, options []interface{}, softOnly bool, f func(subitem Loadable) error) error {
 	rels := s.getRelationsOfType(forItem, HAS_MANY)
 	//TODO: do for HAS_ONE
 	if rels == nil {
 		return nil
 	}
 	for _, rel := range rels {
+		if _, isSoft := rel.To.(SoftDeletable); softOnly && !isSoft {
+			continue
+		}
 		results := make([]Loadable, 0)
-		cond := fmt.Sprintf("`%s`.`%s`=?", rel.To.CollectionName(), rel.ForeignKey)
-		if err := s.storage.Select(rel.To, &results, nil, 0, cond, forItem.Id()); err != nil {
+		cond := s.fkCondition(rel)
+		args := append(append([]interface{}{}, keyOf(forItem)...), options...)
+		if err := selectWithContext(ctx, s.storage, rel.To, &results, nil, 0, cond, args...); err != nil {
 			return err
 		}
 		for _, subitem := range results {
-			if err := s.delete(subitem, t); err != nil {
+			if err := f(subitem); err != nil {
 				return err
 			}
 		}
@@ -316,32 +1041,67 @@ func (s *DispatchedStorage) deleteRelated(forItem Loadable, t *TransactionWrappe
 	return nil
 }
 
-func (s *DispatchedStorage) checkRelated(forItem Loadable) error {
+func (s *DispatchedStorage) checkRelated(ctx context.Context, forItem Loadable) error {
 	rels := s.getRelationsOfType(forItem, BELONGS_TO)
 	if rels == nil {
 		return nil
 	}
-	var id uint64
-	var err error
 	for _, rel := range rels {
-		id, err = loadFkValue(forItem, rel)
-		if err != nil {
-			return err
+		if !areFieldsKnown(forItem, rel.foreignKeys()) {
+			// foreign key of partially loaded item has initial value, which is not stored
+			continue
 		}
-		err = s.storage.Load(rel.To, id)
-		if err != nil {
-			//TODO: Custom error type
-			return fmt.Errorf(
-				"Can't load related item %s#%d, which linked in %s.%s",
+		key, err := s.loadRelated(ctx, forItem, rel)
+		if errors.Is(err, ErrNotFound) {
+			return newError(
+				ErrRelatedItemMissing,
+				"Can't load related item %s#%s, which linked in %s.%s",
 				rel.To.CollectionName(),
-				id,
+				key,
 				forItem.CollectionName(),
-				rel.ForeignKey)
+				strings.Join(rel.foreignKeys(), ","))
+		}
+		if err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
+// Loads item, referenced by forItem with given relation. Returns key of loaded item.
+func (s *DispatchedStorage) loadRelated(ctx context.Context, forItem Loadable, rel *Relation) (Key, error) {
+	if keyed, isKeyed := rel.To.(Keyed); isKeyed {
+		key, err := loadFkKey(forItem, rel)
+		if err != nil {
+			return nil, err
+		}
+		return key, loadByKeyWithContext(ctx, s.storage, keyed, key)
+	}
+	id, err := loadFkValue(forItem, rel)
+	if err != nil {
+		return nil, err
+	}
+	return Key{id}, loadWithContext(ctx, s.storage, rel.To, id)
+}
+
+// Returns dialect of underlying storage (if it's SQL storage) or DefaultDialect
+func (s *DispatchedStorage) dialect() Dialect {
+	if provider, ok := s.storage.(DialectProvider); ok {
+		return provider.Dialect()
+	}
+	return DefaultDialect
+}
+
+// Returns condition for selecting items, related by given relation (by foreign key)
+func (s *DispatchedStorage) fkCondition(rel *Relation) string {
+	d := s.dialect()
+	conditions := make([]string, 0, 1)
+	for _, fk := range rel.foreignKeys() {
+		conditions = append(conditions, fmt.Sprintf("%s.%s=?", d.Quote(rel.To.CollectionName()), d.Quote(fk)))
+	}
+	return strings.Join(conditions, " AND ")
+}
+
 func (s *DispatchedStorage) getRelationsOfType(forItem Loadable, t RelationType) []*Relation {
 	rels, _ := s.relations[forItem.CollectionName()][t]
 	return rels
@@ -352,19 +1112,45 @@ func loadFkValue(forItem Loadable, rel *Relation) (uint64, error) {
 	var gotId bool
 	if rel.GetForeignKeyFunc != nil {
 		id = rel.GetForeignKeyFunc()
-	} else if getter, isGetter := forItem.(FieldGetter); isGetter {
-		rawId := getter.Field(rel.ForeignKey)
+	} else if rawId, isGot := fkFieldValue(forItem, rel.ForeignKey); isGot {
 		if id, gotId = uint64Value(rawId); !gotId {
-			//TODO: Custom error type
-			return 0, fmt.Errorf("Foreign key %s.%s contains not uint64 value (%v)", forItem.CollectionName(), rel.ForeignKey, rawId)
+			return 0, newError(ErrInvalidForeignKey, "Foreign key %s.%s contains not uint64 value (%v)", forItem.CollectionName(), rel.ForeignKey, rawId)
 		}
 	} else {
-		//TODO: Custom error type
-		return 0, fmt.Errorf("Can't check related item of '%s' collection (when processing '%s')", forItem.CollectionName(), rel.To.CollectionName())
+		return 0, newError(ErrInvalidForeignKey, "Can't check related item of '%s' collection (when processing '%s')", forItem.CollectionName(), rel.To.CollectionName())
 	}
 	return id, nil
 }
 
+// Returns values of foreign keys, that reference item with composite (or non-integer) key
+func loadFkKey(forItem Loadable, rel *Relation) (Key, error) {
+	fks := rel.foreignKeys()
+	key := make(Key, 0, len(fks))
+	for _, fk := range fks {
+		value, isGot := fkFieldValue(forItem, fk)
+		if !isGot {
+			return nil, newError(ErrInvalidForeignKey, "Can't check related item of '%s' collection (when processing '%s')", forItem.CollectionName(), rel.To.CollectionName())
+		}
+		key = append(key, value)
+	}
+	return key, nil
+}
+
+// Returns value of foreign key field (it could be a part of forItem's own key)
+func fkFieldValue(forItem Loadable, fk string) (interface{}, bool) {
+	if keyed, isKeyed := forItem.(Keyed); isKeyed {
+		for i, name := range keyed.KeyNames() {
+			if name == fk {
+				return keyed.Key()[i], true
+			}
+		}
+	}
+	if getter, isGetter := forItem.(FieldGetter); isGetter {
+		return getter.Field(fk), true
+	}
+	return nil, false
+}
+
 func uint64Value(from interface{}) (v uint64, got bool) {
 	switch from.(type) {
 	case uint64:
@@ -373,6 +1159,8 @@ func uint64Value(from interface{}) (v uint64, got bool) {
 		return uint64(from.(uint)), true
 	case int:
 		return uint64(from.(int)), true
+	case int64:
+		return uint64(from.(int64)), true
 	}
 	return 0, false
 }
@@ -1,11 +1,16 @@
 package ldbl_test
 
 import (
+	"context"
+	"database/sql"
+	"errors"
 	"fmt"
 	"ldbl"
 	// "log"
 	// "os"
+	"regexp"
 	"testing"
+	"time"
 )
 
 type triggerCheck struct {
@@ -115,8 +120,11 @@ func TestRelations(t *testing.T) {
 	img.SetField("filename", "test.jpg")
 	img.SetField("users_id", uint64(100500))
 	err := S.Save(img)
-	//TODO: error type check
-	assert(t, err != nil, "Got nil error when trying to save *Image with incorrect foreign key")
+	assert(t, errors.Is(err, ldbl.ErrRelatedItemMissing), "Got wrong error when trying to save *Image with incorrect foreign key: %v", err)
+
+	// Not registered relations
+	err = S.LoadParentItem(user, &Image{})
+	assert(t, errors.Is(err, ldbl.ErrRelationNotRegistered), "Got wrong error when trying to load item by not registered relation: %v", err)
 
 	removeTestDb()
 }
@@ -194,3 +202,688 @@ func TestTransactions(t *testing.T) {
 	ok(t, S.Load(firstImage, imgId))         // Image remained in DB
 	removeTestDb()
 }
+
+type ctxKey string
+
+func TestHandlersContext(t *testing.T) {
+	// cleanup after previous tests
+	removeTestDb()
+	// and bootstraping some test data
+	ok(t, makeTestData(provideTestDb()))
+
+	S := provideDispatchedStorage()
+	var got interface{}
+	S.RegisterHandlerContext(&User{}, ldbl.SAVE, func(ctx context.Context, i ldbl.Loadable, tx ldbl.Transaction) error {
+		got = ctx.Value(ctxKey("request"))
+		return nil
+	})
+	user := &User{}
+	ok(t, S.Load(user, 1))
+	ctx := context.WithValue(context.Background(), ctxKey("request"), "test-request")
+	ok(t, S.SaveContext(ctx, user))
+	equals(t, "test-request", got)
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	assert(t, S.SaveContext(cancelled, user) != nil, "Saving with cancelled context must return non-nil error")
+
+	removeTestDb()
+}
+
+func TestBatchSavingTriggers(t *testing.T) {
+	// cleanup after previous tests
+	removeTestDb()
+	// and bootstraping some test data
+	ok(t, makeTestData(provideTestDb()))
+
+	S := provideDispatchedStorage()
+	initTriggers(S)
+	user := &User{}
+	testUserId := uint64(2)
+	ok(t, S.Load(user, testUserId))
+	imagesCount := user.ImagesCount
+
+	items := make([]ldbl.Storable, 0)
+	for i := 0; i < 3; i++ {
+		img := &Image{}
+		img.SetField("filename", "batch.jpg")
+		img.SetField("users_id", testUserId)
+		items = append(items, img)
+	}
+	ok(t, S.SaveAll(items))
+	ok(t, S.Load(user, testUserId)) // user needs to be updated
+	equals(t, imagesCount+len(items), user.ImagesCount)
+
+	// Whole batch must be rolled back, if one of items is not valid
+	img := &Image{}
+	img.SetField("filename", "batch.jpg")
+	img.SetField("users_id", uint64(100500))
+	valid := &Image{}
+	valid.SetField("filename", "batch.jpg")
+	valid.SetField("users_id", testUserId)
+	assert(t, S.SaveAll([]ldbl.Storable{valid, img}) != nil, "Got nil error when trying to save *Image with incorrect foreign key")
+	ok(t, S.Load(user, testUserId))
+	equals(t, imagesCount+len(items), user.ImagesCount)
+
+	removeTestDb()
+}
+
+func TestUpsertingTriggers(t *testing.T) {
+	// cleanup after previous tests
+	removeTestDb()
+	// and bootstraping some test data
+	ok(t, makeTestData(provideTestDb()))
+
+	S := provideDispatchedStorage()
+	check := initTriggers(S)
+
+	user := &User{Email: "me@safron.su", ImagesCount: 100}
+	ok(t, S.Upsert(user, "email"))
+	equals(t, uint64(1), user.Id())
+	assert(t, check.UPDATE, "UPDATE trigger was not pulled")
+	assert(t, check.UPDATED, "UPDATED trigger was not pulled")
+	assert(t, !check.CREATE, "CREATE trigger must not be pulled when existing item updated")
+
+	user = &User{Email: "new@test.com"}
+	ok(t, S.Upsert(user, "email"))
+	assert(t, user.Id() > 0, "Upserted item got no id")
+	assert(t, check.CREATE, "CREATE trigger was not pulled")
+	assert(t, check.CREATED, "CREATED trigger was not pulled")
+
+	// existence of entry is checked for items with explicit ids & keys
+	*check = triggerCheck{}
+	user = &User{id: 777, Email: "explicit@test.com"}
+	ok(t, S.Upsert(user))
+	assert(t, check.CREATE && check.CREATED, "CREATE triggers must be pulled for item with id, that is not stored")
+	assert(t, !check.UPDATE && !check.UPDATED, "UPDATE triggers must not be pulled for not stored item")
+	*check = triggerCheck{}
+	ok(t, S.Upsert(user))
+	assert(t, check.UPDATE && check.UPDATED, "UPDATE triggers must be pulled for stored item")
+	assert(t, !check.CREATE, "CREATE trigger must not be pulled for stored item")
+
+	pulled := make([]string, 0)
+	for _, trigger := range []string{ldbl.CREATED, ldbl.UPDATED} {
+		trigger := trigger
+		S.RegisterHandler(&ImageTag{}, trigger, func(i ldbl.Loadable, tx ldbl.Transaction) error {
+			pulled = append(pulled, trigger)
+			return nil
+		})
+	}
+	tag := &ImageTag{imageId: 1, tag: "dogs"}
+	ok(t, S.Upsert(tag))
+	tag.SetField("weight", int64(2))
+	ok(t, S.Upsert(tag))
+	equals(t, []string{ldbl.CREATED, ldbl.UPDATED}, pulled)
+
+	removeTestDb()
+}
+
+func TestStaleItemsEviction(t *testing.T) {
+	// cleanup after previous tests
+	removeTestDb()
+	// and bootstraping some test data
+	db := provideTestDb()
+	ok(t, makeTestData(db))
+
+	S := provideDispatchedStorage()
+	img := &VersionedImage{}
+	ok(t, S.Load(img, 1)) // now it's cached
+	_, err := db.Exec("UPDATE images SET version=version+1, filename='changed.jpg' WHERE id=1")
+	ok(t, err)
+	img.SetField("filesize", uint64(1))
+	err = S.Save(img)
+	assert(t, errors.Is(err, ldbl.ErrStaleObject), "Saving of outdated item must return ErrStaleObject (got: %v)", err)
+	reloaded := &VersionedImage{}
+	ok(t, S.Load(reloaded, 1))
+	equals(t, "changed.jpg", reloaded.Filename())
+
+	removeTestDb()
+}
+
+func TestNestedTransactionsInHandlers(t *testing.T) {
+	// cleanup after previous tests
+	removeTestDb()
+	// and bootstraping some test data
+	ok(t, makeTestData(provideTestDb()))
+
+	S := provideDispatchedStorage()
+	S.RegisterHandler(&User{}, ldbl.UPDATED, func(i ldbl.Loadable, tx ldbl.Transaction) error {
+		// Isolated part of work: it's failure must not break saving of user
+		err := tx.(ldbl.TransactionalStorage).Transaction(func(nested ldbl.Transaction) error {
+			images := make([]ldbl.Loadable, 0)
+			if err := nested.Select(&Image{}, &images, nil, 0, "users_id=?", i.Id()); err != nil {
+				return err
+			}
+			for _, img := range images {
+				if err := nested.Delete(img); err != nil {
+					return err
+				}
+			}
+			return fmt.Errorf("This is a test error that should lead to rollback a nested transaction")
+		})
+		assert(t, err != nil, "Error of nested transaction must be returned")
+		return nil
+	})
+	user := &User{}
+	ok(t, S.Load(user, 1))
+	user.ImagesCount = 42
+	ok(t, S.Save(user))
+
+	ok(t, S.Load(user, 1))
+	equals(t, 42, user.ImagesCount)
+	images := make([]ldbl.Loadable, 0)
+	ok(t, S.Select(&Image{}, &images, nil, 0, "users_id=?", 1))
+	assert(t, len(images) > 0, "Images must not be deleted by rolled back nested transaction")
+
+	// Items, saved by rolled back nested transaction, are not loaded from cache
+	ok(t, S.Transaction(func(tx ldbl.Transaction) error {
+		err := tx.(ldbl.TransactionalStorage).Transaction(func(nested ldbl.Transaction) error {
+			changed := &User{}
+			if err := nested.Load(changed, 2); err != nil {
+				return err
+			}
+			changed.ImagesCount = 999
+			if err := nested.Save(changed); err != nil {
+				return err
+			}
+			return fmt.Errorf("This is a test error that should lead to rollback a nested transaction")
+		})
+		assert(t, err != nil, "Error of nested transaction must be returned")
+		return nil
+	}))
+	loaded := &User{}
+	ok(t, S.Load(loaded, 2))
+	assert(t, loaded.ImagesCount != 999, "Changes of rolled back nested transaction must not be loaded")
+
+	removeTestDb()
+}
+
+// Records options of transactions, started by storage
+type txOptionsRecorder struct {
+	*ldbl.SqlStorage
+	opts []*sql.TxOptions
+}
+
+func (r *txOptionsRecorder) TransactionWithOptionsContext(ctx context.Context, opts *sql.TxOptions, f func(t ldbl.Transaction) error) error {
+	r.opts = append(r.opts, opts)
+	return r.SqlStorage.TransactionWithOptionsContext(ctx, opts, f)
+}
+
+func TestTransactionOptions(t *testing.T) {
+	// cleanup after previous tests
+	removeTestDb()
+	// and bootstraping some test data
+	ok(t, makeTestData(provideTestDb()))
+
+	recorder := &txOptionsRecorder{SqlStorage: provideSqlStorage()}
+	S := ldbl.NewDispatchedStorage(recorder)
+	S.RegisterRelation(ldbl.NewHasManyRelation(&User{}, &Image{}))
+	triggers := initTriggers(S)
+
+	// Read-only transaction
+	readOnly := &sql.TxOptions{ReadOnly: true}
+	users := make([]ldbl.Loadable, 0)
+	ok(t, S.TransactionWithOptions(readOnly, func(tx ldbl.Transaction) error {
+		return tx.Select(&User{}, &users, nil, 0, "")
+	}))
+	equals(t, TEST_USERS_CNT, len(users))
+	equals(t, []*sql.TxOptions{readOnly}, recorder.opts)
+
+	// Operations inside of transaction are dispatched
+	serializable := &sql.TxOptions{Isolation: sql.LevelSerializable}
+	ok(t, S.TransactionWithOptions(serializable, func(tx ldbl.Transaction) error {
+		user := &User{}
+		if err := tx.Load(user, 1); err != nil {
+			return err
+		}
+		user.ImagesCount = 5
+		return tx.Save(user)
+	}))
+	equals(t, serializable, recorder.opts[1])
+	assert(t, triggers.UPDATED, "Trigger UPDATED must be pulled inside of transaction")
+	user := &User{}
+	ok(t, recorder.Load(user, 1))
+	equals(t, 5, user.ImagesCount)
+
+	removeTestDb()
+}
+
+func TestTransactionCallbacksInHandlers(t *testing.T) {
+	// cleanup after previous tests
+	removeTestDb()
+	// and bootstraping some test data
+	ok(t, makeTestData(provideTestDb()))
+
+	S := provideDispatchedStorage()
+	sent := make([]uint64, 0)
+	failing := false
+	S.RegisterHandler(&User{}, ldbl.SAVED, func(i ldbl.Loadable, tx ldbl.Transaction) error {
+		tx.OnCommit(func() { sent = append(sent, i.Id()) })
+		if failing {
+			return fmt.Errorf("This is a test error that should lead to rollback a transaction")
+		}
+		return nil
+	})
+	user := &User{}
+	ok(t, S.Load(user, 1))
+	ok(t, S.Save(user))
+	equals(t, []uint64{1}, sent)
+
+	failing = true
+	assert(t, S.Save(user) != nil, "Error returned from trigger must be returned from save operation")
+	equals(t, []uint64{1}, sent) // callback of rolled back transaction is not called
+
+	removeTestDb()
+}
+
+func TestSavingRetries(t *testing.T) {
+	// cleanup after previous tests
+	removeTestDb()
+	// and bootstraping some test data
+	ok(t, makeTestData(provideTestDb()))
+
+	S := provideDispatchedStorage().SetRetryPolicy(&ldbl.RetryPolicy{MaxAttempts: 2})
+	attempts := 0
+	S.RegisterHandler(&User{}, ldbl.CREATED, func(i ldbl.Loadable, tx ldbl.Transaction) error {
+		attempts++
+		if attempts == 1 {
+			return errors.New("database is locked")
+		}
+		return nil
+	})
+	user := &User{Email: "retried@test.com"}
+	ok(t, S.Save(user))
+	equals(t, 2, attempts) // item is created again after rollback of the first attempt
+
+	users := make([]ldbl.Loadable, 0)
+	ok(t, S.Select(&User{}, &users, nil, 0, ""))
+	equals(t, TEST_USERS_CNT+1, len(users))
+	loaded := &User{}
+	ok(t, provideSqlStorage().Load(loaded, user.Id()))
+	equals(t, "retried@test.com", loaded.Email)
+
+	// Same with retries of underlying storage: item is created (not updated) by the next attempt
+	S = ldbl.NewDispatchedStorage(provideSqlStorage().SetRetryPolicy(&ldbl.RetryPolicy{MaxAttempts: 2}))
+	attempts = 0
+	S.RegisterHandler(&User{}, ldbl.CREATED, func(i ldbl.Loadable, tx ldbl.Transaction) error {
+		attempts++
+		if attempts == 1 {
+			return errors.New("database is locked")
+		}
+		return nil
+	})
+	user = &User{Email: "retried2@test.com"}
+	ok(t, S.Save(user))
+	equals(t, 2, attempts)
+	ok(t, provideSqlStorage().Load(loaded, user.Id()))
+	equals(t, "retried2@test.com", loaded.Email)
+
+	// Whole state of item is restored before the next attempt (timestamps, time of deletion, loaded fields)
+	now := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	T := provideDispatchedStorage().SetRetryPolicy(&ldbl.RetryPolicy{MaxAttempts: 2}).SetClock(ldbl.ClockFunc(func() time.Time {
+		now = now.Add(time.Second)
+		return now
+	}))
+	attempts = 0
+	T.RegisterHandler(&TimestampedImage{}, ldbl.CREATE, func(i ldbl.Loadable, tx ldbl.Transaction) error {
+		attempts++
+		if attempts == 1 {
+			return errors.New("database is locked")
+		}
+		return nil
+	})
+	img := &TimestampedImage{}
+	img.SetField("users_id", uint64(1))
+	img.SetField("filename", "retried.jpg")
+	ok(t, T.Save(img))
+	equals(t, 2, attempts)
+	assert(t, img.Created().Equal(now), "Time of creation must be set by the last attempt (got: %s)", img.Created())
+
+	T.RegisterHandler(&SoftImage{}, ldbl.DELETED, func(i ldbl.Loadable, tx ldbl.Transaction) error {
+		return errors.New("can't delete")
+	})
+	soft := &SoftImage{}
+	ok(t, T.Load(soft, 1))
+	deletedAt := soft.Field("deleted_at")
+	assert(t, T.Delete(soft) != nil, "Deletion must fail")
+	equals(t, deletedAt, soft.Field("deleted_at"))
+
+	results := make([]ldbl.Loadable, 0)
+	ok(t, T.Select(&SoftImage{}, &results, nil, 0, "id=?", 2, ldbl.WithColumns("filename")))
+	partial := results[0].(*SoftImage)
+	assert(t, T.Delete(partial) != nil, "Deletion must fail")
+	equals(t, []string{"filename"}, partial.LoadedFields())
+
+	removeTestDb()
+}
+
+func TestPartialItemsCaching(t *testing.T) {
+	// cleanup after previous tests
+	removeTestDb()
+	// and bootstraping some test data
+	ok(t, makeTestData(provideTestDb()))
+
+	S := provideDispatchedStorage()
+	img := &Image{}
+	ok(t, S.Load(img, 1)) // full item is cached
+
+	results := make([]ldbl.Loadable, 0)
+	ok(t, S.Select(&Image{}, &results, nil, 0, "id=?", 1, ldbl.WithColumns("filename")))
+	partial := results[0].(*Image)
+	partial.SetField("filename", "renamed.jpg")
+	ok(t, S.Save(partial))
+
+	// Partial item must not replace full one in cache, and outdated full item must be evicted
+	loaded := &Image{}
+	ok(t, S.Load(loaded, 1))
+	equals(t, "renamed.jpg", loaded.Filename())
+	equals(t, uint64(46555), loaded.Filesize())
+	assert(t, loaded.LoadedFields() == nil, "Item loaded from cache must not be partial")
+
+	removeTestDb()
+}
+
+func TestCompositeKeyRelations(t *testing.T) {
+	// cleanup after previous tests
+	removeTestDb()
+	// and bootstraping some test data
+	ok(t, makeTestData(provideTestDb()))
+
+	S := provideDispatchedStorage()
+	S.RegisterRelation(ldbl.NewHasManyRelation(&Image{}, &ImageTag{}))
+	S.RegisterRelation(ldbl.NewHasManyRelation(&ImageTag{}, &TagVote{}).WithFKs("images_id", "tag"))
+	// relation is kept as is, if no foreign keys given
+	rel := ldbl.NewHasManyRelation(&Image{}, &ImageTag{})
+	fk := rel.ForeignKey
+	equals(t, fk, rel.WithFKs().ForeignKey)
+	triggered := make([]string, 0)
+	S.RegisterHandler(&ImageTag{}, ldbl.CREATED, func(i ldbl.Loadable, tx ldbl.Transaction) error {
+		triggered = append(triggered, ldbl.CREATED)
+		return nil
+	})
+	S.RegisterHandler(&ImageTag{}, ldbl.UPDATED, func(i ldbl.Loadable, tx ldbl.Transaction) error {
+		triggered = append(triggered, ldbl.UPDATED)
+		return nil
+	})
+
+	tag := &ImageTag{imageId: 1, tag: "cats"}
+	ok(t, S.Save(tag))
+	tag.SetField("weight", int64(5))
+	ok(t, S.Save(tag))
+	equals(t, []string{ldbl.CREATED, ldbl.UPDATED}, triggered)
+
+	err := S.Save(&ImageTag{imageId: 100, tag: "cats"})
+	assert(t, errors.Is(err, ldbl.ErrRelatedItemMissing), "Saving of item with missing parent must fail (got: %v)", err)
+
+	vote := &TagVote{}
+	vote.SetField("images_id", uint64(1))
+	vote.SetField("tag", "cats")
+	vote.SetField("users_id", uint64(2))
+	ok(t, S.Save(vote))
+	missing := &TagVote{}
+	missing.SetField("images_id", uint64(1))
+	missing.SetField("tag", "dogs")
+	missing.SetField("users_id", uint64(2))
+	err = S.Save(missing)
+	assert(t, errors.Is(err, ldbl.ErrRelatedItemMissing), "Saving of vote for missing tag must fail (got: %v)", err)
+
+	parent := &ImageTag{}
+	ok(t, S.LoadParentItem(vote, parent))
+	equals(t, ldbl.Key{uint64(1), "cats"}, parent.Key())
+	equals(t, int64(5), parent.Field("weight"))
+	votes := make([]ldbl.Loadable, 0)
+	ok(t, S.LoadSubitems(parent, &TagVote{}, &votes))
+	equals(t, 1, len(votes))
+
+	// deleting of tag deletes it's votes
+	ok(t, S.Delete(parent))
+	cnt, err := S.Count(&TagVote{}, "")
+	ok(t, err)
+	equals(t, int64(0), cnt)
+	err = S.LoadByKey(&ImageTag{}, ldbl.Key{uint64(1), "cats"})
+	assert(t, errors.Is(err, ldbl.ErrNotFound), "Deleted item must not be loaded from cache (got: %v)", err)
+
+	removeTestDb()
+}
+
+func TestSoftDeletingRelations(t *testing.T) {
+	// cleanup after previous tests
+	removeTestDb()
+	// and bootstraping some test data
+	ok(t, makeTestData(provideTestDb()))
+
+	S := ldbl.NewDispatchedStorage(provideSqlStorage())
+	S.RegisterRelation(ldbl.NewHasManyRelation(&SoftUser{}, &SoftImage{}))
+	restored := false
+	S.RegisterHandler(&SoftUser{}, ldbl.RESTORED, func(i ldbl.Loadable, tx ldbl.Transaction) error {
+		restored = true
+		return nil
+	})
+	imagesOf := func(userId uint64, args ...interface{}) int64 {
+		cnt, err := S.Count(&SoftImage{}, "users_id=?", append([]interface{}{userId}, args...)...)
+		ok(t, err)
+		return cnt
+	}
+
+	images := make([]ldbl.Loadable, 0)
+	ok(t, S.Select(&SoftImage{}, &images, ldbl.OrderBy("id", ldbl.ASC), 0, "users_id=?", 2))
+	equals(t, 2, len(images))
+	// this one is deleted separately, before it's parent
+	deletedBefore := images[0].(*SoftImage)
+	ok(t, S.Delete(deletedBefore))
+
+	user := &SoftUser{}
+	ok(t, S.Load(user, 2))
+	ok(t, S.Delete(user))
+	err := S.Load(&SoftUser{}, 2)
+	assert(t, errors.Is(err, ldbl.ErrNotFound), "Soft-deleted item must not be loaded (got: %v)", err)
+	equals(t, int64(0), imagesOf(2))
+	equals(t, int64(2), imagesOf(2, ldbl.WithDeleted()))
+
+	// item can't be restored, while it's parent is deleted
+	err = S.Restore(images[1].(*SoftImage))
+	assert(t, errors.Is(err, ldbl.ErrRelatedItemMissing), "Restoring of item with deleted parent must fail (got: %v)", err)
+	// only items, deleted along with parent, are restored with it
+	ok(t, S.Restore(user))
+	assert(t, restored, "Trigger '%s' was not pulled", ldbl.RESTORED)
+	equals(t, int64(1), imagesOf(2))
+	ok(t, S.Load(&SoftImage{}, images[1].Id()))
+	ok(t, S.Restore(deletedBefore))
+	equals(t, int64(2), imagesOf(2))
+
+	// soft deletion is not cascaded to items, that can't be soft-deleted
+	H := ldbl.NewDispatchedStorage(provideSqlStorage())
+	H.RegisterRelation(ldbl.NewHasManyRelation(&SoftUser{}, &Image{}))
+	hardImagesOf := func(userId uint64) int64 {
+		cnt, err := H.Count(&Image{}, "users_id=?", userId)
+		ok(t, err)
+		return cnt
+	}
+	hardCnt := hardImagesOf(1)
+	assert(t, hardCnt > 0, "User must have images")
+	owner := &SoftUser{}
+	ok(t, H.Load(owner, 1))
+	ok(t, H.Delete(owner))
+	equals(t, hardCnt, hardImagesOf(1))
+	ok(t, H.Restore(owner))
+	ok(t, H.Load(&SoftUser{}, 1))
+	equals(t, hardCnt, hardImagesOf(1))
+
+	ok(t, S.Purge(user))
+	equals(t, int64(0), imagesOf(2, ldbl.WithDeleted()))
+	cnt, err := S.Count(&SoftUser{}, "", ldbl.WithDeleted())
+	ok(t, err)
+	equals(t, int64(1), cnt)
+
+	removeTestDb()
+}
+
+func TestTimestamps(t *testing.T) {
+	// cleanup after previous tests
+	removeTestDb()
+	// and bootstraping some test data
+	ok(t, makeTestData(provideTestDb()))
+
+	now := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	S := provideDispatchedStorage().SetClock(ldbl.ClockFunc(func() time.Time {
+		return now
+	}))
+	img := &TimestampedImage{}
+	img.SetField("users_id", uint64(1))
+	img.SetField("filename", "timestamped.jpg")
+	ok(t, S.Save(img))
+	created := now
+
+	now = now.Add(time.Hour)
+	img.SetField("filesize", uint64(1024))
+	ok(t, S.SaveAll([]ldbl.Storable{img}))
+
+	loaded := &TimestampedImage{}
+	ok(t, provideSqlStorage().Load(loaded, img.Id()))
+	assert(t, loaded.Created().Equal(created), "Time of creation must not be changed on update (got: %s)", loaded.Created())
+	updated, _ := loaded.Field("updated").(*time.Time)
+	assert(t, updated != nil && updated.Equal(now), "Time of update must be set from clock (got: %v)", loaded.Field("updated"))
+
+	// time of creation, given explicitly, is kept
+	given := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	img = &TimestampedImage{}
+	img.SetField("users_id", uint64(1))
+	img.SetField("filename", "imported.jpg")
+	img.SetField("created", given)
+	ok(t, S.Save(img))
+	equals(t, given, img.Created())
+
+	// time of soft deletion is got from the same clock
+	now = now.Add(time.Hour)
+	soft := &SoftImage{}
+	ok(t, S.Load(soft, 1))
+	ok(t, S.Delete(soft))
+	deleted := make([]ldbl.Loadable, 0)
+	ok(t, provideSqlStorage().Select(&SoftImage{}, &deleted, nil, 0, "id=?", 1, ldbl.OnlyDeleted()))
+	equals(t, 1, len(deleted))
+	deletedAt, _ := deleted[0].(*SoftImage).Field("deleted_at").(*time.Time)
+	assert(t, deletedAt != nil && deletedAt.Equal(now), "Time of deletion must be set from clock (got: %v)", deleted[0].(*SoftImage).Field("deleted_at"))
+
+	removeTestDb()
+}
+
+func TestValidation(t *testing.T) {
+	// cleanup after previous tests
+	removeTestDb()
+	// and bootstraping some test data
+	ok(t, makeTestData(provideTestDb()))
+
+	S := provideDispatchedStorage()
+	S.RegisterValidation(&Image{}, ldbl.NewValidationRules().
+		Required("filename", "users_id").
+		Length("filename", 5, 20).
+		Matches("filename", regexp.MustCompile(`\.jpg$`)).
+		Range("filesize", 1, 1024*1024).
+		OneOf("users_id", 1, 2).
+		Unique("filename"))
+	saved := false
+	S.RegisterHandler(&Image{}, ldbl.SAVE, func(i ldbl.Loadable, tx ldbl.Transaction) error {
+		saved = true
+		return nil
+	})
+	rulesOf := func(err error) map[string]string {
+		var errs ldbl.ValidationErrors
+		assert(t, errors.As(err, &errs), "ValidationErrors expected (got: %v)", err)
+		assert(t, errors.Is(err, ldbl.ErrValidationFailed), "Error must match ErrValidationFailed")
+		rules := make(map[string]string)
+		for _, fe := range errs {
+			rules[fe.Field] = fe.Rule
+		}
+		return rules
+	}
+
+	img := &Image{}
+	img.SetField("users_id", uint64(3))
+	img.SetField("filename", "kitty1.jpg")
+	img.SetField("filesize", uint64(2*1024*1024))
+	err := S.Save(img)
+	equals(t, map[string]string{"users_id": ldbl.RuleEnum, "filesize": ldbl.RuleRange, "filename": ldbl.RuleUnique}, rulesOf(err))
+	assert(t, !saved, "Trigger SAVE must not be pulled for invalid item")
+
+	img = &Image{}
+	img.SetField("filename", "a.png")
+	equals(t, map[string]string{"users_id": ldbl.RuleRequired, "filename": ldbl.RuleRegexp}, rulesOf(S.Save(img)))
+
+	// values of wrong types don't match rules
+	typed := &Image{}
+	typed.SetField("users_id", "1")
+	typed.SetField("filename", "typed.jpg")
+	typed.SetField("filesize", "big")
+	equals(t, map[string]string{"users_id": ldbl.RuleEnum, "filesize": ldbl.RuleRange}, rulesOf(S.Save(typed)))
+
+	img.SetField("users_id", uint64(2))
+	img.SetField("filename", "valid.jpg")
+	ok(t, S.Save(img))
+	img.SetField("filesize", uint64(100))
+	ok(t, S.Save(img)) // unchanged filename is not checked against itself
+	img.SetField("filename", "pig1.jpg")
+	equals(t, map[string]string{"filename": ldbl.RuleUnique}, rulesOf(S.Save(img)))
+
+	err = S.Save(&ValidatedUser{User{Email: "not-an-email"}})
+	equals(t, map[string]string{"email": "email"}, rulesOf(err))
+	ok(t, S.Save(&ValidatedUser{User{Email: "valid@test.com"}}))
+
+	removeTestDb()
+}
+
+func TestUniqueConstraints(t *testing.T) {
+	// cleanup after previous tests
+	removeTestDb()
+	// and bootstraping some test data
+	ok(t, makeTestData(provideTestDb()))
+
+	S := provideDispatchedStorage().RegisterUnique(&Image{}, "users_id", "filename")
+	newImage := func(userId uint64, filename string) *Image {
+		img := &Image{}
+		img.SetField("users_id", userId)
+		img.SetField("filename", filename)
+		return img
+	}
+
+	err := S.Save(newImage(1, "kitty1.jpg"))
+	var violation *ldbl.UniqueViolationError
+	assert(t, errors.As(err, &violation), "UniqueViolationError expected (got: %v)", err)
+	assert(t, errors.Is(err, ldbl.ErrUniqueViolation), "Error must match ErrUniqueViolation")
+	equals(t, []string{"users_id", "filename"}, violation.Fields)
+	assert(t, violation.Err == nil, "Violation must be found before saving")
+
+	img := newImage(2, "kitty1.jpg") // the same filename of another user
+	ok(t, S.Save(img))
+	img.SetField("filesize", uint64(100))
+	ok(t, S.Save(img))
+	img.SetField("filename", "pig1.jpg")
+	err = S.Save(img)
+	assert(t, errors.Is(err, ldbl.ErrUniqueViolation), "Changed item must be checked (got: %v)", err)
+
+	// violation, reported by DB, is returned as the same error
+	err = S.Save(&User{Email: "me@safron.su"})
+	assert(t, errors.As(err, &violation), "UniqueViolationError expected (got: %v)", err)
+	equals(t, []string{"email"}, violation.Fields)
+
+	// values of fields are compared in DB representation (see RegisterConverter())
+	ldbl.RegisterConverter(ImageMeta{}, ldbl.NewJSONConverter(ImageMeta{}))
+	ldbl.RegisterConverter(Draft, ldbl.NewEnumConverter(map[string]interface{}{
+		"draft":     Draft,
+		"published": Published,
+	}))
+	S = provideDispatchedStorage().RegisterUnique(&ConvertedImage{}, "meta", "status")
+	converted := &ConvertedImage{}
+	ok(t, S.Load(converted, 1))
+	converted.SetField("meta", ImageMeta{Width: 640, Height: 480})
+	converted.SetField("status", Published)
+	ok(t, S.Save(converted))
+	duplicate := &ConvertedImage{}
+	duplicate.SetField("users_id", uint64(2))
+	duplicate.SetField("filename", "duplicate.jpg")
+	duplicate.SetField("meta", ImageMeta{Width: 640, Height: 480})
+	duplicate.SetField("status", Published)
+	err = S.Save(duplicate)
+	assert(t, errors.Is(err, ldbl.ErrUniqueViolation), "Converted values must be checked (got: %v)", err)
+
+	removeTestDb()
+}
@@ -0,0 +1,136 @@
+package ldbl
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Sentinel errors. Errors returned by storages & other components are matching them with errors.Is().
+var (
+	// Requested entry is not exists in DB
+	ErrNotFound = errors.New("Not found")
+	// There is no registered relation between items
+	ErrRelationNotRegistered = errors.New("Relation not registered")
+	// Item, linked by foreign key, is not exists
+	ErrRelatedItemMissing = errors.New("Related item missing")
+	// Primary key of loaded entry has unsupported value
+	ErrInvalidPrimaryKey = errors.New("Invalid primary key")
+	// Foreign key of item can't be got or has unsupported value
+	ErrInvalidForeignKey = errors.New("Invalid foreign key")
+	// Item has no value for field, that is required for operation
+	ErrMissingField = errors.New("Missing field")
+	// Versioned item was changed or deleted by someone else since it was loaded (see Versioned)
+	ErrStaleObject = errors.New("Stale object")
+	// Operation (or some of it's parameters) is not supported by storage
+	ErrNotSupported = errors.New("Not supported")
+	// Item is not valid (see ValidationErrors)
+	ErrValidationFailed = errors.New("Validation failed")
+	// Item has the same values of unique fields, as already stored one (see UniqueViolationError)
+	ErrUniqueViolation = errors.New("Unique violation")
+)
+
+// Error with detailed message, that matches one of sentinel errors
+type detailedError struct {
+	kind error
+	msg  string
+}
+
+func newError(kind error, format string, args ...interface{}) error {
+	return &detailedError{kind: kind, msg: fmt.Sprintf(format, args...)}
+}
+
+func (e *detailedError) Error() string {
+	return e.msg
+}
+
+func (e *detailedError) Unwrap() error {
+	return e.kind
+}
+
+type StaleObjectError struct {
+	Collection string
+	Id         uint64
+	Key        Key // key of Keyed item (Id is 0 for such items)
+	Version    uint64
+}
+
+func newStaleObjectError(item Loadable, version uint64) *StaleObjectError {
+	err := &StaleObjectError{Collection: item.CollectionName(), Id: item.Id(), Version: version}
+	if keyed, isKeyed := item.(Keyed); isKeyed {
+		err.Key = append(Key{}, keyed.Key()...)
+	}
+	return err
+}
+
+func (e *StaleObjectError) Error() string {
+	entry := fmt.Sprintf("%s#%d", e.Collection, e.Id)
+	if e.Key != nil {
+		entry = fmt.Sprintf("%s#%s", e.Collection, e.Key)
+	}
+	return fmt.Sprintf("Entry %s of version %d is stale (it was changed or deleted since loading)", entry, e.Version)
+}
+
+func (e *StaleObjectError) Is(target error) bool {
+	return target == ErrStaleObject
+}
+
+// Returned, when item violates unique constraint: either found by DispatchedStorage (see RegisterUnique()),
+// or reported by DB (in this case Fields are empty, if DB doesn't report them; see Dialect.UniqueViolation()).
+type UniqueViolationError struct {
+	Collection string
+	Fields     []string
+	Err        error // error of DB driver (nil, if violation was found before saving)
+}
+
+func (e *UniqueViolationError) Error() string {
+	fields := "?"
+	if len(e.Fields) > 0 {
+		fields = strings.Join(e.Fields, ", ")
+	}
+	msg := fmt.Sprintf("Entry of %s with the same values of unique fields (%s) already exists", e.Collection, fields)
+	if e.Err != nil {
+		msg += " (" + e.Err.Error() + ")"
+	}
+	return msg
+}
+
+func (e *UniqueViolationError) Is(target error) bool {
+	return target == ErrUniqueViolation
+}
+
+func (e *UniqueViolationError) Unwrap() error {
+	return e.Err
+}
+
+// Returned by Migrator, when one of migrations failed
+type MigrationError struct {
+	Version int    // number of failed migration
+	Query   string // query of failed migration
+	Err     error
+}
+
+func (e *MigrationError) Error() string {
+	return fmt.Sprintf("Migration error: %s (Migration #%d: %s)", e.Err.Error(), e.Version, e.Query)
+}
+
+func (e *MigrationError) Unwrap() error {
+	return e.Err
+}
+
+// Returned, when transaction can't be rolled back. DB may be left in inconsistent state.
+type RollbackError struct {
+	Err         error // reason, because of which transaction was rolled back
+	RollbackErr error // error of rollback itself
+}
+
+func (e *RollbackError) Error() string {
+	return fmt.Sprintf(
+		"Can't rollback a transaction: %s (which must be rolled back because of: %s)",
+		e.RollbackErr.Error(),
+		e.Err.Error())
+}
+
+func (e *RollbackError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,139 @@
+package ldbl
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Extracts value of field after scanning. Returns false, if column contained NULL,
+// which can't be represented with type of field (so field must keep it's initial value).
+type scannedValue func() (interface{}, bool, error)
+
+// Returns placeholder for scanning column of untyped item.
+// Values of such columns are represented as strings (or nil for NULLs).
+func untypedScanTarget() (interface{}, scannedValue) {
+	p := new(sql.NullString)
+	return p, func() (interface{}, bool, error) {
+		if !p.Valid {
+			return nil, true, nil
+		}
+		return p.String, true, nil
+	}
+}
+
+// Returns placeholder for scanning column to the field, that has given initial value.
+// Registered converters (see RegisterConverter()) & sql.Scanner implementations are supported.
+// Pointers & sql.Null* types are used for nullable fields; NULLs are skipped for fields of other types.
+func typedScanTarget(proto interface{}) (interface{}, scannedValue) {
+	if c, found := converterFor(proto); found {
+		return converterScanTarget(c)
+	}
+	switch proto.(type) {
+	case int:
+		p := new(*int)
+		return p, func() (interface{}, bool, error) {
+			if *p == nil {
+				return nil, false, nil
+			}
+			return **p, true, nil
+		}
+	case int64:
+		p := new(*int64)
+		return p, func() (interface{}, bool, error) {
+			if *p == nil {
+				return nil, false, nil
+			}
+			return **p, true, nil
+		}
+	case uint64:
+		p := new(*uint64)
+		return p, func() (interface{}, bool, error) {
+			if *p == nil {
+				return nil, false, nil
+			}
+			return **p, true, nil
+		}
+	case float64:
+		p := new(*float64)
+		return p, func() (interface{}, bool, error) {
+			if *p == nil {
+				return nil, false, nil
+			}
+			return **p, true, nil
+		}
+	case bool:
+		p := new(*bool)
+		return p, func() (interface{}, bool, error) {
+			if *p == nil {
+				return nil, false, nil
+			}
+			return **p, true, nil
+		}
+	case []byte:
+		p := new([]byte)
+		return p, func() (interface{}, bool, error) {
+			if *p == nil {
+				return nil, false, nil
+			}
+			return *p, true, nil
+		}
+	case time.Time:
+		p := new(*time.Time)
+		return p, func() (interface{}, bool, error) {
+			if *p == nil {
+				return nil, false, nil
+			}
+			return **p, true, nil
+		}
+	case *int:
+		p := new(*int)
+		return p, func() (interface{}, bool, error) { return *p, true, nil }
+	case *int64:
+		p := new(*int64)
+		return p, func() (interface{}, bool, error) { return *p, true, nil }
+	case *uint64:
+		p := new(*uint64)
+		return p, func() (interface{}, bool, error) { return *p, true, nil }
+	case *float64:
+		p := new(*float64)
+		return p, func() (interface{}, bool, error) { return *p, true, nil }
+	case *bool:
+		p := new(*bool)
+		return p, func() (interface{}, bool, error) { return *p, true, nil }
+	case *string:
+		p := new(*string)
+		return p, func() (interface{}, bool, error) { return *p, true, nil }
+	case *time.Time:
+		p := new(*time.Time)
+		return p, func() (interface{}, bool, error) { return *p, true, nil }
+	case sql.NullInt64:
+		p := new(sql.NullInt64)
+		return p, func() (interface{}, bool, error) { return *p, true, nil }
+	case sql.NullInt32:
+		p := new(sql.NullInt32)
+		return p, func() (interface{}, bool, error) { return *p, true, nil }
+	case sql.NullFloat64:
+		p := new(sql.NullFloat64)
+		return p, func() (interface{}, bool, error) { return *p, true, nil }
+	case sql.NullBool:
+		p := new(sql.NullBool)
+		return p, func() (interface{}, bool, error) { return *p, true, nil }
+	case sql.NullString:
+		p := new(sql.NullString)
+		return p, func() (interface{}, bool, error) { return *p, true, nil }
+	case sql.NullTime:
+		p := new(sql.NullTime)
+		return p, func() (interface{}, bool, error) { return *p, true, nil }
+	}
+	if p, value, ok := reflectScanTarget(proto); ok {
+		return p, value
+	}
+	// trying to convert all other types to string
+	p := new(*string)
+	return p, func() (interface{}, bool, error) {
+		if *p == nil {
+			return nil, false, nil
+		}
+		return **p, true, nil
+	}
+}
@@ -0,0 +1,195 @@
+package ldbl
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Generates ids of new items, so they are known before insert (see SqlStorage.SetIdGenerator()).
+// Returned zero id means "id is assigned by DB" (auto-increment).
+// Storage is the one, that is inserting item (it could be scoped to transaction).
+type IdGenerator interface {
+	NextId(ctx context.Context, s *SqlStorage, collection string) (uint64, error)
+}
+
+// Leaves id assigning to DB (this is the default behaviour of SqlStorage)
+type AutoIncrementGenerator struct{}
+
+func (g AutoIncrementGenerator) NextId(ctx context.Context, s *SqlStorage, collection string) (uint64, error) {
+	return 0, nil
+}
+
+// Generates random positive 63-bit ids. Probability of collision is negligible for most of tables,
+// but it's still possible (such insert will fail with error of unique constraint).
+type RandomIdGenerator struct{}
+
+func (g RandomIdGenerator) NextId(ctx context.Context, s *SqlStorage, collection string) (uint64, error) {
+	buf := make([]byte, 8)
+	for {
+		if _, err := rand.Read(buf); err != nil {
+			return 0, err
+		}
+		if id := binary.BigEndian.Uint64(buf) &^ (1 << 63); id != 0 {
+			return id, nil
+		}
+	}
+}
+
+const (
+	snowflakeNodeBits = 10
+	snowflakeSeqBits  = 12
+	snowflakeMaxNode  = 1<<snowflakeNodeBits - 1
+	snowflakeMaxSeq   = 1<<snowflakeSeqBits - 1
+)
+
+// Default epoch of SnowflakeGenerator
+var SnowflakeEpoch = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Generates time-ordered ids: 41 bits of milliseconds since epoch, 10 bits of node number & 12 bits of sequence
+// (so, up to 4096 ids per millisecond on every node). Every process, that inserts items, must have unique node number.
+type SnowflakeGenerator struct {
+	sync.Mutex
+	node   uint64
+	epoch  time.Time
+	lastMs int64
+	seq    uint64
+	now    func() time.Time
+}
+
+// Node number must be in range [0, 1023]
+func NewSnowflakeGenerator(node int) (*SnowflakeGenerator, error) {
+	if node < 0 || node > snowflakeMaxNode {
+		return nil, fmt.Errorf("Node number of SnowflakeGenerator must be in range [0, %d] (got: %d)", snowflakeMaxNode, node)
+	}
+	return &SnowflakeGenerator{node: uint64(node), epoch: SnowflakeEpoch, now: time.Now}, nil
+}
+
+// Sets epoch, from which timestamps of ids are counted (must not be changed after ids were generated)
+func (g *SnowflakeGenerator) SetEpoch(epoch time.Time) *SnowflakeGenerator {
+	g.epoch = epoch
+	return g
+}
+
+func (g *SnowflakeGenerator) NextId(ctx context.Context, s *SqlStorage, collection string) (uint64, error) {
+	g.Lock()
+	defer g.Unlock()
+	ms := g.now().Sub(g.epoch).Milliseconds()
+	if ms < g.lastMs {
+		// clock went backwards: keep on counting from the last timestamp
+		ms = g.lastMs
+	}
+	if ms == g.lastMs {
+		g.seq = (g.seq + 1) & snowflakeMaxSeq
+		if g.seq == 0 {
+			// sequence is exhausted: wait for the next millisecond
+			for ms <= g.lastMs {
+				time.Sleep(100 * time.Microsecond)
+				ms = g.now().Sub(g.epoch).Milliseconds()
+			}
+		}
+	} else {
+		g.seq = 0
+	}
+	g.lastMs = ms
+	return uint64(ms)<<(snowflakeNodeBits+snowflakeSeqBits) | g.node<<snowflakeSeqBits | g.seq, nil
+}
+
+// Allocates blocks of ids from sequence table: the "high" part of id is taken from table (one query per block),
+// and the "low" part is counted in memory. Ids are unique among all processes, that use the same table.
+// Block is allocated in it's own short transaction, so it's not returned, if transaction of inserted items
+// is rolled back (ids of such items are just skipped). Note that DB must allow more than one open connection.
+// Sequence table must be created before usage (see Migration()).
+type HiLoGenerator struct {
+	sync.Mutex
+	blockSize uint64
+	table     string
+	blocks    map[string]*hiLoBlock
+}
+
+type hiLoBlock struct {
+	next uint64
+	last uint64
+}
+
+func NewHiLoGenerator(blockSize int) *HiLoGenerator {
+	if blockSize < 1 {
+		blockSize = 1
+	}
+	return &HiLoGenerator{blockSize: uint64(blockSize), table: "ldbl_sequence", blocks: make(map[string]*hiLoBlock)}
+}
+
+// Sets name of sequence table
+func (g *HiLoGenerator) SetTable(name string) *HiLoGenerator {
+	g.table = name
+	return g
+}
+
+// Returns migration, that creates sequence table
+func (g *HiLoGenerator) Migration(d Dialect) Migration {
+	return Migration{
+		Up: fmt.Sprintf(
+			"CREATE TABLE %s (%s VARCHAR(255) NOT NULL PRIMARY KEY, %s BIGINT NOT NULL)",
+			d.Quote(g.table), d.Quote("name"), d.Quote("next_hi")),
+		Down: fmt.Sprintf("DROP TABLE %s", d.Quote(g.table)),
+	}
+}
+
+func (g *HiLoGenerator) NextId(ctx context.Context, s *SqlStorage, collection string) (uint64, error) {
+	g.Lock()
+	defer g.Unlock()
+	block, allocated := g.blocks[collection]
+	if !allocated || block.next > block.last {
+		hi, err := g.allocate(ctx, s, collection)
+		if err != nil {
+			return 0, err
+		}
+		block = &hiLoBlock{next: hi*g.blockSize + 1, last: (hi + 1) * g.blockSize}
+		g.blocks[collection] = block
+	}
+	id := block.next
+	block.next++
+	return id, nil
+}
+
+// Takes next "high" value from sequence table. Update & select are made in separate transaction on DB
+// (not in the one of s): it's commited at once, so sequence row is not locked till the end of caller's transaction,
+// and allocated block can't be returned by rollback, while it's ids are used by other transactions.
+func (g *HiLoGenerator) allocate(ctx context.Context, s *SqlStorage, collection string) (uint64, error) {
+	seq := &SqlStorage{db: s.db, dialect: s.dialect, clock: s.clock, OptionalLogger: s.OptionalLogger}
+	var hi uint64
+	err := seq.TransactionContext(ctx, func(t Transaction) error {
+		var err error
+		hi, err = g.increment(ctx, t.(*SqlStorage), collection)
+		return err
+	})
+	return hi, err
+}
+
+func (g *HiLoGenerator) increment(ctx context.Context, tx *SqlStorage, collection string) (uint64, error) {
+	d := tx.dialect
+	res, err := tx.exec(ctx, fmt.Sprintf(
+		"UPDATE %s SET %s=%s+1 WHERE %s=?",
+		d.Quote(g.table), d.Quote("next_hi"), d.Quote("next_hi"), d.Quote("name")), collection)
+	if err != nil {
+		return 0, err
+	}
+	if affected, err := res.RowsAffected(); err != nil {
+		return 0, err
+	} else if affected == 0 {
+		_, err := tx.exec(ctx, fmt.Sprintf(
+			"INSERT INTO %s (%s, %s) VALUES (?, ?)",
+			d.Quote(g.table), d.Quote("name"), d.Quote("next_hi")), collection, 1)
+		return 0, err
+	}
+	next, err := tx.queryId(ctx, fmt.Sprintf(
+		"SELECT %s FROM %s WHERE %s=?",
+		d.Quote("next_hi"), d.Quote(g.table), d.Quote("name")), collection)
+	if err != nil {
+		return 0, err
+	}
+	return next - 1, nil
+}
@@ -7,6 +7,11 @@
 // methods, event callbacks, etc.).
 package ldbl
 
+import (
+	"context"
+	"database/sql"
+)
+
 // Very base interface for items that could be loaded or stored to DB.
 // It describes collection name (read "table name" for SQL databases)
 // and name for the primary key field of item in the collection.
@@ -41,6 +46,32 @@ type Structured interface {
 	FieldsStruct() map[string]interface{}
 }
 
+// Items, that are tracking changes of own fields, should implement this interface.
+// ChangedFields() must return only fields, that were changed since item was loaded or saved.
+// ResetChanges() is called by storage, when item was saved.
+// Storage will update only changed fields of such items (and will not update them at all, if nothing changed).
+type ChangeTracked interface {
+	ChangedFields() map[string]interface{}
+	ResetChanges()
+}
+
+// Items, that must be protected from concurrent modifications (optimistic locking), should implement this interface.
+// VersionField() must return name of integer field, that stores entry's version; Version() - current version of item.
+// Storage checks version on update & delete (returning StaleObjectError on mismatch), and increments it on update.
+type Versioned interface {
+	VersionField() string
+	Version() uint64
+	SetVersion(version uint64)
+}
+
+// Items, that could be loaded only with some of fields (see WithColumns()), should implement this interface.
+// Storage calls SetLoadedFields() after Fill() with list of loaded fields (or nil, if item was loaded entirely).
+// Partially loaded items are never cached, and only loaded fields of them are written on update.
+type PartiallyLoadable interface {
+	SetLoadedFields(fields []string)
+	LoadedFields() []string
+}
+
 // Describes universal method for getting field value by field name.
 type FieldGetter interface {
 	Field(name string) interface{}
@@ -51,6 +82,21 @@ type FieldsSetter interface {
 	SetField(name string, value interface{})
 }
 
+// Items, which times of creation & last update are filled by DispatchedStorage on saving
+// (see DispatchedStorage.SetClock()). Methods return names of fields; empty name means "don't fill".
+// Time of creation is set only if it's empty. Items must implement FieldsSetter.
+type Timestamped interface {
+	Storable
+	CreatedField() string
+	UpdatedField() string
+}
+
+// Items, that check themselves before saving (see DispatchedStorage). Validate() may return
+// ValidationErrors or FieldError for describing failed fields; other errors are wrapped to FieldError.
+type Validatable interface {
+	Validate() error
+}
+
 // Base storage interface. Every type that could request a DB, must implement it as minimum.
 // Typically, high-level components has own handy methods for items selecting rather than base Select().
 type Storage interface {
@@ -60,12 +106,102 @@ type Storage interface {
 	Select(proto Loadable, results *[]Loadable, order Orderer, skip int, condition string, args ...interface{}) error
 }
 
-// Just alias of Storage, needed for highlight cases when we need to use Transaction (instead of Storage) for write operations
+// Implemented by storages, that are able to save many items at once more effectively, than one by one
+type BatchStorage interface {
+	SaveAll(items []Storable) error
+}
+
+// Implemented by storages, that are able to count & aggregate items without loading them.
+type AggregatingStorage interface {
+	Count(proto Loadable, condition string, args ...interface{}) (int64, error)
+	Exists(proto Loadable, condition string, args ...interface{}) (bool, error)
+	Aggregate(proto Loadable, fn AggregateFunc, field string, condition string, args ...interface{}) (float64, error)
+}
+
+// Implemented by storages, that are able to load items by Key (see Keyed)
+type KeyedStorage interface {
+	LoadByKey(to Keyed, key Key) error
+}
+
+// Items, that are not removed on deletion, but marked as deleted: DeletedField() returns name of field,
+// that keeps time of deletion (NULL means "not deleted"). Deleted items are not loaded (see WithDeleted()).
+type SoftDeletable interface {
+	Loadable
+	DeletedField() string
+}
+
+// Implemented by storages, that support soft deletion (see SoftDeletable)
+type SoftDeleteStorage interface {
+	Restore(item SoftDeletable) error
+	Purge(item Loadable) error
+}
+
+// Implemented by storages, that are using current time (e.g. for times of soft deletion),
+// so DispatchedStorage could pass it's clock to them (see DispatchedStorage.SetClock()).
+type ClockedStorage interface {
+	UseClock(c Clock)
+}
+
+// Implemented by storages, that support "insert or update" operation: item is inserted,
+// or, if there is an entry with the same values of conflictFields, that entry is updated.
+type UpsertStorage interface {
+	Upsert(item Storable, conflictFields ...string) error
+}
+
+// Storage, scoped to transaction. Besides of base storage operations, allows to register callbacks,
+// that are called (once) after transaction is finished: it's useful for side effects (like sending emails),
+// that must not happen, if changes were rolled back.
 type Transaction interface {
 	Storage
+	OnCommit(f func())
+	OnRollback(f func())
 }
 
 // When DB supports transaction, related storage type will implement this interface.
 type TransactionalStorage interface {
 	Transaction(func(t Transaction) error) error
 }
+
+// Context-aware variant of Storage. Given context is passed down to DB driver (and to trigger handlers),
+// so caller is able to cancel slow queries or limit them with deadlines.
+type StorageContext interface {
+	SaveContext(ctx context.Context, item Storable) error
+	LoadContext(ctx context.Context, to Loadable, id uint64) error
+	DeleteContext(ctx context.Context, item Loadable) error
+	SelectContext(ctx context.Context, proto Loadable, results *[]Loadable, order Orderer, skip int, condition string, args ...interface{}) error
+}
+
+// Context-aware variant of TransactionalStorage.
+type TransactionalStorageContext interface {
+	TransactionContext(ctx context.Context, f func(t Transaction) error) error
+}
+
+// Implemented by transactional storages, that allow to set isolation level & read-only mode of transaction.
+// Options are passed to DB driver as is (nil means driver's defaults).
+type TransactionalStorageOptions interface {
+	TransactionWithOptions(opts *sql.TxOptions, f func(t Transaction) error) error
+	TransactionWithOptionsContext(ctx context.Context, opts *sql.TxOptions, f func(t Transaction) error) error
+}
+
+// Cursor is used for iterating over selected items one by one, without loading all of them to memory.
+// Cursor must be closed after usage. Typical usage:
+//
+//	for cursor.Next() {
+//		item := cursor.Item()
+//		...
+//	}
+//	if err := cursor.Err(); err != nil {
+//		...
+//	}
+type Cursor interface {
+	Next() bool
+	Item() Loadable
+	Err() error
+	Close() error
+}
+
+// Implemented by storages, that are able to stream selected items.
+// Limit <= 0 means "no limit".
+type IterableStorage interface {
+	SelectIter(proto Loadable, order Orderer, skip, limit int, condition string, args ...interface{}) (Cursor, error)
+}
@@ -0,0 +1,121 @@
+package ldbl
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Value of primary key. Values of composite key are given in order of Keyed.KeyNames().
+type Key []interface{}
+
+// Items with non-integer (like UUID strings) or composite primary keys should implement this interface.
+// KeyNames() must return names of primary key fields (PKName() should return the first of them),
+// Key() - current value of key. Keys are not generated by DB, so they must be set before saving.
+// FillKey() is called instead of Fill(), when item is loaded (and with nil key, when item was deleted).
+// Key fields are not expected in Fields(), same as integer id. Id() of such items is not used by storages.
+type Keyed interface {
+	Loadable
+	KeyNames() []string
+	Key() Key
+	FillKey(key Key, fields map[string]interface{}) error
+}
+
+// Returns string representation of key (used for indexing items in cache). String values are quoted,
+// so keys like {"a/b", "c"} & {"a", "b/c"} are represented differently.
+func (k Key) String() string {
+	parts := make([]string, 0, len(k))
+	for _, v := range k {
+		if bytes, isBytes := v.([]byte); isBytes {
+			v = string(bytes)
+		}
+		if str, isStr := v.(string); isStr {
+			parts = append(parts, strconv.Quote(str))
+		} else {
+			parts = append(parts, fmt.Sprint(v))
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+// Returns true for empty key, or if all of it's values are zero (key of not stored item)
+func (k Key) IsZero() bool {
+	for _, v := range k {
+		if v != nil && !reflect.ValueOf(v).IsZero() {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns key of item (for items with integer ids it contains just id)
+func keyOf(item Loadable) Key {
+	if keyed, ok := item.(Keyed); ok {
+		return keyed.Key()
+	}
+	return Key{item.Id()}
+}
+
+// Returns names of primary key fields of item
+func keyNamesOf(item Collectioned) []string {
+	if keyed, ok := item.(Keyed); ok {
+		return keyed.KeyNames()
+	}
+	return []string{item.PKName()}
+}
+
+func isKeyField(item Collectioned, field string) bool {
+	for _, name := range keyNamesOf(item) {
+		if name == field {
+			return true
+		}
+	}
+	return false
+}
+
+// Fills item with loaded fields & key. Key is got from scanned values of key columns
+// (see keyScanTarget()); integer id is expected for items, that are not Keyed.
+func fillWithKey(to Loadable, columns []string, scanned []interface{}, fields map[string]interface{}) error {
+	keyed, isKeyed := to.(Keyed)
+	if !isKeyed {
+		id := uint64(0)
+		for i, column := range columns {
+			if column != to.PKName() {
+				continue
+			}
+			idPtr, ok := scanned[i].(*uint64)
+			if !ok {
+				return newError(ErrInvalidPrimaryKey, "%s: Primary key contains not integer value", to.CollectionName())
+			}
+			id = *idPtr
+		}
+		return to.Fill(id, fields)
+	}
+	names := keyed.KeyNames()
+	key := make(Key, len(names))
+	for j, name := range names {
+		for i, column := range columns {
+			if column == name {
+				key[j] = keyValue(*scanned[i].(*interface{}))
+			}
+		}
+	}
+	return keyed.FillKey(key, fields)
+}
+
+// Returns scan target for primary key column
+func keyScanTarget(item Loadable) interface{} {
+	if _, isKeyed := item.(Keyed); isKeyed {
+		return new(interface{})
+	}
+	return new(uint64)
+}
+
+// Text keys could be returned by DB driver as []byte
+func keyValue(v interface{}) interface{} {
+	if bytes, isBytes := v.([]byte); isBytes {
+		return string(bytes)
+	}
+	return v
+}
@@ -18,6 +18,7 @@ type Migration struct {
 type Migrator struct {
 	migrations []Migration
 	tabName    string
+	dialect    Dialect
 }
 
 // Creates a new Migrator instance
@@ -27,7 +28,7 @@ func NewMigrator() *Migrator {
 
 // Creates a new Migrator instance and inits it with given migration list
 func NewMigratorWithMigrations(migrations []Migration) *Migrator {
-	return &Migrator{migrations: migrations, tabName: "ldbl_migration"}
+	return &Migrator{migrations: migrations, tabName: "ldbl_migration", dialect: DefaultDialect}
 }
 
 // Set name of service table, that stores current schema version
@@ -36,6 +37,12 @@ func (m *Migrator) SetMigrationTabName(n string) *Migrator {
 	return m
 }
 
+// Set SQL dialect, used for queries to service table
+func (m *Migrator) SetDialect(d Dialect) *Migrator {
+	m.dialect = d
+	return m
+}
+
 func (m *Migrator) AddMigration(migration Migration) {
 	m.migrations = append(m.migrations, migration)
 }
@@ -58,11 +65,11 @@ func (m *Migrator) Update(db *sql.DB) error {
 		}
 		_, err := tx.Exec(mig.Up)
 		if err != nil {
-			if err := tx.Rollback(); err != nil {
-				panic(fmt.Errorf("Can't rollback transaction while migrating; DB may be broken"))
+			migrErr := &MigrationError{Version: num, Query: mig.Up, Err: err}
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				return &RollbackError{Err: migrErr, RollbackErr: rollbackErr}
 			}
-			//TODO: custom error type
-			return fmt.Errorf("Migration error: %s (Migration #%d: %s)", err.Error(), num, mig.Up)
+			return migrErr
 		}
 		currentVersion = num
 	}
@@ -70,7 +77,7 @@ func (m *Migrator) Update(db *sql.DB) error {
 		return err
 	}
 	if err := m.storeCurrentVersion(db, currentVersion); err != nil {
-		panic(fmt.Errorf("Can't store current version after transactions is applied"))
+		return fmt.Errorf("Can't store current version after transactions is applied: %w", err)
 	}
 	return nil
 }
@@ -82,14 +89,24 @@ func (m *Migrator) MigrateToVersion(db *sql.DB) error {
 
 func (m *Migrator) createMigrTable(db *sql.DB) error {
 	sql := fmt.Sprintf(
-		"CREATE TABLE `%s` (`id` INTEGER PRIMARY KEY AUTOINCREMENT, `version` INTEGER NOT NULL, `performed_at` DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP);",
-		m.tabName)
+		"CREATE TABLE %s (%s, %s INTEGER NOT NULL, %s %s NOT NULL DEFAULT CURRENT_TIMESTAMP);",
+		m.dialect.Quote(m.tabName),
+		m.dialect.AutoIncrementPK("id"),
+		m.dialect.Quote("version"),
+		m.dialect.Quote("performed_at"),
+		m.dialect.DateTimeType())
 	_, err := db.Exec(sql)
 	return err
 }
 
 func (m *Migrator) loadCurrentVersion(db *sql.DB) (int, error) {
-	sql := fmt.Sprintf("SELECT `version` FROM `%s` WHERE 1 ORDER BY `id` DESC LIMIT 0, 1", m.tabName)
+	sql := joinSql(
+		fmt.Sprintf(
+			"SELECT %s FROM %s ORDER BY %s DESC",
+			m.dialect.Quote("version"),
+			m.dialect.Quote(m.tabName),
+			m.dialect.Quote("id")),
+		m.dialect.LimitOffset(1, 0))
 	rows, err := db.Query(sql)
 	if err != nil {
 		return 0, err
@@ -111,7 +128,7 @@ func (m *Migrator) storeCurrentVersion(db *sql.DB, version int) error {
 			return err
 		}
 	}
-	sql := fmt.Sprintf("INSERT INTO `%s` (`version`) VALUES (?)", m.tabName)
+	sql := m.dialect.Rebind(fmt.Sprintf("INSERT INTO %s (%s) VALUES (?)", m.dialect.Quote(m.tabName), m.dialect.Quote("version")))
 	_, err := db.Exec(sql, version)
 	return err
 }
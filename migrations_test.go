@@ -0,0 +1,31 @@
+package ldbl_test
+
+import (
+	"errors"
+	"ldbl"
+	"testing"
+)
+
+func TestMigrationErrors(t *testing.T) {
+	// cleanup after previous tests
+	removeTestDb()
+	db := provideTestDb()
+
+	migr := ldbl.NewMigratorWithMigrations([]ldbl.Migration{
+		ldbl.Migration{Up: `CREATE TABLE tags (id INTEGER PRIMARY KEY AUTOINCREMENT, name VARCHAR(255) NOT NULL);`},
+		ldbl.Migration{Up: `ALTER TABLE not_existing ADD COLUMN name VARCHAR(255);`},
+	}).SetMigrationTabName("test_migration")
+	err := migr.Update(db)
+	var migrErr *ldbl.MigrationError
+	if !errors.As(err, &migrErr) {
+		t.Fatalf("Failed migration must return *MigrationError (got: %T)", err)
+	}
+	equals(t, 2, migrErr.Version)
+	equals(t, `ALTER TABLE not_existing ADD COLUMN name VARCHAR(255);`, migrErr.Query)
+
+	// First migration must be rolled back too
+	_, err = db.Exec("SELECT * FROM tags")
+	assert(t, err != nil, "Migrations must be rolled back after failure")
+
+	removeTestDb()
+}
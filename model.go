@@ -1,8 +1,12 @@
 package ldbl
 
+// Model is a basic implementation of Storable item, that keeps it's fields in a map.
+// It tracks changes of fields (see ChangeTracked), so only changed fields are written on update.
 type Model struct {
-	id     uint64
-	fields map[string]interface{}
+	id      uint64
+	fields  map[string]interface{}
+	changed map[string]bool
+	loaded  []string // fields, that were loaded (nil if all of them; see PartiallyLoadable)
 }
 
 func (m *Model) PKName() string {
@@ -14,6 +18,8 @@ func (m *Model) Fill(id uint64, fields map[string]interface{}) error {
 	if fields != nil {
 		m.fields = fields
 	}
+	m.changed = nil
+	m.loaded = nil
 	return nil
 }
 
@@ -37,6 +43,30 @@ func (m *Model) SetField(name string, value interface{}) {
 		m.fields = make(map[string]interface{})
 	}
 	m.fields[name] = value
+	if m.changed == nil {
+		m.changed = make(map[string]bool)
+	}
+	m.changed[name] = true
+}
+
+func (m *Model) ChangedFields() map[string]interface{} {
+	changed := make(map[string]interface{}, len(m.changed))
+	for name := range m.changed {
+		changed[name] = m.fields[name]
+	}
+	return changed
+}
+
+func (m *Model) ResetChanges() {
+	m.changed = nil
+}
+
+func (m *Model) SetLoadedFields(fields []string) {
+	m.loaded = fields
+}
+
+func (m *Model) LoadedFields() []string {
+	return m.loaded
 }
 
 func (m *Model) Clone() Model {
@@ -1,7 +1,11 @@
 package ldbl_test
 
 import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
 	"ldbl"
+	"strings"
 	"testing"
 	"time"
 )
@@ -84,6 +88,292 @@ func (i *Image) LoadUser(s *ldbl.DispatchedStorage) (*User, error) {
 	return user, nil
 }
 
+// Image with optimistic locking
+type VersionedImage struct {
+	Image
+}
+
+func (i *VersionedImage) Clone() ldbl.Loadable {
+	return &VersionedImage{Image{i.Model.Clone()}}
+}
+func (i *VersionedImage) FieldsStruct() map[string]interface{} {
+	fields := i.Image.FieldsStruct()
+	fields["version"] = uint64(0)
+	return fields
+}
+func (i *VersionedImage) VersionField() string {
+	return "version"
+}
+func (i *VersionedImage) Version() uint64 {
+	v, _ := i.Field("version").(uint64)
+	return v
+}
+func (i *VersionedImage) SetVersion(v uint64) {
+	i.SetField("version", v)
+}
+
+// Image with nullable fields
+type NullableImage struct {
+	Image
+}
+
+func (i *NullableImage) Clone() ldbl.Loadable {
+	return &NullableImage{Image{i.Model.Clone()}}
+}
+func (i *NullableImage) FieldsStruct() map[string]interface{} {
+	fields := i.Image.FieldsStruct()
+	fields["description"] = (*string)(nil)
+	fields["rating"] = sql.NullInt64{}
+	return fields
+}
+
+// Image without fields description
+type RawImage struct {
+	ldbl.Model
+}
+
+func (i *RawImage) CollectionName() string {
+	return "images"
+}
+func (i *RawImage) Clone() ldbl.Loadable {
+	return &RawImage{i.Model.Clone()}
+}
+
+// Image with fields of custom types
+type ConvertedImage struct {
+	Image
+}
+
+type ImageMeta struct {
+	Width  int
+	Height int
+}
+
+type ImageStatus int
+
+const (
+	Draft ImageStatus = iota + 1
+	Published
+)
+
+// Decimal-like type, that implements sql.Scanner & driver.Valuer
+type Price struct {
+	Cents int64
+}
+
+func (p *Price) Scan(src interface{}) error {
+	var units, cents int64
+	switch v := src.(type) {
+	case nil:
+		p.Cents = 0
+		return nil
+	case []byte:
+		src = string(v)
+	}
+	if _, err := fmt.Sscanf(src.(string), "%d.%02d", &units, &cents); err != nil {
+		return err
+	}
+	p.Cents = units*100 + cents
+	return nil
+}
+func (p Price) Value() (driver.Value, error) {
+	return fmt.Sprintf("%d.%02d", p.Cents/100, p.Cents%100), nil
+}
+
+func (i *ConvertedImage) Clone() ldbl.Loadable {
+	return &ConvertedImage{Image{i.Model.Clone()}}
+}
+func (i *ConvertedImage) FieldsStruct() map[string]interface{} {
+	fields := i.Image.FieldsStruct()
+	fields["meta"] = ImageMeta{}
+	fields["status"] = Draft
+	fields["duration"] = time.Duration(0)
+	fields["price"] = Price{}
+	return fields
+}
+
+// Soft-deletable items
+type SoftUser struct {
+	User
+}
+
+func (u *SoftUser) Clone() ldbl.Loadable {
+	return &SoftUser{User{Email: u.Email, Created: u.Created}}
+}
+func (u *SoftUser) DeletedField() string {
+	return "deleted_at"
+}
+
+type SoftImage struct {
+	Image
+}
+
+func (i *SoftImage) Clone() ldbl.Loadable {
+	return &SoftImage{Image{i.Model.Clone()}}
+}
+func (i *SoftImage) FieldsStruct() map[string]interface{} {
+	fields := i.Image.FieldsStruct()
+	fields["deleted_at"] = (*time.Time)(nil)
+	return fields
+}
+func (i *SoftImage) DeletedField() string {
+	return "deleted_at"
+}
+
+// Image with automatically filled timestamps
+type TimestampedImage struct {
+	Image
+}
+
+func (i *TimestampedImage) Clone() ldbl.Loadable {
+	return &TimestampedImage{Image{i.Model.Clone()}}
+}
+func (i *TimestampedImage) FieldsStruct() map[string]interface{} {
+	fields := i.Image.FieldsStruct()
+	fields["updated"] = (*time.Time)(nil)
+	return fields
+}
+func (i *TimestampedImage) CreatedField() string {
+	return "created"
+}
+func (i *TimestampedImage) UpdatedField() string {
+	return "updated"
+}
+
+// User, that validates itself
+type ValidatedUser struct {
+	User
+}
+
+func (u *ValidatedUser) Clone() ldbl.Loadable {
+	return &ValidatedUser{User{Email: u.Email, Created: u.Created}}
+}
+func (u *ValidatedUser) Validate() error {
+	if !strings.Contains(u.Email, "@") {
+		return ldbl.FieldError{Field: "email", Rule: "email", Message: "Not an email"}
+	}
+	return nil
+}
+
+// Item with string key
+type Setting struct {
+	ldbl.Model
+	uuid string
+}
+
+func (s *Setting) CollectionName() string {
+	return "settings"
+}
+func (s *Setting) PKName() string {
+	return "uuid"
+}
+func (s *Setting) KeyNames() []string {
+	return []string{"uuid"}
+}
+func (s *Setting) Key() ldbl.Key {
+	return ldbl.Key{s.uuid}
+}
+func (s *Setting) FillKey(key ldbl.Key, fields map[string]interface{}) error {
+	s.uuid = ""
+	if key != nil {
+		s.uuid, _ = key[0].(string)
+	}
+	return s.Model.Fill(0, fields)
+}
+func (s *Setting) Clone() ldbl.Loadable {
+	return &Setting{Model: s.Model.Clone()}
+}
+func (s *Setting) FieldsStruct() map[string]interface{} {
+	return map[string]interface{}{
+		"name":  "",
+		"value": "",
+	}
+}
+
+// Item with string key & optimistic locking
+type VersionedSetting struct {
+	Setting
+}
+
+func (s *VersionedSetting) Clone() ldbl.Loadable {
+	return &VersionedSetting{Setting{Model: s.Model.Clone()}}
+}
+func (s *VersionedSetting) FieldsStruct() map[string]interface{} {
+	fields := s.Setting.FieldsStruct()
+	fields["version"] = uint64(0)
+	return fields
+}
+func (s *VersionedSetting) VersionField() string {
+	return "version"
+}
+func (s *VersionedSetting) Version() uint64 {
+	v, _ := s.Field("version").(uint64)
+	return v
+}
+func (s *VersionedSetting) SetVersion(v uint64) {
+	s.SetField("version", v)
+}
+
+// Item with composite key
+type ImageTag struct {
+	ldbl.Model
+	imageId uint64
+	tag     string
+}
+
+func (i *ImageTag) CollectionName() string {
+	return "image_tags"
+}
+func (i *ImageTag) PKName() string {
+	return "images_id"
+}
+func (i *ImageTag) KeyNames() []string {
+	return []string{"images_id", "tag"}
+}
+func (i *ImageTag) Key() ldbl.Key {
+	return ldbl.Key{i.imageId, i.tag}
+}
+func (i *ImageTag) FillKey(key ldbl.Key, fields map[string]interface{}) error {
+	i.imageId, i.tag = 0, ""
+	if key != nil {
+		switch id := key[0].(type) {
+		case int64:
+			i.imageId = uint64(id)
+		case uint64:
+			i.imageId = id
+		}
+		i.tag, _ = key[1].(string)
+	}
+	return i.Model.Fill(0, fields)
+}
+func (i *ImageTag) Clone() ldbl.Loadable {
+	return &ImageTag{Model: i.Model.Clone()}
+}
+func (i *ImageTag) FieldsStruct() map[string]interface{} {
+	return map[string]interface{}{
+		"weight": int64(0),
+	}
+}
+
+// Item, that references ImageTag
+type TagVote struct {
+	ldbl.Model
+}
+
+func (v *TagVote) CollectionName() string {
+	return "tag_votes"
+}
+func (v *TagVote) Clone() ldbl.Loadable {
+	return &TagVote{v.Model.Clone()}
+}
+func (v *TagVote) FieldsStruct() map[string]interface{} {
+	return map[string]interface{}{
+		"images_id": uint64(0),
+		"tag":       "",
+		"users_id":  uint64(0),
+	}
+}
+
 ////// Model tests
 
 func TestSetField(t *testing.T) {
@@ -94,3 +384,13 @@ func TestSetField(t *testing.T) {
 	assert(t, ok, "Can't get back value set for field 'filesize' (got value of wrong type; expected: uint64; got: %T)", got)
 	equals(t, uint64(100*1024), asUint64)
 }
+
+func TestChangesTracking(t *testing.T) {
+	img := &Image{}
+	img.Fill(1, map[string]interface{}{"filename": "test.jpg", "filesize": uint64(100)})
+	equals(t, 0, len(img.ChangedFields()))
+	img.SetField("filesize", uint64(200))
+	equals(t, map[string]interface{}{"filesize": uint64(200)}, img.ChangedFields())
+	img.ResetChanges()
+	equals(t, 0, len(img.ChangedFields()))
+}
@@ -2,7 +2,10 @@ package ldbl
 
 import (
 	"fmt"
+	"reflect"
+	"sort"
 	"strings"
+	"time"
 )
 
 type OrderDirection string
@@ -45,3 +48,169 @@ func (o *CombinedOrder) OrderString() string {
 	}
 	return strings.Join(sqls, ", ")
 }
+
+// Sorts already loaded items according to given order (as DB would do).
+// Field values are got with FieldGetter or Storable.Fields(); table prefixes of field names (like "images.") are ignored.
+// Only Order & *CombinedOrder are supported (other Orderer types lead to ErrNotSupported).
+func sortItems(items []Loadable, order Orderer) error {
+	if order == nil {
+		return nil
+	}
+	var orders []Order
+	switch o := order.(type) {
+	case Order:
+		orders = []Order{o}
+	case *Order:
+		orders = []Order{*o}
+	case *CombinedOrder:
+		orders = o.orders
+	default:
+		return newError(ErrNotSupported, "Can't sort items by order of type %T", order)
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		for _, o := range orders {
+			cmp := compareValues(itemField(items[i], o.Field), itemField(items[j], o.Field))
+			if cmp == 0 {
+				continue
+			}
+			if strings.EqualFold(string(o.Direction), string(DESC)) {
+				return cmp > 0
+			}
+			return cmp < 0
+		}
+		return false
+	})
+	return nil
+}
+
+func itemField(item Loadable, field string) interface{} {
+	if dot := strings.LastIndex(field, "."); dot >= 0 {
+		field = field[dot+1:]
+	}
+	if field == item.PKName() {
+		return item.Id()
+	}
+	if getter, ok := item.(FieldGetter); ok {
+		return getter.Field(field)
+	}
+	if storable, ok := item.(Storable); ok {
+		return storable.Fields()[field]
+	}
+	return nil
+}
+
+// Compares values of the same kind (nils are less than any other value).
+// Returns 0 for values, that can't be compared.
+func compareValues(a, b interface{}) int {
+	cmp, _ := compareValuesOf(a, b)
+	return cmp
+}
+
+// Same as compareValues(), but also returns false, if values can't be compared (they have different kinds)
+func compareValuesOf(a, b interface{}) (int, bool) {
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	for va.Kind() == reflect.Ptr && !va.IsNil() {
+		va = va.Elem()
+	}
+	for vb.Kind() == reflect.Ptr && !vb.IsNil() {
+		vb = vb.Elem()
+	}
+	aNil, bNil := !va.IsValid() || va.Kind() == reflect.Ptr, !vb.IsValid() || vb.Kind() == reflect.Ptr
+	switch {
+	case aNil && bNil:
+		return 0, true
+	case aNil:
+		return -1, true
+	case bNil:
+		return 1, true
+	}
+	ta, aIsTime := va.Interface().(time.Time)
+	tb, bIsTime := vb.Interface().(time.Time)
+	if aIsTime || bIsTime {
+		if !aIsTime || !bIsTime {
+			return 0, false
+		}
+		switch {
+		case ta.Before(tb):
+			return -1, true
+		case ta.After(tb):
+			return 1, true
+		}
+		return 0, true
+	}
+	if isNumberKind(va.Kind()) && isNumberKind(vb.Kind()) {
+		return compareNumbers(va, vb), true
+	}
+	switch {
+	case va.Kind() == reflect.String && vb.Kind() == reflect.String:
+		return strings.Compare(va.String(), vb.String()), true
+	case va.Kind() == reflect.Bool && vb.Kind() == reflect.Bool:
+		switch {
+		case va.Bool() == vb.Bool():
+			return 0, true
+		case va.Bool():
+			return 1, true
+		}
+		return -1, true
+	}
+	return 0, false
+}
+
+func isNumberKind(k reflect.Kind) bool {
+	return k >= reflect.Int && k <= reflect.Float64 && k != reflect.Uintptr
+}
+
+func isIntKind(k reflect.Kind) bool {
+	return k >= reflect.Int && k <= reflect.Int64
+}
+
+func isUintKind(k reflect.Kind) bool {
+	return k >= reflect.Uint && k <= reflect.Uint64
+}
+
+// Integers are compared exactly (big ids may not fit to float64 precision)
+func compareNumbers(a, b reflect.Value) int {
+	switch {
+	case isIntKind(a.Kind()) && isIntKind(b.Kind()):
+		return compareInts(a.Int(), b.Int())
+	case isUintKind(a.Kind()) && isUintKind(b.Kind()):
+		switch {
+		case a.Uint() < b.Uint():
+			return -1
+		case a.Uint() > b.Uint():
+			return 1
+		}
+		return 0
+	}
+	return compareFloats(numberOf(a), numberOf(b))
+}
+
+func compareInts(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func numberOf(v reflect.Value) float64 {
+	switch {
+	case isIntKind(v.Kind()):
+		return float64(v.Int())
+	case isUintKind(v.Kind()):
+		return float64(v.Uint())
+	}
+	return v.Float()
+}
+
+func compareFloats(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
@@ -2,15 +2,38 @@ package ldbl
 
 import (
 	"fmt"
+	"strings"
 )
 
 type SqlQuery struct {
-	what      Loadable
-	condition string
-	args      []interface{}
-	order     Orderer
-	limit     int
-	offset    int
+	what       Loadable
+	columns    []string
+	condition  string
+	args       []interface{}
+	order      Orderer
+	limit      int
+	offset     int
+	count      bool
+	aggregates []aggregate
+	groupBy    []string
+	having     string
+	havingArgs []interface{}
+	deleted    deletedMode
+}
+
+// Aggregate function of SQL
+type AggregateFunc string
+
+const (
+	SUM AggregateFunc = "SUM"
+	AVG AggregateFunc = "AVG"
+	MIN AggregateFunc = "MIN"
+	MAX AggregateFunc = "MAX"
+)
+
+type aggregate struct {
+	fn    AggregateFunc
+	field string
 }
 
 //TODO: Joins
@@ -21,28 +44,120 @@ type SqlQueryBilder interface {
 	Args() []interface{}
 }
 
+// Query builders, that are able to build query for particular SQL dialect,
+// should implement this interface (SqlStorage will prefer it to Query()).
+type DialectQueryBuilder interface {
+	QueryFor(d Dialect) string
+}
+
 func Select(what Loadable) *SqlQuery {
-	return &SqlQuery{what: what, condition: "1", limit: -1}
+	return &SqlQuery{what: what, limit: -1}
 }
 
 func (q *SqlQuery) ItemToLoad() Loadable {
 	return q.what
 }
 
+// Returns query built with DefaultDialect
 func (q *SqlQuery) Query() string {
+	return q.QueryFor(DefaultDialect)
+}
+
+func (q *SqlQuery) QueryFor(d Dialect) string {
+	conditionSql := ""
+	if condition := deletedCondition(d, q.what, q.condition, q.deleted); condition != "" {
+		conditionSql = "WHERE " + condition
+	}
+	groupSql := ""
+	if len(q.groupBy) > 0 {
+		groupSql = "GROUP BY " + quoteAll(d, q.groupBy)
+	}
+	havingSql := ""
+	if q.having != "" {
+		havingSql = "HAVING " + q.having
+	}
 	orderSql := ""
 	if q.order != nil {
 		orderSql = "ORDER BY " + q.order.OrderString()
 	}
-	limitSql := ""
-	if (q.offset > 0) || (q.limit > 0) {
-		limitSql = fmt.Sprintf("LIMIT %d, %d", q.offset, q.limit)
-	}
-	return fmt.Sprintf("SELECT * FROM `%s` WHERE %s %s %s", q.what.CollectionName(), q.condition, orderSql, limitSql)
+	return joinSql(
+		"SELECT "+q.selectListSql(d)+" FROM "+d.Quote(q.what.CollectionName()),
+		conditionSql,
+		groupSql,
+		havingSql,
+		orderSql,
+		d.LimitOffset(q.limit, q.offset))
 }
 
 func (q *SqlQuery) Args() []interface{} {
-	return q.args
+	if len(q.havingArgs) == 0 {
+		return q.args
+	}
+	args := make([]interface{}, 0, len(q.args)+len(q.havingArgs))
+	args = append(args, q.args...)
+	return append(args, q.havingArgs...)
+}
+
+// Returns true, if query selects aggregated values (instead of items)
+func (q *SqlQuery) IsAggregated() bool {
+	return q.count || len(q.aggregates) > 0 || len(q.groupBy) > 0
+}
+
+// Selects count of rows (as "count" column) instead of items.
+// Use SqlStorage.QueryValue() or SqlStorage.QueryValues() (for grouped query) for getting results.
+func (q *SqlQuery) Count() *SqlQuery {
+	q.count = true
+	return q
+}
+
+// Selects value of aggregate function over field (as column named like "sum_filesize") instead of items.
+// Use SqlStorage.QueryValue() or SqlStorage.QueryValues() (for grouped query) for getting results.
+func (q *SqlQuery) Aggregate(fn AggregateFunc, field string) *SqlQuery {
+	q.aggregates = append(q.aggregates, aggregate{fn, field})
+	return q
+}
+
+// Groups rows by given fields; values of them are selected along with aggregated ones
+func (q *SqlQuery) GroupBy(fields ...string) *SqlQuery {
+	q.groupBy = append(q.groupBy, fields...)
+	return q
+}
+
+// Filters groups by condition over aggregated values (like "COUNT(*) > ?")
+func (q *SqlQuery) Having(condition string, args ...interface{}) *SqlQuery {
+	q.having = condition
+	q.havingArgs = args
+	return q
+}
+
+func (q *SqlQuery) selectListSql(d Dialect) string {
+	if !q.IsAggregated() {
+		return columnsSql(d, q.what, q.columns)
+	}
+	list := make([]string, 0, len(q.groupBy)+len(q.aggregates)+1)
+	for _, field := range q.groupBy {
+		list = append(list, d.Quote(field))
+	}
+	if q.count {
+		list = append(list, "COUNT(*) AS "+d.Quote("count"))
+	}
+	for _, a := range q.aggregates {
+		alias := strings.ToLower(string(a.fn)) + "_" + a.field
+		list = append(list, fmt.Sprintf("%s(%s) AS %s", a.fn, d.Quote(a.field), d.Quote(alias)))
+	}
+	return strings.Join(list, ", ")
+}
+
+// Limits loaded fields of items (primary key is loaded always). Items will be marked as partially loaded
+// (see PartiallyLoadable). Structured items keep initial values for the rest of fields.
+func (q *SqlQuery) Columns(fields ...string) *SqlQuery {
+	q.columns = fields
+	return q
+}
+
+// Returns fields, given to Columns() (nil means "all fields")
+func (q *SqlQuery) SelectedColumns() []string {
+	return q.columns
 }
 
 func (q *SqlQuery) Where(condition string, args ...interface{}) *SqlQuery {
@@ -51,6 +166,18 @@ func (q *SqlQuery) Where(condition string, args ...interface{}) *SqlQuery {
 	return q
 }
 
+// Selects soft-deleted items along with not deleted ones (see SoftDeletable)
+func (q *SqlQuery) WithDeleted() *SqlQuery {
+	q.deleted = includeDeleted
+	return q
+}
+
+// Selects only soft-deleted items (see SoftDeletable)
+func (q *SqlQuery) OnlyDeleted() *SqlQuery {
+	q.deleted = onlyDeleted
+	return q
+}
+
 func (q *SqlQuery) OrderBy(field string, dir OrderDirection) *SqlQuery {
 	if q.order == nil {
 		q.order = OrderBy(field, dir)
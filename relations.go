@@ -12,40 +12,69 @@ type Relation struct {
 	From              Loadable
 	To                Loadable
 	ForeignKey        string
+	ForeignKeys       []string // for relations with items, that have composite keys (see Keyed)
 	Type              RelationType
 	GetForeignKeyFunc func() uint64
 }
 
 func NewHasOneRelation(from, to Loadable) *Relation {
-	return &Relation{From: from, To: to, Type: HAS_ONE, ForeignKey: foreignKeyFor(from)}
+	return (&Relation{From: from, To: to, Type: HAS_ONE}).WithFKs(foreignKeysFor(from)...)
 }
 
 func NewHasManyRelation(from, to Loadable) *Relation {
-	return &Relation{From: from, To: to, Type: HAS_MANY, ForeignKey: foreignKeyFor(from)}
+	return (&Relation{From: from, To: to, Type: HAS_MANY}).WithFKs(foreignKeysFor(from)...)
 }
 
 func NewBelongsToRelation(from, to Loadable) *Relation {
-	return &Relation{From: from, To: to, Type: BELONGS_TO, ForeignKey: foreignKeyFor(to)}
+	return (&Relation{From: from, To: to, Type: BELONGS_TO}).WithFKs(foreignKeysFor(to)...)
 }
 
 //TODO: many-to-many: NewHasManyThroughRelation() ?
 
 func (r *Relation) WithFK(fk string) *Relation {
 	r.ForeignKey = fk
+	r.ForeignKeys = nil
+	return r
+}
+
+// Sets foreign keys, that reference composite key (in order of Keyed.KeyNames()).
+// Relation is kept unchanged, if no keys given.
+func (r *Relation) WithFKs(fks ...string) *Relation {
+	if len(fks) == 0 {
+		return r
+	}
+	r.ForeignKey = fks[0]
+	r.ForeignKeys = nil
+	if len(fks) > 1 {
+		r.ForeignKeys = fks
+	}
 	return r
 }
 
 func (r *Relation) Reversed() *Relation {
 	switch r.Type {
 	case HAS_ONE, HAS_MANY:
-		return &Relation{From: r.To, To: r.From, ForeignKey: r.ForeignKey, Type: BELONGS_TO}
+		return &Relation{From: r.To, To: r.From, ForeignKey: r.ForeignKey, ForeignKeys: r.ForeignKeys, Type: BELONGS_TO}
 	case BELONGS_TO:
-		return &Relation{From: r.To, To: r.From, ForeignKey: r.ForeignKey, Type: HAS_MANY}
+		return &Relation{From: r.To, To: r.From, ForeignKey: r.ForeignKey, ForeignKeys: r.ForeignKeys, Type: HAS_MANY}
 	}
 	return nil
 }
 
-func foreignKeyFor(item Collectioned) string {
+// Returns all foreign keys of relation
+func (r *Relation) foreignKeys() []string {
+	if len(r.ForeignKeys) > 0 {
+		return r.ForeignKeys
+	}
+	return []string{r.ForeignKey}
+}
+
+func foreignKeysFor(item Collectioned) []string {
 	//TODO: singularize?
-	return item.CollectionName() + "_" + item.PKName()
+	names := keyNamesOf(item)
+	fks := make([]string, 0, len(names))
+	for _, name := range names {
+		fks = append(fks, item.CollectionName()+"_"+name)
+	}
+	return fks
 }
@@ -0,0 +1,111 @@
+package ldbl_test
+
+import (
+	"database/sql"
+	"fmt"
+	"ldbl"
+	"os"
+	"testing"
+	"time"
+)
+
+var TEST_REPLICAS_CNT = 2
+
+// Creates replicas with the same test data, but with email of first user, that identifies replica
+func provideReplicaDbs(t *testing.T) []*sql.DB {
+	dbs := make([]*sql.DB, 0, TEST_REPLICAS_CNT)
+	for i := 0; i < TEST_REPLICAS_CNT; i++ {
+		db, err := createDb(replicaDbName(i))
+		ok(t, err)
+		ok(t, makeTestData(db))
+		_, err = db.Exec("UPDATE users SET email=? WHERE id=1", replicaEmail(i))
+		ok(t, err)
+		dbs = append(dbs, db)
+	}
+	return dbs
+}
+
+func removeReplicaDbs(dbs []*sql.DB) {
+	for i, db := range dbs {
+		db.Close()
+		os.Remove(replicaDbName(i))
+	}
+}
+
+func replicaDbName(i int) string {
+	return fmt.Sprintf("ldbl-sqlite-replica%d_test.db", i)
+}
+
+func replicaEmail(i int) string {
+	return fmt.Sprintf("replica%d@test.com", i)
+}
+
+func TestReplication(t *testing.T) {
+	// cleanup after previous tests
+	removeTestDb()
+	// and bootstraping some test data
+	ok(t, makeTestData(provideTestDb()))
+	replicaDbs := provideReplicaDbs(t)
+	defer removeReplicaDbs(replicaDbs)
+
+	replicas := make([]*ldbl.SqlStorage, 0, len(replicaDbs))
+	for _, db := range replicaDbs {
+		replicas = append(replicas, ldbl.NewSqlStorage(db))
+	}
+	S := ldbl.NewReplicatedStorage(provideSqlStorage(), replicas...)
+
+	// Reads are balanced between replicas
+	user := &User{}
+	for i := 0; i < 2*TEST_REPLICAS_CNT; i++ {
+		ok(t, S.Load(user, 1))
+		equals(t, replicaEmail(i%TEST_REPLICAS_CNT), user.Email)
+	}
+	results := make([]ldbl.Loadable, 0)
+	ok(t, S.Query(ldbl.Select(&User{}).Where("id=?", 1), &results))
+	equals(t, replicaEmail(0), results[0].(*User).Email)
+
+	// Writes go to primary
+	user.Email = "primary@test.com"
+	ok(t, S.Save(user))
+	ok(t, S.Primary().Load(user, 1))
+	equals(t, "primary@test.com", user.Email)
+	ok(t, replicas[0].Load(user, 1))
+	equals(t, replicaEmail(0), user.Email)
+
+	// Least busy replica is chosen (all of them are idle, so the first one)
+	S.SetBalancer(ldbl.LeastBusyBalancer{})
+	ok(t, S.Load(user, 1))
+	equals(t, replicaEmail(0), user.Email)
+
+	// Counts & values are read from replica too
+	cnt, err := S.Count(&User{}, "email=?", replicaEmail(0))
+	ok(t, err)
+	equals(t, int64(1), cnt)
+	var usersCnt int64
+	ok(t, S.QueryValue(ldbl.Select(&User{}).Count().Where("email=?", replicaEmail(0)), &usersCnt))
+	equals(t, int64(1), usersCnt)
+	exists, err := ldbl.NewDispatchedStorage(S).Exists(&User{}, "email=?", replicaEmail(0))
+	ok(t, err)
+	assert(t, exists, "Existence must be checked on replica")
+	_, err = ldbl.NewDispatchedStorage(S).Aggregate(&Image{}, ldbl.SUM, "filesize", "")
+	ok(t, err)
+
+	// Reads right after write go to primary
+	S.SetReadYourWritesWindow(time.Hour)
+	user.Email = "primary@test.com"
+	ok(t, S.Save(user))
+	ok(t, S.Load(user, 1))
+	equals(t, "primary@test.com", user.Email)
+
+	// Transactions are performed on primary
+	S.SetReadYourWritesWindow(0)
+	ok(t, S.Transaction(func(tx ldbl.Transaction) error {
+		if err := tx.Load(user, 1); err != nil {
+			return err
+		}
+		equals(t, "primary@test.com", user.Email)
+		return nil
+	}))
+
+	removeTestDb()
+}
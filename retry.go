@@ -0,0 +1,125 @@
+package ldbl
+
+import (
+	"context"
+	"time"
+)
+
+// Describes, how operations, failed with transient errors (like deadlocks or "database is locked"), are retried.
+// Whole transaction is re-run on every attempt, so it's function must not have side effects outside of DB
+// (use Transaction.OnCommit() for them).
+type RetryPolicy struct {
+	// Max count of attempts (including the first one); values < 2 mean "no retries"
+	MaxAttempts int
+	// Returns delay before given attempt (starting from 2); nil means "no delay"
+	Backoff func(attempt int) time.Duration
+	// Returns true for errors, that can be retried; nil means that Dialect.IsTransientError() is used
+	Classifier func(err error) bool
+}
+
+// Returns backoff, that doubles delay on every attempt, starting from base, but not exceeding max
+func ExponentialBackoff(base, max time.Duration) func(attempt int) time.Duration {
+	return func(attempt int) time.Duration {
+		delay := base
+		for i := 2; i < attempt && delay < max; i++ {
+			delay *= 2
+		}
+		if delay > max {
+			return max
+		}
+		return delay
+	}
+}
+
+// Performs f, retrying it according to policy. Retries are stopped, when ctx is done.
+func retry(ctx context.Context, policy *RetryPolicy, d Dialect, logger *OptionalLogger, f func() error) error {
+	err := f()
+	if policy == nil {
+		return err
+	}
+	isTransient := policy.Classifier
+	if isTransient == nil {
+		isTransient = d.IsTransientError
+	}
+	for attempt := 2; attempt <= policy.MaxAttempts && err != nil && isTransient(err); attempt++ {
+		var delay time.Duration
+		if policy.Backoff != nil {
+			delay = policy.Backoff(attempt)
+		}
+		logger.Log("Transient error: %s; retrying in %s (attempt %d of %d)", err, delay, attempt, policy.MaxAttempts)
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		err = f()
+	}
+	return err
+}
+
+// State of item before operation. It's restored before retry, because failed attempt could change item
+// (assign id to created item, increment version, reset changes, etc.), but it's changes were rolled back.
+type itemState struct {
+	item    Loadable
+	id      uint64
+	key     Key // key of Keyed item
+	fields  map[string]interface{}
+	changed map[string]interface{}
+	loaded  []string // loaded fields of partially loaded item
+	version uint64
+}
+
+func saveItemState(item Loadable) *itemState {
+	st := &itemState{item: item, id: item.Id()}
+	if keyed, ok := item.(Keyed); ok {
+		st.key = append(Key{}, keyed.Key()...)
+	}
+	if storable, ok := item.(Storable); ok {
+		st.fields = copyFields(storable.Fields())
+	}
+	if tracked, ok := item.(ChangeTracked); ok {
+		st.changed = copyFields(tracked.ChangedFields())
+	}
+	if partial, ok := item.(PartiallyLoadable); ok && partial.LoadedFields() != nil {
+		st.loaded = append([]string{}, partial.LoadedFields()...)
+	}
+	if versioned, ok := item.(Versioned); ok {
+		st.version = versioned.Version()
+	}
+	return st
+}
+
+// Restores whole state of item: failed attempt could change any of it's fields (timestamps, time of deletion, etc.)
+func (st *itemState) restore() {
+	if keyed, ok := st.item.(Keyed); ok {
+		if st.fields != nil || keyed.Key().String() != st.key.String() {
+			keyed.FillKey(append(Key{}, st.key...), copyFields(st.fields))
+		}
+	} else if st.fields != nil || st.item.Id() != st.id {
+		st.item.Fill(st.id, copyFields(st.fields))
+	}
+	if partial, ok := st.item.(PartiallyLoadable); ok {
+		partial.SetLoadedFields(append([]string(nil), st.loaded...))
+	}
+	if setter, ok := st.item.(FieldsSetter); ok {
+		for name, value := range st.changed {
+			setter.SetField(name, value)
+		}
+	}
+	if versioned, ok := st.item.(Versioned); ok {
+		versioned.SetVersion(st.version)
+	}
+}
+
+func copyFields(fields map[string]interface{}) map[string]interface{} {
+	if fields == nil {
+		return nil
+	}
+	copied := make(map[string]interface{}, len(fields))
+	for k, v := range fields {
+		copied[k] = v
+	}
+	return copied
+}
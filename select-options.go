@@ -0,0 +1,141 @@
+package ldbl
+
+import (
+	"strings"
+)
+
+// Option of selecting items. Options are passed to Select() (and SelectIter()) among with arguments of condition:
+//
+//	storage.Select(&Image{}, &results, nil, 0, "users_id=?", userId, ldbl.WithColumns("filename"))
+//
+// Storages, that don't support some option, will ignore it.
+type SelectOption func(o *selectOptions)
+
+type selectOptions struct {
+	columns []string
+	deleted deletedMode
+}
+
+// Which soft-deleted items are selected (see SoftDeletable)
+type deletedMode int
+
+const (
+	excludeDeleted deletedMode = iota
+	includeDeleted
+	onlyDeleted
+)
+
+// Limits loaded fields of selected items (primary key is loaded always).
+// Items will be marked as partially loaded (see PartiallyLoadable).
+func WithColumns(fields ...string) SelectOption {
+	return func(o *selectOptions) {
+		o.columns = fields
+	}
+}
+
+// Selects soft-deleted items along with not deleted ones (see SoftDeletable)
+func WithDeleted() SelectOption {
+	return func(o *selectOptions) {
+		o.deleted = includeDeleted
+	}
+}
+
+// Selects only soft-deleted items (see SoftDeletable)
+func OnlyDeleted() SelectOption {
+	return func(o *selectOptions) {
+		o.deleted = onlyDeleted
+	}
+}
+
+// Separates select options from arguments of condition
+func splitSelectArgs(args []interface{}) (selectOptions, []interface{}) {
+	opts := selectOptions{}
+	conditionArgs := args[:0:0]
+	for _, arg := range args {
+		if option, isOption := arg.(SelectOption); isOption {
+			option(&opts)
+			continue
+		}
+		conditionArgs = append(conditionArgs, arg)
+	}
+	return opts, conditionArgs
+}
+
+// Returns list of columns for SELECT query ("*" if columns are not given)
+func columnsSql(d Dialect, proto Loadable, columns []string) string {
+	if len(columns) == 0 {
+		return "*"
+	}
+	keyNames := keyNamesOf(proto)
+	quoted := make([]string, 0, len(columns)+len(keyNames))
+	for _, name := range keyNames {
+		quoted = append(quoted, d.Quote(name))
+	}
+	for _, column := range columns {
+		if !isKeyField(proto, column) {
+			quoted = append(quoted, d.Quote(column))
+		}
+	}
+	return strings.Join(quoted, ", ")
+}
+
+// Adds filter of soft-deleted items to condition (if items of proto are SoftDeletable)
+func deletedCondition(d Dialect, proto Loadable, condition string, mode deletedMode) string {
+	softDeletable, ok := proto.(SoftDeletable)
+	if !ok || mode == includeDeleted {
+		return condition
+	}
+	filter := d.Quote(softDeletable.DeletedField()) + " IS NULL"
+	if mode == onlyDeleted {
+		filter = d.Quote(softDeletable.DeletedField()) + " IS NOT NULL"
+	}
+	if condition == "" {
+		return filter
+	}
+	return "(" + condition + ") AND " + filter
+}
+
+// Marks item as partially loaded (if it supports this)
+func markLoadedFields(item Loadable, columns []string) {
+	if partial, ok := item.(PartiallyLoadable); ok && len(columns) > 0 {
+		partial.SetLoadedFields(columns)
+	}
+}
+
+// Returns true, if item was loaded not entirely
+func isPartiallyLoaded(item Loadable) bool {
+	partial, ok := item.(PartiallyLoadable)
+	return ok && partial.LoadedFields() != nil
+}
+
+// Returns false, if item was loaded partially without given field
+func isFieldLoaded(item Loadable, field string) bool {
+	if !isPartiallyLoaded(item) {
+		return true
+	}
+	for _, loaded := range item.(PartiallyLoadable).LoadedFields() {
+		if loaded == field {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns false, if some of fields was not loaded (and not changed) in partially loaded item,
+// so it has initial value, which is not stored
+func areFieldsKnown(item Loadable, fields []string) bool {
+	for _, field := range fields {
+		if !isFieldLoaded(item, field) && !isFieldChanged(item, field) && !isKeyField(item, field) {
+			return false
+		}
+	}
+	return true
+}
+
+func isFieldChanged(item Loadable, field string) bool {
+	if tracked, ok := item.(ChangeTracked); ok {
+		_, changed := tracked.ChangedFields()[field]
+		return changed
+	}
+	return false
+}
@@ -0,0 +1,158 @@
+package ldbl_test
+
+import (
+	"context"
+	"errors"
+	"ldbl"
+	"os"
+	"testing"
+)
+
+var TEST_SHARD_DB_NAME = "ldbl-sqlite-shard_test.db"
+
+// Images are distributed between shards by id; other collections are stored in first shard
+func shardImagesById(collection string, id uint64, shardsCnt int) int {
+	if collection == "images" {
+		return int(id % uint64(shardsCnt))
+	}
+	return 0
+}
+
+// Generates ids with given step, so all of them are routed to the same shard by shardImagesById
+type steppingIdGenerator struct {
+	last, step uint64
+}
+
+func (g *steppingIdGenerator) NextId(ctx context.Context, s *ldbl.SqlStorage, collection string) (uint64, error) {
+	g.last += g.step
+	return g.last, nil
+}
+
+func idsOf(items []ldbl.Loadable) []uint64 {
+	ids := make([]uint64, 0, len(items))
+	for _, item := range items {
+		ids = append(ids, item.Id())
+	}
+	return ids
+}
+
+func TestSharding(t *testing.T) {
+	// cleanup after previous tests
+	removeTestDb()
+	// and bootstraping some test data
+	ok(t, makeTestData(provideTestDb()))
+
+	order := ldbl.OrderBy("images.filesize", ldbl.DESC).Then("id", ldbl.ASC)
+	expected := make([]ldbl.Loadable, 0)
+	ok(t, provideSqlStorage().Select(&Image{}, &expected, order, 0, ""))
+
+	// Both shards are filled with the same data, and then extra images are removed from every shard
+	shardDb, err := createDb(TEST_SHARD_DB_NAME)
+	ok(t, err)
+	defer os.Remove(TEST_SHARD_DB_NAME)
+	defer shardDb.Close()
+	ok(t, makeTestData(shardDb))
+	ok(t, dbExec(provideTestDb(), []string{"DELETE FROM images WHERE id % 2 = 1"}))
+	ok(t, dbExec(shardDb, []string{"DELETE FROM images WHERE id % 2 = 0"}))
+
+	S := ldbl.NewShardedStorage(provideSqlStorage(), ldbl.NewSqlStorage(shardDb)).SetShardFunc(shardImagesById)
+
+	// Loading from different shards
+	img := &Image{}
+	ok(t, S.Load(img, 2))
+	ok(t, S.Load(img, 3))
+	equals(t, uint64(3), img.Id())
+
+	// Results of all shards are merged according to order
+	results := make([]ldbl.Loadable, 0)
+	ok(t, S.Select(&Image{}, &results, order, 0, ""))
+	equals(t, idsOf(expected), idsOf(results))
+
+	results = make([]ldbl.Loadable, 0)
+	ok(t, S.Select(&Image{}, &results, order, 2, "filesize>?", 100000))
+	filtered := make([]ldbl.Loadable, 0)
+	for _, item := range expected {
+		if item.(*Image).Filesize() > 100000 {
+			filtered = append(filtered, item)
+		}
+	}
+	equals(t, idsOf(filtered[2:]), idsOf(results))
+
+	// Capacity of results limits count of merged items
+	results = make([]ldbl.Loadable, 0, 3)
+	ok(t, S.Select(&Image{}, &results, order, 1, ""))
+	equals(t, idsOf(expected[1:4]), idsOf(results))
+
+	cursor, err := S.SelectIter(&Image{}, order, 2, 3, "")
+	ok(t, err)
+	results = make([]ldbl.Loadable, 0)
+	for cursor.Next() {
+		results = append(results, cursor.Item())
+	}
+	ok(t, cursor.Close())
+	equals(t, idsOf(expected[2:5]), idsOf(results))
+
+	// Counts & aggregates are combined over shards
+	cnt, err := S.Count(&Image{}, "")
+	ok(t, err)
+	equals(t, int64(len(expected)), cnt)
+	exists, err := S.Exists(&Image{}, "filename=?", "pig1.jpg")
+	ok(t, err)
+	assert(t, exists, "Item of one of shards must exist")
+	var sum, min, max uint64
+	for i, item := range expected {
+		size := item.(*Image).Filesize()
+		sum += size
+		if i == 0 || size < min {
+			min = size
+		}
+		if size > max {
+			max = size
+		}
+	}
+	value, err := S.Aggregate(&Image{}, ldbl.SUM, "filesize", "")
+	ok(t, err)
+	equals(t, float64(sum), value)
+	value, err = S.Aggregate(&Image{}, ldbl.MIN, "filesize", "")
+	ok(t, err)
+	equals(t, float64(min), value)
+	value, err = S.Aggregate(&Image{}, ldbl.MAX, "filesize", "users_id=?", 2)
+	ok(t, err)
+	equals(t, float64(898111), value)
+	_, err = S.Aggregate(&Image{}, ldbl.AVG, "filesize", "")
+	assert(t, errors.Is(err, ldbl.ErrNotSupported), "AVG can't be combined over shards (got: %v)", err)
+
+	// New item is saved to shard, chosen for id 0, and can be loaded by assigned id
+	G := ldbl.NewShardedStorage(
+		provideSqlStorage().SetIdGenerator(&Image{}, &steppingIdGenerator{last: 1000, step: 2}),
+		ldbl.NewSqlStorage(shardDb)).SetShardFunc(shardImagesById)
+	created := &Image{}
+	created.SetField("users_id", uint64(1))
+	created.SetField("filename", "sharded.jpg")
+	ok(t, G.Save(created))
+	equals(t, uint64(1002), created.Id())
+	loaded := &Image{}
+	ok(t, G.Load(loaded, created.Id()))
+	equals(t, "sharded.jpg", loaded.Field("filename"))
+
+	// id, that is routed to another shard, is rejected
+	G = ldbl.NewShardedStorage(
+		provideSqlStorage().SetIdGenerator(&Image{}, &steppingIdGenerator{last: 1001, step: 2}),
+		ldbl.NewSqlStorage(shardDb)).SetShardFunc(shardImagesById)
+	misrouted := &Image{}
+	misrouted.SetField("users_id", uint64(1))
+	misrouted.SetField("filename", "misrouted.jpg")
+	err = G.Save(misrouted)
+	assert(t, errors.Is(err, ldbl.ErrInvalidPrimaryKey), "Item with id of another shard must not be saved (got: %v)", err)
+	equals(t, uint64(0), misrouted.Id())
+	assert(t, provideSqlStorage().Load(&Image{}, 1003) != nil, "Misrouted item must not be stored")
+
+	// Deleting from shard
+	ok(t, S.Delete(img))
+	assert(t, S.Load(&Image{}, 3) != nil, "Deleted image must not be loaded")
+
+	// Default shard func routes whole collection to one shard
+	equals(t, ldbl.ShardByCollection("users", 1, 2), ldbl.ShardByCollection("users", 2, 2))
+
+	removeTestDb()
+}
@@ -1,9 +1,12 @@
 package ldbl_test
 
 import (
+	"errors"
 	"ldbl"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 var qParams = struct {
@@ -59,3 +62,517 @@ func TestQuerying(t *testing.T) {
 	removeTestDb()
 
 }
+
+func TestIterating(t *testing.T) {
+	// cleanup after previous tests
+	removeTestDb()
+	// and bootstraping some test data
+	ok(t, makeTestData(provideTestDb()))
+
+	S := provideSqlStorage()
+
+	// Selecting with cursor
+	cursor, err := S.SelectIter(&Image{}, ldbl.OrderBy("id", ldbl.ASC), 0, 0, "")
+	ok(t, err)
+	cnt := 0
+	prev := uint64(0)
+	for cursor.Next() {
+		img, isImg := cursor.Item().(*Image)
+		assert(t, isImg, "Got item of wrong type (expected: *Image; got: %T)", cursor.Item())
+		assert(t, img.Id() > prev, "Wrong ordering (current item id must be greater than previous value of %d; got: %d)", prev, img.Id())
+		prev = img.Id()
+		cnt++
+	}
+	ok(t, cursor.Err())
+	ok(t, cursor.Close())
+	equals(t, TEST_IMAGES_CNT, cnt)
+
+	// Skipping & limiting
+	cursor, err = S.SelectIter(&Image{}, nil, 2, 3, "")
+	ok(t, err)
+	cnt = 0
+	for cursor.Next() {
+		cnt++
+	}
+	ok(t, cursor.Err())
+	ok(t, cursor.Close())
+	equals(t, 3, cnt)
+
+	// Querying with cursor
+	cursor, err = S.QueryIter(ldbl.Select(&Image{}).Where("filename LIKE ?", qParams.filenameLike+"%"))
+	ok(t, err)
+	for cursor.Next() {
+		img := cursor.Item().(*Image)
+		assert(t, strings.HasPrefix(img.Filename(), qParams.filenameLike), "'filename' must start from '%s'; got: '%s'", qParams.filenameLike, img.Filename())
+	}
+	ok(t, cursor.Err())
+	ok(t, cursor.Close())
+
+	// Selecting through dispatched storage
+	cursor, err = ldbl.NewDispatchedStorage(S).SelectIter(&User{}, nil, 0, 0, "")
+	ok(t, err)
+	cnt = 0
+	for cursor.Next() {
+		cnt++
+	}
+	ok(t, cursor.Close())
+	equals(t, TEST_USERS_CNT, cnt)
+
+	removeTestDb()
+}
+
+func TestUpserting(t *testing.T) {
+	// cleanup after previous tests
+	removeTestDb()
+	// and bootstraping some test data
+	ok(t, makeTestData(provideTestDb()))
+
+	S := provideSqlStorage()
+
+	// Existing entry must be updated
+	user := &User{Email: "me@safron.su", ImagesCount: 100}
+	ok(t, S.Upsert(user, "email"))
+	equals(t, uint64(1), user.Id())
+	ok(t, S.Load(user, 1))
+	equals(t, 100, user.ImagesCount)
+
+	// New entry must be inserted
+	user = &User{Email: "new@test.com", ImagesCount: 1}
+	ok(t, S.Upsert(user, "email"))
+	assert(t, user.Id() > uint64(TEST_USERS_CNT), "Upserted item must get id of new entry (got: %d)", user.Id())
+	ok(t, S.Load(user, user.Id()))
+	equals(t, "new@test.com", user.Email)
+
+	removeTestDb()
+}
+
+func TestNestedTransactions(t *testing.T) {
+	// cleanup after previous tests
+	removeTestDb()
+	// and bootstraping some test data
+	ok(t, makeTestData(provideTestDb()))
+
+	S := provideSqlStorage()
+	nestedErr := errors.New("Test error of nested transaction")
+
+	created := &User{Email: "nested@test.com"}
+	err := S.Transaction(func(tx ldbl.Transaction) error {
+		user := &User{}
+		ok(t, tx.Load(user, 1))
+		user.ImagesCount = 10
+		ok(t, tx.Save(user))
+
+		// Failed nested transaction must roll back only own changes
+		err := tx.(ldbl.TransactionalStorage).Transaction(func(nested ldbl.Transaction) error {
+			user := &User{}
+			ok(t, nested.Load(user, 2))
+			user.ImagesCount = 20
+			ok(t, nested.Save(user))
+			return nestedErr
+		})
+		equals(t, nestedErr, err)
+
+		// Successful one must be committed along with outer transaction
+		return tx.(ldbl.TransactionalStorage).Transaction(func(nested ldbl.Transaction) error {
+			return nested.Save(created)
+		})
+	})
+	ok(t, err)
+
+	user := &User{}
+	ok(t, S.Load(user, 1))
+	equals(t, 10, user.ImagesCount)
+	ok(t, S.Load(user, 2))
+	assert(t, user.ImagesCount != 20, "Changes of failed nested transaction must be rolled back")
+	ok(t, S.Load(user, created.Id()))
+	equals(t, "nested@test.com", user.Email)
+
+	removeTestDb()
+}
+
+func TestTransactionCallbacks(t *testing.T) {
+	// cleanup after previous tests
+	removeTestDb()
+	// and bootstraping some test data
+	ok(t, makeTestData(provideTestDb()))
+
+	S := provideSqlStorage()
+	calls := make([]string, 0)
+	record := func(name string) func() {
+		return func() { calls = append(calls, name) }
+	}
+
+	// Commited transaction
+	ok(t, S.Transaction(func(tx ldbl.Transaction) error {
+		tx.OnCommit(record("commit"))
+		tx.OnRollback(record("rollback"))
+		equals(t, 0, len(calls)) // callbacks are not called before commit
+		return nil
+	}))
+	equals(t, []string{"commit"}, calls)
+
+	// Rolled back transaction
+	calls = calls[:0]
+	testErr := errors.New("Test error")
+	err := S.Transaction(func(tx ldbl.Transaction) error {
+		tx.OnCommit(record("commit"))
+		tx.OnRollback(record("rollback"))
+		return testErr
+	})
+	equals(t, testErr, err)
+	equals(t, []string{"rollback"}, calls)
+
+	// Nested transactions
+	calls = calls[:0]
+	ok(t, S.Transaction(func(tx ldbl.Transaction) error {
+		tx.(ldbl.TransactionalStorage).Transaction(func(nested ldbl.Transaction) error {
+			nested.OnCommit(record("failed nested commit"))
+			nested.OnRollback(record("failed nested rollback"))
+			return testErr
+		})
+		equals(t, []string{"failed nested rollback"}, calls)
+		return tx.(ldbl.TransactionalStorage).Transaction(func(nested ldbl.Transaction) error {
+			nested.OnCommit(record("nested commit"))
+			return nil
+		})
+	}))
+	equals(t, []string{"failed nested rollback", "nested commit"}, calls)
+
+	// Outside of transaction callback is called immediately
+	calls = calls[:0]
+	S.OnCommit(record("commit"))
+	S.OnRollback(record("rollback"))
+	equals(t, []string{"commit"}, calls)
+
+	removeTestDb()
+}
+
+func TestStatementCache(t *testing.T) {
+	// cleanup after previous tests
+	removeTestDb()
+	// and bootstraping some test data
+	ok(t, makeTestData(provideTestDb()))
+
+	S := provideSqlStorage().EnableStatementCache(2)
+	equals(t, ldbl.StatementCacheStats{}, S.StatementCacheStats())
+
+	// The same query is prepared once
+	user := &User{}
+	ok(t, S.Load(user, 1))
+	ok(t, S.Load(user, 2))
+	equals(t, ldbl.StatementCacheStats{Hits: 1, Misses: 1, Size: 1}, S.StatementCacheStats())
+
+	// Cached statements are used inside of transaction
+	ok(t, S.Transaction(func(tx ldbl.Transaction) error {
+		if err := tx.Load(user, 1); err != nil {
+			return err
+		}
+		user.ImagesCount = 10
+		return tx.Save(user)
+	}))
+	equals(t, ldbl.StatementCacheStats{Hits: 2, Misses: 2, Size: 2}, S.StatementCacheStats())
+	ok(t, S.Load(user, 1))
+	equals(t, 10, user.ImagesCount)
+
+	// Least recently used statement is evicted
+	images := make([]ldbl.Loadable, 0)
+	ok(t, S.Select(&Image{}, &images, nil, 0, "users_id=?", 1))
+	equals(t, ldbl.StatementCacheStats{Hits: 3, Misses: 3, Size: 2}, S.StatementCacheStats())
+	user.ImagesCount = 20
+	ok(t, S.Save(user)) // UPDATE statement was evicted
+	equals(t, ldbl.StatementCacheStats{Hits: 3, Misses: 4, Size: 2}, S.StatementCacheStats())
+
+	// Statement, that is evicted by concurrent query, is not closed while it's in use
+	var wg sync.WaitGroup
+	errs := make(chan error, 32*3)
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- S.Load(&User{}, 1)
+			errs <- S.Load(&Image{}, 1)
+			_, err := S.Count(&Image{}, "users_id=?", 1)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		ok(t, err)
+	}
+
+	// Statements are bound to transaction once, and kept till it's end (even if they are evicted from cache)
+	S.EnableStatementCache(1)
+	ok(t, S.Transaction(func(tx ldbl.Transaction) error {
+		for i := 0; i < 2; i++ {
+			if err := tx.Load(&User{}, 1); err != nil {
+				return err
+			}
+			images := make([]ldbl.Loadable, 0)
+			if err := tx.Select(&Image{}, &images, nil, 0, "users_id=?", 1); err != nil {
+				return err
+			}
+		}
+		return tx.(*ldbl.SqlStorage).Transaction(func(nested ldbl.Transaction) error {
+			return nested.Load(&User{}, 2)
+		})
+	}))
+	equals(t, ldbl.StatementCacheStats{Hits: 3, Misses: 4, Size: 1}, S.StatementCacheStats()) // SAVEPOINT & RELEASE are missed too
+	ok(t, S.Load(user, 1))
+
+	// Cache can be disabled
+	S.EnableStatementCache(0)
+	ok(t, S.Load(user, 1))
+	equals(t, ldbl.StatementCacheStats{}, S.StatementCacheStats())
+
+	removeTestDb()
+}
+
+func TestTransactionRetries(t *testing.T) {
+	// cleanup after previous tests
+	removeTestDb()
+	// and bootstraping some test data
+	ok(t, makeTestData(provideTestDb()))
+
+	S := provideSqlStorage().SetRetryPolicy(&ldbl.RetryPolicy{
+		MaxAttempts: 3,
+		Backoff:     ldbl.ExponentialBackoff(time.Millisecond, 10*time.Millisecond),
+	})
+
+	// Transient errors are retried
+	attempts := 0
+	ok(t, S.Transaction(func(tx ldbl.Transaction) error {
+		attempts++
+		if err := tx.Save(&User{Email: "retried@test.com"}); err != nil {
+			return err
+		}
+		if attempts < 3 {
+			return errors.New("database is locked")
+		}
+		return nil
+	}))
+	equals(t, 3, attempts)
+	users := make([]ldbl.Loadable, 0)
+	ok(t, S.Select(&User{}, &users, nil, 0, "email=?", "retried@test.com"))
+	equals(t, 1, len(users))
+
+	// Items, saved or deleted by rolled back attempt, are restored before the next one
+	user := &User{Email: "retried2@test.com"}
+	deleted := &User{}
+	ok(t, S.Load(deleted, 1))
+	attempts = 0
+	ok(t, S.Transaction(func(tx ldbl.Transaction) error {
+		attempts++
+		if err := tx.Save(user); err != nil {
+			return err
+		}
+		if err := tx.Delete(deleted); err != nil {
+			return err
+		}
+		if attempts == 1 {
+			equals(t, uint64(0), deleted.Id())
+			return errors.New("database is locked")
+		}
+		return nil
+	}))
+	equals(t, 2, attempts)
+	assert(t, user.Id() > 0, "Saved item must get id")
+	loaded := &User{}
+	ok(t, S.Load(loaded, user.Id()))
+	equals(t, "retried2@test.com", loaded.Email)
+	err := S.Load(loaded, 1)
+	assert(t, errors.Is(err, ldbl.ErrNotFound), "Item must be deleted by retried attempt")
+
+	// But no more than MaxAttempts times
+	attempts = 0
+	err = S.Transaction(func(tx ldbl.Transaction) error {
+		attempts++
+		return errors.New("database is locked")
+	})
+	assert(t, err != nil, "Error of last attempt must be returned")
+	equals(t, 3, attempts)
+
+	// Other errors are not retried
+	attempts = 0
+	S.Transaction(func(tx ldbl.Transaction) error {
+		attempts++
+		return errors.New("Test error")
+	})
+	equals(t, 1, attempts)
+
+	removeTestDb()
+}
+
+func TestColumnProjection(t *testing.T) {
+	// cleanup after previous tests
+	removeTestDb()
+	// and bootstraping some test data
+	ok(t, makeTestData(provideTestDb()))
+
+	S := provideSqlStorage()
+
+	// Only selected fields are loaded; Structured items keep initial values for the rest
+	results := make([]ldbl.Loadable, 0)
+	ok(t, S.Select(&Image{}, &results, ldbl.OrderBy("id", ldbl.ASC), 0, "filesize>?", 100000, ldbl.WithColumns("filename")))
+	assert(t, len(results) > 0, "Got 0 results")
+	img := results[0].(*Image)
+	equals(t, uint64(2), img.Id())
+	equals(t, "kitty2.jpg", img.Filename())
+	equals(t, uint64(0), img.Filesize())
+	equals(t, []string{"filename"}, img.LoadedFields())
+
+	results = make([]ldbl.Loadable, 0)
+	ok(t, S.Query(ldbl.Select(&RawImage{}).Columns("filename", "filesize").Where("id=?", 1), &results))
+	equals(t, 1, len(results))
+	equals(t, map[string]interface{}{"filename": "kitty1.jpg", "filesize": "46555"}, results[0].(*RawImage).Fields())
+
+	// Fields, that were not loaded, are not overwritten on update
+	img.SetField("filename", "renamed.jpg")
+	ok(t, S.Save(img))
+	loaded := &Image{}
+	ok(t, S.Load(loaded, img.Id()))
+	equals(t, "renamed.jpg", loaded.Filename())
+	equals(t, uint64(124899), loaded.Filesize())
+	assert(t, loaded.LoadedFields() == nil, "Entirely loaded item must not be marked as partial")
+
+	removeTestDb()
+}
+
+func TestAggregating(t *testing.T) {
+	// cleanup after previous tests
+	removeTestDb()
+	// and bootstraping some test data
+	ok(t, makeTestData(provideTestDb()))
+
+	S := provideSqlStorage()
+
+	cnt, err := S.Count(&Image{}, "")
+	ok(t, err)
+	equals(t, int64(TEST_IMAGES_CNT), cnt)
+	cnt, err = S.Count(&Image{}, "filename LIKE ?", "kitty%")
+	ok(t, err)
+	equals(t, int64(5), cnt)
+
+	exists, err := S.Exists(&Image{}, "filename=?", "pig1.jpg")
+	ok(t, err)
+	assert(t, exists, "Image must exist")
+	exists, err = S.Exists(&Image{}, "filename=?", "unknown.jpg")
+	ok(t, err)
+	assert(t, !exists, "Image must not exist")
+
+	max, err := S.Aggregate(&Image{}, ldbl.MAX, "filesize", "users_id=?", 1)
+	ok(t, err)
+	equals(t, float64(440000), max)
+	avg, err := S.Aggregate(&Image{}, ldbl.AVG, "filesize", "users_id=?", 2)
+	ok(t, err)
+	equals(t, float64(898111+800246)/2, avg)
+	sum, err := S.Aggregate(&Image{}, ldbl.SUM, "filesize", "users_id=?", 100)
+	ok(t, err)
+	equals(t, float64(0), sum) // NULL for empty set
+
+	// Grouped query
+	query := ldbl.Select(&Image{}).
+		GroupBy("users_id").
+		Count().
+		Aggregate(ldbl.SUM, "filesize").
+		Having("COUNT(*) > ?", 1).
+		OrderBy("users_id", ldbl.ASC)
+	equals(t,
+		"SELECT `users_id`, COUNT(*) AS `count`, SUM(`filesize`) AS `sum_filesize` FROM `images` GROUP BY `users_id` HAVING COUNT(*) > ? ORDER BY users_id ASC",
+		query.Query())
+	rows, err := S.QueryValues(query)
+	ok(t, err)
+	equals(t, []map[string]interface{}{
+		{"users_id": int64(1), "count": int64(7), "sum_filesize": int64(46555 + 124899 + 164845 + 88190 + 164845 + 130229 + 440000)},
+		{"users_id": int64(2), "count": int64(2), "sum_filesize": int64(898111 + 800246)},
+	}, rows)
+
+	var usersCnt int
+	ok(t, S.QueryValue(ldbl.Select(&User{}).Count(), &usersCnt))
+	equals(t, TEST_USERS_CNT, usersCnt)
+
+	// Dispatched storage uses the same methods
+	D := provideDispatchedStorage()
+	cnt, err = D.Count(&User{}, "images_cnt>?", 2)
+	ok(t, err)
+	equals(t, int64(1), cnt)
+
+	removeTestDb()
+}
+
+func TestIdGenerators(t *testing.T) {
+	// cleanup after previous tests
+	removeTestDb()
+	// and bootstraping some test data
+	db := provideTestDb()
+	ok(t, makeTestData(db))
+
+	hilo := ldbl.NewHiLoGenerator(2)
+	_, err := db.Exec(hilo.Migration(ldbl.DefaultDialect).Up)
+	ok(t, err)
+	S := provideSqlStorage().SetIdGenerator(&TagVote{}, hilo)
+	other := provideSqlStorage().SetIdGenerator(&TagVote{}, ldbl.NewHiLoGenerator(2)) // like another process
+	newVote := func() *TagVote {
+		vote := &TagVote{}
+		vote.SetField("images_id", uint64(1))
+		vote.SetField("tag", "cats")
+		vote.SetField("users_id", uint64(1))
+		return vote
+	}
+	ids := make([]uint64, 0)
+	for _, storage := range []*ldbl.SqlStorage{S, S, other, S, S} {
+		vote := newVote()
+		ok(t, storage.Save(vote))
+		ids = append(ids, vote.Id())
+	}
+	equals(t, []uint64{1, 2, 3, 5, 6}, ids)
+
+	// block, allocated for rolled back transaction, is not allocated again (it's ids could be used by others)
+	var rolledBackId uint64
+	err = S.Transaction(func(tx ldbl.Transaction) error {
+		vote := newVote()
+		ok(t, tx.Save(vote))
+		rolledBackId = vote.Id()
+		return errors.New("Test error")
+	})
+	assert(t, err != nil, "Transaction must fail")
+	equals(t, uint64(7), rolledBackId)
+	vote := newVote()
+	ok(t, S.Save(vote))
+	equals(t, uint64(8), vote.Id())
+	ok(t, S.Load(&TagVote{}, vote.Id()))
+	third := provideSqlStorage().SetIdGenerator(&TagVote{}, ldbl.NewHiLoGenerator(2))
+	vote = newVote()
+	ok(t, third.Save(vote))
+	equals(t, uint64(9), vote.Id())
+
+	snowflake, err := ldbl.NewSnowflakeGenerator(7)
+	ok(t, err)
+	S.SetDefaultIdGenerator(snowflake)
+	images := []ldbl.Storable{&Image{}, &Image{}, &Image{}}
+	for _, img := range images {
+		img.(*Image).SetField("users_id", uint64(1))
+		img.(*Image).SetField("filename", "snowflake.jpg")
+	}
+	ok(t, S.SaveAll(images))
+	for i, img := range images {
+		equals(t, uint64(7), img.Id()>>12&1023)
+		if i > 0 {
+			assert(t, img.Id() > images[i-1].Id(), "Snowflake ids must grow (got %d after %d)", img.Id(), images[i-1].Id())
+		}
+		ok(t, S.Load(&Image{}, img.Id()))
+	}
+
+	S.SetIdGenerator(&User{}, ldbl.RandomIdGenerator{})
+	user := &User{Email: "random@test.com"}
+	ok(t, S.Save(user))
+	assert(t, user.Id() > 0 && user.Id() < 1<<63, "Random id must be positive 63-bit number (got: %d)", user.Id())
+	loaded := &User{}
+	ok(t, S.Load(loaded, user.Id()))
+	equals(t, "random@test.com", loaded.Email)
+
+	_, err = ldbl.NewSnowflakeGenerator(1024)
+	assert(t, err != nil, "Node number out of range must be rejected")
+
+	removeTestDb()
+}
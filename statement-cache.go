@@ -0,0 +1,165 @@
+package ldbl
+
+import (
+	"container/list"
+	"context"
+	"database/sql"
+	"sync"
+)
+
+// Cache of prepared statements, keyed by SQL text. When cache is full, least recently used statement is evicted
+// (and closed, when it's released by all it's users). Statements are prepared on DB (not on transaction),
+// so they can be reused by any transaction (see sql.Tx.Stmt()); every transaction binds statement once.
+type StatementCache struct {
+	sync.Mutex
+	db      *sql.DB
+	maxSize int
+	stmts   map[string]*list.Element
+	lru     *list.List // front is the most recently used statement
+	hits    uint64
+	misses  uint64
+}
+
+// Counters of statement cache usage (useful for tuning of cache size)
+type StatementCacheStats struct {
+	Hits   uint64
+	Misses uint64
+	Size   int
+}
+
+type cachedStmt struct {
+	query   string
+	stmt    *sql.Stmt
+	refs    int  // count of users, that got statement and didn't release it yet
+	evicted bool // statement is not in cache anymore, so it's closed after the last release
+}
+
+// With maxSize <= 0 statements are not cached: every statement is closed, when it's released.
+func NewStatementCache(db *sql.DB, maxSize int) *StatementCache {
+	return &StatementCache{
+		db:      db,
+		maxSize: maxSize,
+		stmts:   make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// Returns prepared statement for query (preparing it, if it's not cached yet). Returned func must be called,
+// when statement is not needed anymore: till then statement is not closed, even if it's evicted from cache.
+// Rows, opened by statement, can be read after release (they keep statement opened by themselves).
+func (c *StatementCache) Get(ctx context.Context, query string) (*sql.Stmt, func(), error) {
+	c.Lock()
+	defer c.Unlock()
+	if el, cached := c.stmts[query]; cached {
+		c.hits++
+		c.lru.MoveToFront(el)
+		return c.acquire(el.Value.(*cachedStmt))
+	}
+	c.misses++
+	stmt, err := c.db.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, nil, err
+	}
+	cached := &cachedStmt{query: query, stmt: stmt}
+	if c.maxSize <= 0 {
+		cached.evicted = true
+		return c.acquire(cached)
+	}
+	for c.lru.Len() >= c.maxSize {
+		c.evict(c.lru.Back())
+	}
+	c.stmts[query] = c.lru.PushFront(cached)
+	return c.acquire(cached)
+}
+
+func (c *StatementCache) Stats() StatementCacheStats {
+	c.Lock()
+	defer c.Unlock()
+	return StatementCacheStats{Hits: c.hits, Misses: c.misses, Size: c.lru.Len()}
+}
+
+// Evicts all cached statements (they are closed, when they aren't used anymore)
+func (c *StatementCache) Clear() {
+	c.Lock()
+	defer c.Unlock()
+	for c.lru.Len() > 0 {
+		c.evict(c.lru.Back())
+	}
+}
+
+// Counts use of statement, that was got from cache before (see txStatements)
+func (c *StatementCache) countHit() {
+	c.Lock()
+	defer c.Unlock()
+	c.hits++
+}
+
+func (c *StatementCache) acquire(cached *cachedStmt) (*sql.Stmt, func(), error) {
+	cached.refs++
+	var once sync.Once
+	return cached.stmt, func() {
+		once.Do(func() {
+			c.Lock()
+			defer c.Unlock()
+			cached.refs--
+			if cached.evicted && cached.refs == 0 {
+				cached.stmt.Close()
+			}
+		})
+	}, nil
+}
+
+// Statements of cache, bound to transaction (so they are re-bound once per transaction, not on every query).
+// Bound statements are closed by database/sql along with transaction; cached ones are released after that.
+type txStatements struct {
+	sync.Mutex
+	cache    *StatementCache
+	stmts    map[string]*sql.Stmt
+	releases []func()
+}
+
+func newTxStatements(cache *StatementCache) *txStatements {
+	if cache == nil {
+		return nil
+	}
+	return &txStatements{cache: cache, stmts: make(map[string]*sql.Stmt)}
+}
+
+func (t *txStatements) get(ctx context.Context, tx *sql.Tx, query string) (*sql.Stmt, func(), error) {
+	t.Lock()
+	defer t.Unlock()
+	if stmt, bound := t.stmts[query]; bound {
+		t.cache.countHit()
+		return stmt, func() {}, nil
+	}
+	stmt, release, err := t.cache.Get(ctx, query)
+	if err != nil {
+		return nil, nil, err
+	}
+	bound := tx.StmtContext(ctx, stmt)
+	t.stmts[query] = bound
+	t.releases = append(t.releases, release)
+	return bound, func() {}, nil
+}
+
+// Releases cached statements; must be called, when transaction is finished
+func (t *txStatements) release() {
+	if t == nil {
+		return
+	}
+	t.Lock()
+	defer t.Unlock()
+	for _, release := range t.releases {
+		release()
+	}
+	t.stmts, t.releases = nil, nil
+}
+
+func (c *StatementCache) evict(el *list.Element) {
+	cached := c.lru.Remove(el).(*cachedStmt)
+	delete(c.stmts, cached.query)
+	cached.evicted = true
+	if cached.refs == 0 {
+		cached.stmt.Close()
+	}
+}
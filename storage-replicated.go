@@ -0,0 +1,319 @@
+package ldbl
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Storage, that works with primary DB and it's read replicas.
+// Write operations (Save(), Delete(), transactions, etc.) are performed on primary storage,
+// and read operations (Load(), Select(), Query(), Count(), etc.) - on one of replicas, chosen by ReplicaBalancer.
+// Replicas may lag behind primary, so for some time after write (see SetReadYourWritesWindow())
+// reads are performed on primary too.
+type ReplicatedStorage struct {
+	OptionalLogger
+	primary  *SqlStorage
+	replicas []*SqlStorage
+	inFlight []int64 // count of currently performed queries for every replica
+	balancer ReplicaBalancer
+	window   time.Duration
+	mu       sync.RWMutex
+	written  time.Time // time of last write operation
+}
+
+// Chooses replica for read operation
+type ReplicaBalancer interface {
+	// Returns index of replica; inFlight contains count of currently performed queries for every replica
+	Choose(inFlight []int64) int
+}
+
+// Uses replicas in turn
+type RoundRobinBalancer struct {
+	counter uint64
+}
+
+// Uses replica with the least count of currently performed queries
+type LeastBusyBalancer struct{}
+
+func (b *RoundRobinBalancer) Choose(inFlight []int64) int {
+	return int((atomic.AddUint64(&b.counter, 1) - 1) % uint64(len(inFlight)))
+}
+
+func (b LeastBusyBalancer) Choose(inFlight []int64) int {
+	chosen := 0
+	for i := range inFlight {
+		if atomic.LoadInt64(&inFlight[i]) < atomic.LoadInt64(&inFlight[chosen]) {
+			chosen = i
+		}
+	}
+	return chosen
+}
+
+// Use this func for creating new instances of ReplicatedStorage.
+// Replicas are chosen with RoundRobinBalancer by default (see SetBalancer()).
+// Without replicas all operations are performed on primary.
+func NewReplicatedStorage(primary *SqlStorage, replicas ...*SqlStorage) *ReplicatedStorage {
+	s := &ReplicatedStorage{
+		primary:  primary,
+		replicas: replicas,
+		inFlight: make([]int64, len(replicas)),
+		balancer: &RoundRobinBalancer{},
+	}
+	s.LogPrefix = "Replicated storage"
+	return s
+}
+
+func (s *ReplicatedStorage) SetBalancer(b ReplicaBalancer) *ReplicatedStorage {
+	s.balancer = b
+	return s
+}
+
+// Sets duration after write operation, during which all reads are performed on primary
+// (so changes are visible immediately, even if replicas are not synced yet). Zero by default.
+func (s *ReplicatedStorage) SetReadYourWritesWindow(d time.Duration) *ReplicatedStorage {
+	s.window = d
+	return s
+}
+
+// Sets clock of primary storage (all writes are performed on it)
+func (s *ReplicatedStorage) UseClock(c Clock) {
+	s.primary.SetClock(c)
+}
+
+func (s *ReplicatedStorage) Primary() *SqlStorage {
+	return s.primary
+}
+
+func (s *ReplicatedStorage) Dialect() Dialect {
+	return s.primary.Dialect()
+}
+
+func (s *ReplicatedStorage) Save(item Storable) error {
+	return s.SaveContext(context.Background(), item)
+}
+
+func (s *ReplicatedStorage) SaveContext(ctx context.Context, item Storable) error {
+	defer s.markWritten()
+	return s.primary.SaveContext(ctx, item)
+}
+
+func (s *ReplicatedStorage) SaveAll(items []Storable) error {
+	return s.SaveAllContext(context.Background(), items)
+}
+
+func (s *ReplicatedStorage) SaveAllContext(ctx context.Context, items []Storable) error {
+	defer s.markWritten()
+	return s.primary.SaveAllContext(ctx, items)
+}
+
+func (s *ReplicatedStorage) Upsert(item Storable, conflictFields ...string) error {
+	return s.UpsertContext(context.Background(), item, conflictFields...)
+}
+
+func (s *ReplicatedStorage) UpsertContext(ctx context.Context, item Storable, conflictFields ...string) error {
+	defer s.markWritten()
+	return s.primary.UpsertContext(ctx, item, conflictFields...)
+}
+
+func (s *ReplicatedStorage) Delete(item Loadable) error {
+	return s.DeleteContext(context.Background(), item)
+}
+
+func (s *ReplicatedStorage) DeleteContext(ctx context.Context, item Loadable) error {
+	defer s.markWritten()
+	return s.primary.DeleteContext(ctx, item)
+}
+
+func (s *ReplicatedStorage) Restore(item SoftDeletable) error {
+	return s.RestoreContext(context.Background(), item)
+}
+
+func (s *ReplicatedStorage) RestoreContext(ctx context.Context, item SoftDeletable) error {
+	defer s.markWritten()
+	return s.primary.RestoreContext(ctx, item)
+}
+
+func (s *ReplicatedStorage) Purge(item Loadable) error {
+	return s.PurgeContext(context.Background(), item)
+}
+
+func (s *ReplicatedStorage) PurgeContext(ctx context.Context, item Loadable) error {
+	defer s.markWritten()
+	return s.primary.PurgeContext(ctx, item)
+}
+
+func (s *ReplicatedStorage) Load(to Loadable, id uint64) error {
+	return s.LoadContext(context.Background(), to, id)
+}
+
+func (s *ReplicatedStorage) LoadContext(ctx context.Context, to Loadable, id uint64) error {
+	return s.read(func(r *SqlStorage) error {
+		return r.LoadContext(ctx, to, id)
+	})
+}
+
+func (s *ReplicatedStorage) LoadByKey(to Keyed, key Key) error {
+	return s.LoadByKeyContext(context.Background(), to, key)
+}
+
+func (s *ReplicatedStorage) LoadByKeyContext(ctx context.Context, to Keyed, key Key) error {
+	return s.read(func(r *SqlStorage) error {
+		return r.LoadByKeyContext(ctx, to, key)
+	})
+}
+
+func (s *ReplicatedStorage) Select(proto Loadable, results *[]Loadable, order Orderer, skip int, condition string, args ...interface{}) error {
+	return s.SelectContext(context.Background(), proto, results, order, skip, condition, args...)
+}
+
+func (s *ReplicatedStorage) SelectContext(ctx context.Context, proto Loadable, results *[]Loadable, order Orderer, skip int, condition string, args ...interface{}) error {
+	return s.read(func(r *SqlStorage) error {
+		return r.SelectContext(ctx, proto, results, order, skip, condition, args...)
+	})
+}
+
+func (s *ReplicatedStorage) SelectIter(proto Loadable, order Orderer, skip, limit int, condition string, args ...interface{}) (Cursor, error) {
+	return s.SelectIterContext(context.Background(), proto, order, skip, limit, condition, args...)
+}
+
+func (s *ReplicatedStorage) SelectIterContext(ctx context.Context, proto Loadable, order Orderer, skip, limit int, condition string, args ...interface{}) (cursor Cursor, err error) {
+	err = s.read(func(r *SqlStorage) error {
+		cursor, err = r.SelectIterContext(ctx, proto, order, skip, limit, condition, args...)
+		return err
+	})
+	return
+}
+
+func (s *ReplicatedStorage) Query(builder SqlQueryBilder, results *[]Loadable) error {
+	return s.QueryContext(context.Background(), builder, results)
+}
+
+func (s *ReplicatedStorage) QueryContext(ctx context.Context, builder SqlQueryBilder, results *[]Loadable) error {
+	return s.read(func(r *SqlStorage) error {
+		return r.QueryContext(ctx, builder, results)
+	})
+}
+
+func (s *ReplicatedStorage) QueryIter(builder SqlQueryBilder) (Cursor, error) {
+	return s.QueryIterContext(context.Background(), builder)
+}
+
+func (s *ReplicatedStorage) QueryIterContext(ctx context.Context, builder SqlQueryBilder) (cursor Cursor, err error) {
+	err = s.read(func(r *SqlStorage) error {
+		cursor, err = r.QueryIterContext(ctx, builder)
+		return err
+	})
+	return
+}
+
+// Same as SqlStorage.QueryValue(), but query is performed on replica
+func (s *ReplicatedStorage) QueryValue(builder SqlQueryBilder, dest interface{}) error {
+	return s.QueryValueContext(context.Background(), builder, dest)
+}
+
+func (s *ReplicatedStorage) QueryValueContext(ctx context.Context, builder SqlQueryBilder, dest interface{}) error {
+	return s.read(func(r *SqlStorage) error {
+		return r.QueryValueContext(ctx, builder, dest)
+	})
+}
+
+// Same as SqlStorage.QueryValues(), but query is performed on replica
+func (s *ReplicatedStorage) QueryValues(builder SqlQueryBilder) ([]map[string]interface{}, error) {
+	return s.QueryValuesContext(context.Background(), builder)
+}
+
+func (s *ReplicatedStorage) QueryValuesContext(ctx context.Context, builder SqlQueryBilder) (rows []map[string]interface{}, err error) {
+	err = s.read(func(r *SqlStorage) error {
+		rows, err = r.QueryValuesContext(ctx, builder)
+		return err
+	})
+	return
+}
+
+func (s *ReplicatedStorage) Count(proto Loadable, condition string, args ...interface{}) (int64, error) {
+	return s.CountContext(context.Background(), proto, condition, args...)
+}
+
+func (s *ReplicatedStorage) CountContext(ctx context.Context, proto Loadable, condition string, args ...interface{}) (cnt int64, err error) {
+	err = s.read(func(r *SqlStorage) error {
+		cnt, err = r.CountContext(ctx, proto, condition, args...)
+		return err
+	})
+	return
+}
+
+func (s *ReplicatedStorage) Exists(proto Loadable, condition string, args ...interface{}) (bool, error) {
+	return s.ExistsContext(context.Background(), proto, condition, args...)
+}
+
+func (s *ReplicatedStorage) ExistsContext(ctx context.Context, proto Loadable, condition string, args ...interface{}) (exists bool, err error) {
+	err = s.read(func(r *SqlStorage) error {
+		exists, err = r.ExistsContext(ctx, proto, condition, args...)
+		return err
+	})
+	return
+}
+
+func (s *ReplicatedStorage) Aggregate(proto Loadable, fn AggregateFunc, field string, condition string, args ...interface{}) (float64, error) {
+	return s.AggregateContext(context.Background(), proto, fn, field, condition, args...)
+}
+
+func (s *ReplicatedStorage) AggregateContext(ctx context.Context, proto Loadable, fn AggregateFunc, field string, condition string, args ...interface{}) (value float64, err error) {
+	err = s.read(func(r *SqlStorage) error {
+		value, err = r.AggregateContext(ctx, proto, fn, field, condition, args...)
+		return err
+	})
+	return
+}
+
+// Transactions are always performed on primary (including reads inside of them)
+func (s *ReplicatedStorage) Transaction(f func(t Transaction) error) error {
+	return s.TransactionWithOptionsContext(context.Background(), nil, f)
+}
+
+func (s *ReplicatedStorage) TransactionContext(ctx context.Context, f func(t Transaction) error) error {
+	return s.TransactionWithOptionsContext(ctx, nil, f)
+}
+
+func (s *ReplicatedStorage) TransactionWithOptions(opts *sql.TxOptions, f func(t Transaction) error) error {
+	return s.TransactionWithOptionsContext(context.Background(), opts, f)
+}
+
+func (s *ReplicatedStorage) TransactionWithOptionsContext(ctx context.Context, opts *sql.TxOptions, f func(t Transaction) error) error {
+	defer s.markWritten()
+	return s.primary.TransactionWithOptionsContext(ctx, opts, f)
+}
+
+// Performs read operation on replica (or on primary, if there are no replicas or write was made recently)
+func (s *ReplicatedStorage) read(f func(r *SqlStorage) error) error {
+	if len(s.replicas) == 0 || s.recentlyWritten() {
+		s.Log("Reading from primary")
+		return f(s.primary)
+	}
+	i := s.balancer.Choose(s.inFlight)
+	s.Log("Reading from replica #%d", i)
+	atomic.AddInt64(&s.inFlight[i], 1)
+	defer atomic.AddInt64(&s.inFlight[i], -1)
+	return f(s.replicas[i])
+}
+
+func (s *ReplicatedStorage) markWritten() {
+	if s.window <= 0 {
+		return
+	}
+	s.mu.Lock()
+	s.written = time.Now()
+	s.mu.Unlock()
+}
+
+func (s *ReplicatedStorage) recentlyWritten() bool {
+	if s.window <= 0 {
+		return false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return time.Since(s.written) < s.window
+}
@@ -0,0 +1,306 @@
+package ldbl
+
+import (
+	"context"
+	"hash/fnv"
+)
+
+// Returns index of shard (from 0 to shardsCnt-1), that stores item of given collection with given id.
+// New items are saved to shard, returned for id 0, so ids, assigned by that shard (by DB or by IdGenerator
+// of it's SqlStorage), must be routed to the same shard, and must not collide with ids of other shards.
+type ShardFunc func(collection string, id uint64, shardsCnt int) int
+
+// Stores every collection entirely in one shard, chosen by hash of collection name
+func ShardByCollection(collection string, id uint64, shardsCnt int) int {
+	h := fnv.New32a()
+	h.Write([]byte(collection))
+	return int(h.Sum32() % uint32(shardsCnt))
+}
+
+// Storage, that distributes items between several underlying storages (shards).
+// Load(), Save() & Delete() are routed to shard, chosen by ShardFunc; Select() is performed
+// on all shards, and results are merged according to given order (counts & aggregates are combined too).
+type ShardedStorage struct {
+	OptionalLogger
+	shards    []Storage
+	shardFunc ShardFunc
+}
+
+// Use this func for creating new instances of ShardedStorage.
+// Items are routed with ShardByCollection by default (see SetShardFunc()).
+func NewShardedStorage(shards ...Storage) *ShardedStorage {
+	s := &ShardedStorage{shards: shards, shardFunc: ShardByCollection}
+	s.LogPrefix = "Sharded storage"
+	return s
+}
+
+func (s *ShardedStorage) SetShardFunc(f ShardFunc) *ShardedStorage {
+	s.shardFunc = f
+	return s
+}
+
+// Sets clock of all shards, that are using it
+func (s *ShardedStorage) UseClock(c Clock) {
+	for _, shard := range s.shards {
+		if clocked, ok := shard.(ClockedStorage); ok {
+			clocked.UseClock(c)
+		}
+	}
+}
+
+// Returns shard, that stores item of given collection with given id
+func (s *ShardedStorage) ShardFor(collection string, id uint64) Storage {
+	i := s.shardFunc(collection, id, len(s.shards))
+	s.Log("%s#%d is routed to shard #%d", collection, id, i)
+	return s.shards[i]
+}
+
+func (s *ShardedStorage) Save(item Storable) error {
+	return s.SaveContext(context.Background(), item)
+}
+
+// Saves item to it's shard. New item is saved to shard, chosen for id 0, and then it's checked, that assigned id
+// is routed to the same shard (otherwise item couldn't be loaded by it's id): if it's not, ErrInvalidPrimaryKey
+// is returned, and entry is not stored (when shard supports transactions).
+func (s *ShardedStorage) SaveContext(ctx context.Context, item Storable) error {
+	if _, isKeyed := item.(Keyed); isKeyed || item.Id() != 0 {
+		return saveWithContext(ctx, s.ShardFor(item.CollectionName(), item.Id()), item)
+	}
+	i := s.shardFunc(item.CollectionName(), 0, len(s.shards))
+	s.Log("New %s item is routed to shard #%d", item.CollectionName(), i)
+	create := func(shard Storage) error {
+		if err := saveWithContext(ctx, shard, item); err != nil {
+			return err
+		}
+		if routed := s.shardFunc(item.CollectionName(), item.Id(), len(s.shards)); routed != i {
+			return newError(
+				ErrInvalidPrimaryKey,
+				"%s#%d is saved to shard #%d, but it's id is routed to shard #%d",
+				item.CollectionName(), item.Id(), i, routed)
+		}
+		return nil
+	}
+	transactional, isTransactional := s.shards[i].(TransactionalStorage)
+	if !isTransactional {
+		return create(s.shards[i])
+	}
+	return transactionWithContext(ctx, transactional, func(t Transaction) error {
+		return create(t)
+	})
+}
+
+func (s *ShardedStorage) Load(to Loadable, id uint64) error {
+	return s.LoadContext(context.Background(), to, id)
+}
+
+func (s *ShardedStorage) LoadContext(ctx context.Context, to Loadable, id uint64) error {
+	return loadWithContext(ctx, s.ShardFor(to.CollectionName(), id), to, id)
+}
+
+func (s *ShardedStorage) Delete(item Loadable) error {
+	return s.DeleteContext(context.Background(), item)
+}
+
+func (s *ShardedStorage) DeleteContext(ctx context.Context, item Loadable) error {
+	return deleteWithContext(ctx, s.ShardFor(item.CollectionName(), item.Id()), item)
+}
+
+func (s *ShardedStorage) Restore(item SoftDeletable) error {
+	return s.RestoreContext(context.Background(), item)
+}
+
+func (s *ShardedStorage) RestoreContext(ctx context.Context, item SoftDeletable) error {
+	return restoreWithContext(ctx, s.ShardFor(item.CollectionName(), item.Id()), item)
+}
+
+func (s *ShardedStorage) Purge(item Loadable) error {
+	return s.PurgeContext(context.Background(), item)
+}
+
+func (s *ShardedStorage) PurgeContext(ctx context.Context, item Loadable) error {
+	return purgeWithContext(ctx, s.ShardFor(item.CollectionName(), item.Id()), item)
+}
+
+// Selects items from all shards. Results are merged according to order (only Order & *CombinedOrder
+// are supported), and then first skip items are skipped. As usual, cap(*results) limits count of selected items.
+func (s *ShardedStorage) Select(proto Loadable, results *[]Loadable, order Orderer, skip int, condition string, args ...interface{}) error {
+	return s.SelectContext(context.Background(), proto, results, order, skip, condition, args...)
+}
+
+func (s *ShardedStorage) SelectContext(ctx context.Context, proto Loadable, results *[]Loadable, order Orderer, skip int, condition string, args ...interface{}) error {
+	items, err := s.selectMerged(ctx, proto, order, skip, cap(*results), condition, args)
+	if err != nil {
+		return err
+	}
+	*results = append(*results, items...)
+	return nil
+}
+
+// Same as Select(), but with limit (<= 0 means "no limit"). Every shard returns at most skip+limit items
+// (if it's able to limit results, see IterableStorage), so merged results are kept in memory.
+func (s *ShardedStorage) SelectIter(proto Loadable, order Orderer, skip, limit int, condition string, args ...interface{}) (Cursor, error) {
+	return s.SelectIterContext(context.Background(), proto, order, skip, limit, condition, args...)
+}
+
+func (s *ShardedStorage) SelectIterContext(ctx context.Context, proto Loadable, order Orderer, skip, limit int, condition string, args ...interface{}) (Cursor, error) {
+	items, err := s.selectMerged(ctx, proto, order, skip, limit, condition, args)
+	if err != nil {
+		return nil, err
+	}
+	return &sliceCursor{items: items}, nil
+}
+
+func (s *ShardedStorage) selectMerged(ctx context.Context, proto Loadable, order Orderer, skip, limit int, condition string, args []interface{}) ([]Loadable, error) {
+	if skip < 0 {
+		skip = 0
+	}
+	shardLimit := 0
+	if limit > 0 {
+		shardLimit = skip + limit
+	}
+	merged := make([]Loadable, 0)
+	for i, shard := range s.shards {
+		items, err := selectLimited(ctx, shard, proto, order, shardLimit, condition, args)
+		if err != nil {
+			return nil, err
+		}
+		s.Log("Selected %d %s items from shard #%d", len(items), proto.CollectionName(), i)
+		merged = append(merged, items...)
+	}
+	if err := sortItems(merged, order); err != nil {
+		return nil, err
+	}
+	if skip >= len(merged) {
+		return merged[:0], nil
+	}
+	merged = merged[skip:]
+	if limit > 0 && limit < len(merged) {
+		merged = merged[:limit]
+	}
+	return merged, nil
+}
+
+// Returns sum of counts of items, that match condition, in all shards
+func (s *ShardedStorage) Count(proto Loadable, condition string, args ...interface{}) (int64, error) {
+	return s.CountContext(context.Background(), proto, condition, args...)
+}
+
+func (s *ShardedStorage) CountContext(ctx context.Context, proto Loadable, condition string, args ...interface{}) (int64, error) {
+	var total int64
+	for _, shard := range s.shards {
+		cnt, err := countIn(ctx, shard, proto, condition, args)
+		if err != nil {
+			return 0, err
+		}
+		total += cnt
+	}
+	return total, nil
+}
+
+// Returns true, if at least one of shards has item, that matches condition
+func (s *ShardedStorage) Exists(proto Loadable, condition string, args ...interface{}) (bool, error) {
+	return s.ExistsContext(context.Background(), proto, condition, args...)
+}
+
+func (s *ShardedStorage) ExistsContext(ctx context.Context, proto Loadable, condition string, args ...interface{}) (bool, error) {
+	for _, shard := range s.shards {
+		exists, err := existsIn(ctx, shard, proto, condition, args)
+		if err != nil || exists {
+			return exists, err
+		}
+	}
+	return false, nil
+}
+
+// Aggregates items of all shards. Only SUM, MIN & MAX are supported: results of shards can't be combined
+// for other functions (ErrNotSupported is returned for them, or if some of shards is not AggregatingStorage).
+func (s *ShardedStorage) Aggregate(proto Loadable, fn AggregateFunc, field string, condition string, args ...interface{}) (float64, error) {
+	return s.AggregateContext(context.Background(), proto, fn, field, condition, args...)
+}
+
+func (s *ShardedStorage) AggregateContext(ctx context.Context, proto Loadable, fn AggregateFunc, field string, condition string, args ...interface{}) (float64, error) {
+	if fn != SUM && fn != MIN && fn != MAX {
+		return 0, newError(ErrNotSupported, "Results of %s can't be combined over shards", fn)
+	}
+	result, found := float64(0), false
+	for i, shard := range s.shards {
+		aggregating, ok := shard.(AggregatingStorage)
+		if !ok {
+			return 0, newError(ErrNotSupported, "Shard #%d (%T) is not able to aggregate items", i, shard)
+		}
+		if fn != SUM {
+			// shards without values give 0, so they must be skipped for MIN & MAX
+			notNull := dialectOf(shard).Quote(field) + " IS NOT NULL"
+			if condition != "" {
+				notNull = "(" + condition + ") AND " + notNull
+			}
+			exists, err := existsWithContext(ctx, aggregating, proto, notNull, args...)
+			if err != nil {
+				return 0, err
+			}
+			if !exists {
+				continue
+			}
+		}
+		value, err := aggregateWithContext(ctx, aggregating, proto, fn, field, condition, args...)
+		if err != nil {
+			return 0, err
+		}
+		switch {
+		case !found, fn == MIN && value < result, fn == MAX && value > result:
+			result = value
+		case fn == SUM:
+			result += value
+		}
+		found = true
+	}
+	return result, nil
+}
+
+// Returns dialect of storage (if it's SQL storage) or DefaultDialect
+func dialectOf(s Storage) Dialect {
+	if provider, ok := s.(DialectProvider); ok {
+		return provider.Dialect()
+	}
+	return DefaultDialect
+}
+
+// Counts items in storage (selecting them, if storage is not able to count)
+func countIn(ctx context.Context, s Storage, proto Loadable, condition string, args []interface{}) (int64, error) {
+	if aggregating, ok := s.(AggregatingStorage); ok {
+		return countWithContext(ctx, aggregating, proto, condition, args...)
+	}
+	items := make([]Loadable, 0)
+	if err := selectWithContext(ctx, s, proto, &items, nil, 0, condition, args...); err != nil {
+		return 0, err
+	}
+	return int64(len(items)), nil
+}
+
+func existsIn(ctx context.Context, s Storage, proto Loadable, condition string, args []interface{}) (bool, error) {
+	if aggregating, ok := s.(AggregatingStorage); ok {
+		return existsWithContext(ctx, aggregating, proto, condition, args...)
+	}
+	cnt, err := countIn(ctx, s, proto, condition, args)
+	return cnt > 0, err
+}
+
+// Selects at most limit items (if storage is able to limit results), starting from the first one
+func selectLimited(ctx context.Context, s Storage, proto Loadable, order Orderer, limit int, condition string, args []interface{}) ([]Loadable, error) {
+	iterable, isIterable := s.(IterableStorage)
+	if limit <= 0 || !isIterable {
+		items := make([]Loadable, 0, limit)
+		err := selectWithContext(ctx, s, proto, &items, order, 0, condition, args...)
+		return items, err
+	}
+	cursor, err := selectIterWithContext(ctx, iterable, proto, order, 0, limit, condition, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+	items := make([]Loadable, 0, limit)
+	for cursor.Next() {
+		items = append(items, cursor.Item())
+	}
+	return items, cursor.Err()
+}
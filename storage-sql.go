@@ -1,9 +1,12 @@
 package ldbl
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"log"
+	"sort"
 	"strings"
 	"time"
 )
@@ -15,118 +18,719 @@ import (
 // Also supports transaction.
 type SqlStorage struct {
 	OptionalLogger
-	db     *sql.DB
-	logger *log.Logger
-	tx     *sql.Tx
+	db      *sql.DB
+	logger  *log.Logger
+	tx      *sql.Tx
+	ctx     context.Context // context of transaction (is set only for storages, that are scoped to transaction)
+	dialect Dialect
+	level   int             // nesting level of transaction (0 for top-level one); nested transactions use savepoints
+	hooks   *txCallbacks    // callbacks, registered inside of transaction
+	stmts   *StatementCache // cache of prepared statements (nil, if disabled)
+	retries *RetryPolicy    // policy of retrying transactions (nil, if disabled)
+	idGens  *idGenerators   // generators of ids for new items (nil, if ids are assigned by DB)
+	clock   Clock
+	deleted *time.Time    // time of soft deletion, shared by all items deleted inside of transaction (zero until first deletion)
+	txStmts *txStatements // cached statements, bound to transaction
+}
+
+// Generators of ids, set for collections
+type idGenerators struct {
+	byCollection map[string]IdGenerator
+	common       IdGenerator
+}
+
+// Callbacks, that will be called after transaction is finished
+type txCallbacks struct {
+	onCommit   []func()
+	onRollback []func()
+	states     []*itemState // states of items before they were changed inside of transaction
+}
+
+// Restores items, changed inside of rolled back transaction (so they could be saved again, e.g. on retry),
+// and calls callbacks
+func (h *txCallbacks) rollback() {
+	for i := len(h.states) - 1; i >= 0; i-- {
+		h.states[i].restore()
+	}
+	runCallbacks(h.onRollback)
 }
 
 // Use this func for creating new instances of SQLStorage.
+// Storage uses DefaultDialect for building queries (see SetDialect()).
 func NewSqlStorage(db *sql.DB) *SqlStorage {
-	s := &SqlStorage{db: db}
+	s := &SqlStorage{db: db, dialect: DefaultDialect, clock: SystemClock{}}
 	s.LogPrefix = "Storage"
 	return s
 }
 
+// Sets SQL dialect of DB, that storage is working with
+func (s *SqlStorage) SetDialect(d Dialect) *SqlStorage {
+	s.dialect = d
+	return s
+}
+
+func (s *SqlStorage) Dialect() Dialect {
+	return s.dialect
+}
+
+// Sets policy of retrying transactions, failed with transient errors (nil disables retries).
+// Whole function, passed to Transaction(), is re-run on every attempt (nested transactions are not retried).
+// Items, saved or deleted by rolled back attempt, are restored to their previous state before the next one.
+func (s *SqlStorage) SetRetryPolicy(policy *RetryPolicy) *SqlStorage {
+	s.retries = policy
+	return s
+}
+
+// Enables caching of prepared statements: queries with the same SQL text will be prepared only once
+// (maxSize statements are kept at most). Transactions of storage use cached statements too.
+// Note that statements are prepared on separate connection, so DB must allow more than one open connection.
+// With maxSize <= 0 cache is disabled.
+func (s *SqlStorage) EnableStatementCache(maxSize int) *SqlStorage {
+	if s.stmts != nil {
+		s.stmts.Clear()
+		s.stmts = nil
+	}
+	if maxSize > 0 {
+		s.stmts = NewStatementCache(s.db, maxSize)
+	}
+	return s
+}
+
+// Sets source of time for deletion times of SoftDeletable items
+func (s *SqlStorage) SetClock(c Clock) *SqlStorage {
+	s.clock = c
+	return s
+}
+
+// Same as SetClock() (see ClockedStorage)
+func (s *SqlStorage) UseClock(c Clock) {
+	s.SetClock(c)
+}
+
+// Sets generator of ids for new items of collection: ids are got before insert and included into INSERT statement.
+// By default ids are assigned by DB (see AutoIncrementGenerator).
+func (s *SqlStorage) SetIdGenerator(forItem Collectioned, g IdGenerator) *SqlStorage {
+	s.initIdGenerators()
+	s.idGens.byCollection[forItem.CollectionName()] = g
+	return s
+}
+
+// Sets generator of ids for collections, that have no own generator (see SetIdGenerator())
+func (s *SqlStorage) SetDefaultIdGenerator(g IdGenerator) *SqlStorage {
+	s.initIdGenerators()
+	s.idGens.common = g
+	return s
+}
+
+func (s *SqlStorage) initIdGenerators() {
+	if s.idGens == nil {
+		s.idGens = &idGenerators{byCollection: make(map[string]IdGenerator)}
+	}
+}
+
+// Returns usage counters of statement cache (zeros, if cache is disabled)
+func (s *SqlStorage) StatementCacheStats() StatementCacheStats {
+	if s.stmts == nil {
+		return StatementCacheStats{}
+	}
+	return s.stmts.Stats()
+}
+
 func (s *SqlStorage) Save(item Storable) error {
+	return s.SaveContext(s.context(), item)
+}
+
+func (s *SqlStorage) SaveContext(ctx context.Context, item Storable) error {
+	s.track(item)
+	return s.uniqueViolation(item.CollectionName(), s.save(ctx, item))
+}
+
+func (s *SqlStorage) save(ctx context.Context, item Storable) error {
+	if _, isKeyed := item.(Keyed); isKeyed {
+		return s.saveKeyed(ctx, item, nil)
+	}
 	if item.Id() == 0 {
-		return s.createNewEntry(item)
+		return s.createNewEntry(ctx, item)
+	}
+	return s.updateEntry(ctx, item)
+}
+
+// Saves all given items. New items are inserted with multi-row INSERT queries
+// (grouped by collection & set of fields), and get their ids as usual.
+// If storage is not inside of transaction, all items are saved in the new one.
+func (s *SqlStorage) SaveAll(items []Storable) error {
+	return s.SaveAllContext(s.context(), items)
+}
+
+func (s *SqlStorage) SaveAllContext(ctx context.Context, items []Storable) error {
+	if s.tx == nil {
+		return s.TransactionContext(ctx, func(t Transaction) error {
+			return t.(*SqlStorage).SaveAllContext(ctx, items)
+		})
+	}
+	for _, item := range items {
+		s.track(item)
+	}
+	return s.saveAll(ctx, items)
+}
+
+// Inserts item, or updates existing entry with the same values of conflictFields (they should be covered by unique key).
+// When conflictFields are not given, primary key is used. After saving, item gets id of inserted or updated entry.
+func (s *SqlStorage) Upsert(item Storable, conflictFields ...string) error {
+	return s.UpsertContext(s.context(), item, conflictFields...)
+}
+
+func (s *SqlStorage) UpsertContext(ctx context.Context, item Storable, conflictFields ...string) error {
+	s.track(item)
+	return s.uniqueViolation(item.CollectionName(), s.upsert(ctx, item, conflictFields))
+}
+
+func (s *SqlStorage) upsert(ctx context.Context, item Storable, conflictFields []string) error {
+	if _, isKeyed := item.(Keyed); isKeyed {
+		return s.saveKeyed(ctx, item, conflictFields)
+	}
+	values, err := insertValues(item)
+	if err != nil {
+		return err
+	}
+	if len(conflictFields) == 0 {
+		if item.Id() == 0 {
+			return s.createNewEntry(ctx, item)
+		}
+		conflictFields = []string{item.PKName()}
+		values[item.PKName()] = item.Id()
+	}
+	conflictValues := make([]interface{}, 0, len(conflictFields))
+	isConflictField := make(map[string]bool, len(conflictFields))
+	for _, field := range conflictFields {
+		value, present := values[field]
+		if !present {
+			return newError(ErrMissingField, "Can't upsert %s: no value for field '%s'", item.CollectionName(), field)
+		}
+		conflictValues = append(conflictValues, value)
+		isConflictField[field] = true
+	}
+	updateColumns := make([]string, 0, len(values))
+	for field := range values {
+		if !isConflictField[field] {
+			updateColumns = append(updateColumns, field)
+		}
 	}
-	return s.updateEntry(item)
+	sql, args := s.makeUpsertSql(item.CollectionName(), values, conflictFields, updateColumns)
+	if _, err := s.exec(ctx, sql, args...); err != nil {
+		return err
+	}
+	// id of affected entry can't be got in the same way for all DBs, so it's just selected
+	idSql := joinSql(
+		fmt.Sprintf(
+			"SELECT %s FROM %s WHERE %s",
+			s.dialect.Quote(item.PKName()),
+			s.dialect.Quote(item.CollectionName()),
+			equalsCondition(s.dialect, conflictFields)),
+		s.dialect.LimitOffset(1, 0))
+	id, err := s.queryId(ctx, idSql, conflictValues...)
+	if err != nil {
+		return err
+	}
+	item.Fill(id, nil)
+	resetChanges(item)
+	return nil
 }
 
 func (s *SqlStorage) Load(to Loadable, id uint64) error {
-	sql := fmt.Sprintf("SELECT * FROM `%s` WHERE `%s`=? LIMIT 1", to.CollectionName(), to.PKName())
-	rows, columns, err := s.queryRows(sql, id)
+	return s.LoadContext(s.context(), to, id)
+}
+
+func (s *SqlStorage) LoadContext(ctx context.Context, to Loadable, id uint64) error {
+	if keyed, isKeyed := to.(Keyed); isKeyed {
+		return s.LoadByKeyContext(ctx, keyed, Key{id})
+	}
+	return s.loadByKey(ctx, to, Key{id})
+}
+
+// Loads item with non-integer or composite primary key (see Keyed)
+func (s *SqlStorage) LoadByKey(to Keyed, key Key) error {
+	return s.LoadByKeyContext(s.context(), to, key)
+}
+
+func (s *SqlStorage) LoadByKeyContext(ctx context.Context, to Keyed, key Key) error {
+	return s.loadByKey(ctx, to, key)
+}
+
+func (s *SqlStorage) loadByKey(ctx context.Context, to Loadable, key Key) error {
+	keyNames := keyNamesOf(to)
+	if len(key) != len(keyNames) {
+		return newError(ErrInvalidPrimaryKey, "%s: Key %v doesn't match primary key %v", to.CollectionName(), key, keyNames)
+	}
+	condition := deletedCondition(s.dialect, to, equalsCondition(s.dialect, keyNames), excludeDeleted)
+	sql := joinSql(
+		fmt.Sprintf("SELECT * FROM %s WHERE %s", s.dialect.Quote(to.CollectionName()), condition),
+		s.dialect.LimitOffset(1, 0))
+	rows, columns, err := s.queryRows(ctx, sql, key...)
 	if err != nil {
 		return err
 	}
 	defer rows.Close()
 	if !rows.Next() {
-		//TODO: Custom error type
-		return fmt.Errorf("Entry %s#%d is not exists", to.CollectionName(), id)
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		return newError(ErrNotFound, "Entry %s#%s is not exists", to.CollectionName(), key)
 	}
 	return s.fillFromRow(rows, columns, to)
 }
 
 func (s *SqlStorage) Select(proto Loadable, results *[]Loadable, order Orderer, skip int, condition string, args ...interface{}) error {
-	conditionSql := condition
-	if conditionSql == "" {
-		conditionSql = "1"
-	}
-	orderSql := ""
-	if order != nil {
-		orderSql = "ORDER BY " + order.OrderString()
-	}
+	return s.SelectContext(s.context(), proto, results, order, skip, condition, args...)
+}
+
+func (s *SqlStorage) SelectContext(ctx context.Context, proto Loadable, results *[]Loadable, order Orderer, skip int, condition string, args ...interface{}) error {
 	limit := cap(*results)
 	if limit == 0 {
 		limit = -1
 	}
-	limitSql := ""
-	if (skip > 0) || (limit > 0) {
-		limitSql = fmt.Sprintf("LIMIT %d, %d", skip, limit)
+	opts, args := splitSelectArgs(args)
+	condition = deletedCondition(s.dialect, proto, condition, opts.deleted)
+	sql := s.makeSelectSql(proto, order, skip, limit, condition, opts.columns)
+	return s.loadByQuery(ctx, proto, sql, args, limit, opts.columns, results)
+}
+
+// Same as Select(), but returns cursor for iterating over selected items instead of loading them all at once.
+// Limit <= 0 means "no limit". Cursor keeps underlying rows opened until it's closed.
+func (s *SqlStorage) SelectIter(proto Loadable, order Orderer, skip, limit int, condition string, args ...interface{}) (Cursor, error) {
+	return s.SelectIterContext(s.context(), proto, order, skip, limit, condition, args...)
+}
+
+func (s *SqlStorage) SelectIterContext(ctx context.Context, proto Loadable, order Orderer, skip, limit int, condition string, args ...interface{}) (Cursor, error) {
+	if limit <= 0 {
+		limit = -1
+	}
+	opts, args := splitSelectArgs(args)
+	condition = deletedCondition(s.dialect, proto, condition, opts.deleted)
+	sql := s.makeSelectSql(proto, order, skip, limit, condition, opts.columns)
+	cursor, err := s.openCursor(ctx, proto, sql, args, limit, opts.columns)
+	if err != nil {
+		return nil, err
 	}
-	sql := fmt.Sprintf(
-		"SELECT * FROM `%s` WHERE %s %s %s",
-		proto.CollectionName(),
-		conditionSql,
-		orderSql,
-		limitSql)
-	return s.loadByQuery(proto, sql, args, limit, results)
+	return cursor, nil
 }
 
+// Deletes item. SoftDeletable items are only marked as deleted (see Restore() & Purge()):
+// they keep their ids, and time of deletion is set to their deleted field.
 func (s *SqlStorage) Delete(item Loadable) error {
-	if item.Id() == 0 {
+	return s.DeleteContext(s.context(), item)
+}
+
+func (s *SqlStorage) DeleteContext(ctx context.Context, item Loadable) error {
+	s.track(item)
+	if softDeletable, ok := item.(SoftDeletable); ok {
+		return s.setDeleted(ctx, softDeletable, s.deletionTime())
+	}
+	return s.remove(ctx, item)
+}
+
+// Returns time of soft deletion. Inside of transaction it's the same for all deleted items,
+// so items deleted together (e.g. by relations) could be distinguished later.
+func (s *SqlStorage) deletionTime() time.Time {
+	if s.deleted == nil {
+		return s.clock.Now()
+	}
+	if s.deleted.IsZero() {
+		*s.deleted = s.clock.Now()
+	}
+	return *s.deleted
+}
+
+// Restores soft-deleted item (see SoftDeletable)
+func (s *SqlStorage) Restore(item SoftDeletable) error {
+	return s.RestoreContext(s.context(), item)
+}
+
+func (s *SqlStorage) RestoreContext(ctx context.Context, item SoftDeletable) error {
+	s.track(item)
+	return s.setDeleted(ctx, item, nil)
+}
+
+// Deletes item permanently (even if it's SoftDeletable)
+func (s *SqlStorage) Purge(item Loadable) error {
+	return s.PurgeContext(s.context(), item)
+}
+
+func (s *SqlStorage) PurgeContext(ctx context.Context, item Loadable) error {
+	s.track(item)
+	return s.remove(ctx, item)
+}
+
+// Sets time of deletion of SoftDeletable item (nil restores it)
+func (s *SqlStorage) setDeleted(ctx context.Context, item SoftDeletable, deleted interface{}) error {
+	key := keyOf(item)
+	if key.IsZero() {
+		return nil
+	}
+	field := s.dialect.Quote(item.DeletedField())
+	filter := field + " IS NULL"
+	if deleted == nil {
+		filter = field + " IS NOT NULL"
+	}
+	fieldsSet := field + "=?"
+	args := []interface{}{deleted}
+	versioned, isVersioned := item.(Versioned)
+	if isVersioned {
+		fieldsSet += ", " + s.dialect.Quote(versioned.VersionField()) + "=?"
+		args = append(args, versioned.Version()+1)
+	}
+	sql := fmt.Sprintf(
+		"UPDATE %s SET %s WHERE %s AND %s",
+		s.dialect.Quote(item.CollectionName()), fieldsSet, equalsCondition(s.dialect, keyNamesOf(item)), filter)
+	args = append(args, key...)
+	if isVersioned {
+		sql += fmt.Sprintf(" AND %s=?", s.dialect.Quote(versioned.VersionField()))
+		args = append(args, versioned.Version())
+	}
+	res, err := s.exec(ctx, sql, args...)
+	if err != nil {
+		return err
+	}
+	if isVersioned {
+		if err := checkNotStale(res, item, versioned); err != nil {
+			return err
+		}
+		versioned.SetVersion(versioned.Version() + 1)
+	}
+	if setter, ok := item.(FieldsSetter); ok {
+		setter.SetField(item.DeletedField(), deleted)
+		resetChanges(item)
+	}
+	return nil
+}
+
+func (s *SqlStorage) remove(ctx context.Context, item Loadable) error {
+	key := keyOf(item)
+	if key.IsZero() {
+		return nil
+	}
+	sql := fmt.Sprintf("DELETE FROM %s WHERE %s", s.dialect.Quote(item.CollectionName()), equalsCondition(s.dialect, keyNamesOf(item)))
+	args := append([]interface{}{}, key...)
+	versioned, isVersioned := item.(Versioned)
+	if isVersioned {
+		sql += fmt.Sprintf(" AND %s=?", s.dialect.Quote(versioned.VersionField()))
+		args = append(args, versioned.Version())
+	}
+	res, err := s.exec(ctx, sql, args...)
+	if err != nil {
+		return err
+	}
+	if isVersioned {
+		if err := checkNotStale(res, item, versioned); err != nil {
+			return err
+		}
+	}
+	if keyed, isKeyed := item.(Keyed); isKeyed {
+		keyed.FillKey(nil, nil)
 		return nil
 	}
-	sql := fmt.Sprintf("DELETE FROM `%s` WHERE `%s`=%d", item.CollectionName(), item.PKName(), item.Id())
-	_, err := s.exec(sql)
 	item.Fill(0, nil)
-	return err
+	return nil
 }
 
-//TODO: doc
+// TODO: doc
 func (s *SqlStorage) Query(builder SqlQueryBilder, results *[]Loadable) error {
-	return s.loadByQuery(builder.ItemToLoad(), builder.Query(), builder.Args(), -1, results)
+	return s.QueryContext(s.context(), builder, results)
+}
+
+func (s *SqlStorage) QueryContext(ctx context.Context, builder SqlQueryBilder, results *[]Loadable) error {
+	return s.loadByQuery(ctx, builder.ItemToLoad(), s.queryOf(builder), builder.Args(), -1, selectedColumns(builder), results)
+}
+
+// Same as Query(), but returns cursor for iterating over loaded items.
+func (s *SqlStorage) QueryIter(builder SqlQueryBilder) (Cursor, error) {
+	return s.QueryIterContext(s.context(), builder)
+}
+
+func (s *SqlStorage) QueryIterContext(ctx context.Context, builder SqlQueryBilder) (Cursor, error) {
+	cursor, err := s.openCursor(ctx, builder.ItemToLoad(), s.queryOf(builder), builder.Args(), -1, selectedColumns(builder))
+	if err != nil {
+		return nil, err
+	}
+	return cursor, nil
+}
+
+// Performs query, that returns single value (like SqlQuery.Count()), and scans it to dest (see sql.Rows.Scan()).
+// Returns ErrNotFound, if query returned no rows.
+func (s *SqlStorage) QueryValue(builder SqlQueryBilder, dest interface{}) error {
+	return s.QueryValueContext(s.context(), builder, dest)
+}
+
+func (s *SqlStorage) QueryValueContext(ctx context.Context, builder SqlQueryBilder, dest interface{}) error {
+	sql := s.queryOf(builder)
+	rows, _, err := s.queryRows(ctx, sql, builder.Args()...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		return newError(ErrNotFound, "Query returned no rows: %s", sql)
+	}
+	return rows.Scan(dest)
+}
+
+// Performs query (like grouped one, see SqlQuery.GroupBy()) and returns it's rows as maps of column values.
+// Values are returned as DB driver gives them (except of []byte, that are converted to strings).
+func (s *SqlStorage) QueryValues(builder SqlQueryBilder) ([]map[string]interface{}, error) {
+	return s.QueryValuesContext(s.context(), builder)
+}
+
+func (s *SqlStorage) QueryValuesContext(ctx context.Context, builder SqlQueryBilder) ([]map[string]interface{}, error) {
+	rows, columns, err := s.queryRows(ctx, s.queryOf(builder), builder.Args()...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	results := make([]map[string]interface{}, 0)
+	values := make([]interface{}, len(columns))
+	targets := make([]interface{}, len(columns))
+	for i := range values {
+		targets[i] = &values[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(targets...); err != nil {
+			return nil, err
+		}
+		row := make(map[string]interface{}, len(columns))
+		for i, column := range columns {
+			if bytes, isBytes := values[i].([]byte); isBytes {
+				row[column] = string(bytes)
+			} else {
+				row[column] = values[i]
+			}
+		}
+		results = append(results, row)
+	}
+	return results, rows.Err()
+}
+
+// Returns count of items, that match condition
+func (s *SqlStorage) Count(proto Loadable, condition string, args ...interface{}) (int64, error) {
+	return s.CountContext(s.context(), proto, condition, args...)
 }
 
-//TODO: doc
+func (s *SqlStorage) CountContext(ctx context.Context, proto Loadable, condition string, args ...interface{}) (int64, error) {
+	opts, args := splitSelectArgs(args)
+	q := Select(proto).Count().Where(condition, args...)
+	q.deleted = opts.deleted
+	var cnt int64
+	err := s.QueryValueContext(ctx, q, &cnt)
+	return cnt, err
+}
+
+// Returns true, if there is at least one item, that matches condition
+func (s *SqlStorage) Exists(proto Loadable, condition string, args ...interface{}) (bool, error) {
+	return s.ExistsContext(s.context(), proto, condition, args...)
+}
+
+func (s *SqlStorage) ExistsContext(ctx context.Context, proto Loadable, condition string, args ...interface{}) (bool, error) {
+	opts, args := splitSelectArgs(args)
+	condition = deletedCondition(s.dialect, proto, condition, opts.deleted)
+	conditionSql := ""
+	if condition != "" {
+		conditionSql = "WHERE " + condition
+	}
+	sql := joinSql(
+		"SELECT 1 FROM "+s.dialect.Quote(proto.CollectionName()),
+		conditionSql,
+		s.dialect.LimitOffset(1, 0))
+	rows, _, err := s.queryRows(ctx, sql, args...)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	if rows.Next() {
+		return true, nil
+	}
+	return false, rows.Err()
+}
+
+// Returns value of aggregate function over field of items, that match condition.
+// If there are no such items (so result is NULL), 0 is returned.
+func (s *SqlStorage) Aggregate(proto Loadable, fn AggregateFunc, field string, condition string, args ...interface{}) (float64, error) {
+	return s.AggregateContext(s.context(), proto, fn, field, condition, args...)
+}
+
+func (s *SqlStorage) AggregateContext(ctx context.Context, proto Loadable, fn AggregateFunc, field string, condition string, args ...interface{}) (float64, error) {
+	opts, args := splitSelectArgs(args)
+	q := Select(proto).Aggregate(fn, field).Where(condition, args...)
+	q.deleted = opts.deleted
+	var value sql.NullFloat64
+	err := s.QueryValueContext(ctx, q, &value)
+	return value.Float64, err
+}
+
+// TODO: doc
 func (s *SqlStorage) Transaction(f func(t Transaction) error) error {
-	tx, err := s.db.Begin()
+	return s.TransactionContext(s.context(), f)
+}
+
+// Runs f inside a transaction, started with given context.
+// Storage passed to f is bound to that context, so all it's queries will be cancelled along with ctx.
+// When called on transaction-scoped storage, nested transaction is performed using savepoint.
+func (s *SqlStorage) TransactionContext(ctx context.Context, f func(t Transaction) error) error {
+	return s.TransactionWithOptionsContext(ctx, nil, f)
+}
+
+// Runs f inside a transaction with given isolation level & read-only mode (nil opts means defaults of DB driver).
+// Options can't be changed for nested transaction, so they are ignored when storage is already inside transaction.
+func (s *SqlStorage) TransactionWithOptions(opts *sql.TxOptions, f func(t Transaction) error) error {
+	return s.TransactionWithOptionsContext(s.context(), opts, f)
+}
+
+func (s *SqlStorage) TransactionWithOptionsContext(ctx context.Context, opts *sql.TxOptions, f func(t Transaction) error) error {
+	if s.tx != nil {
+		return s.savepoint(ctx, f)
+	}
+	return retry(ctx, s.retries, s.dialect, &s.OptionalLogger, func() error {
+		return s.transaction(ctx, opts, f)
+	})
+}
+
+func (s *SqlStorage) transaction(ctx context.Context, opts *sql.TxOptions, f func(t Transaction) error) error {
+	tx, err := s.db.BeginTx(ctx, opts)
 	if err != nil {
-		return nil
+		return err
 	}
 	s.Log("Transaction started")
-	transaction := &SqlStorage{tx: tx, OptionalLogger: s.OptionalLogger}
+	hooks := &txCallbacks{}
+	txStmts := newTxStatements(s.stmts)
+	defer txStmts.release()
+	transaction := &SqlStorage{db: s.db, tx: tx, ctx: ctx, dialect: s.dialect, hooks: hooks, stmts: s.stmts, idGens: s.idGens, clock: s.clock, deleted: new(time.Time), txStmts: txStmts, OptionalLogger: s.OptionalLogger}
 	transaction.LogPrefix = "Storage (inside transaction)"
 	err = f(transaction)
 	if err != nil {
-		if rollbackErr := tx.Rollback(); rollbackErr != nil {
-			//TODO: custom error type
-			panic(fmt.Errorf(
-				"Can't rollback a transaction: %s (which must be rolled back because of: %s)",
-				rollbackErr.Error(),
-				err.Error()))
+		rollbackErr := tx.Rollback()
+		hooks.rollback()
+		if rollbackErr != nil {
+			return &RollbackError{Err: err, RollbackErr: rollbackErr}
 		}
 		s.Log("Transaction rolled back")
 		return err
 	}
 	s.Log("Transaction will be commited")
-	return tx.Commit()
+	if err = tx.Commit(); err != nil {
+		hooks.rollback()
+		return err
+	}
+	runCallbacks(hooks.onCommit)
+	return nil
 }
 
-func (s *SqlStorage) loadByQuery(proto Loadable, sql string, args []interface{}, limit int, results *[]Loadable) error {
-	unlimited := limit == -1
-	rows, columns, err := s.queryRows(sql, args...)
-	if err != nil {
+// Registers callback, that will be called after commit of transaction.
+// For storage, that is not inside of transaction, f is called immediately (changes are already commited).
+// Callbacks of nested transaction are called after commit of the top-level one.
+func (s *SqlStorage) OnCommit(f func()) {
+	if s.hooks == nil {
+		f()
+		return
+	}
+	s.hooks.onCommit = append(s.hooks.onCommit, f)
+}
+
+// Registers callback, that will be called after rollback of transaction (or if it's commit failed).
+// For storage, that is not inside of transaction, f is never called.
+func (s *SqlStorage) OnRollback(f func()) {
+	if s.hooks == nil {
+		return
+	}
+	s.hooks.onRollback = append(s.hooks.onRollback, f)
+}
+
+// Performs nested transaction inside of the current one, using savepoint.
+// If f returns error, only changes made by f are rolled back, and outer transaction may continue.
+func (s *SqlStorage) savepoint(ctx context.Context, f func(t Transaction) error) error {
+	name := s.dialect.Quote(fmt.Sprintf("ldbl_sp_%d", s.level+1))
+	if _, err := s.exec(ctx, "SAVEPOINT "+name); err != nil {
 		return err
 	}
-	defer rows.Close()
-	for i := 0; rows.Next() && (unlimited || (i < limit)); i++ {
-		clone := proto.Clone()
-		if err := s.fillFromRow(rows, columns, clone); err != nil {
-			return err
+	s.Log("Savepoint %s created", name)
+	hooks := &txCallbacks{}
+	transaction := &SqlStorage{db: s.db, tx: s.tx, ctx: ctx, dialect: s.dialect, level: s.level + 1, hooks: hooks, stmts: s.stmts, idGens: s.idGens, clock: s.clock, deleted: s.deleted, txStmts: s.txStmts, OptionalLogger: s.OptionalLogger}
+	transaction.LogPrefix = "Storage (inside nested transaction)"
+	err := f(transaction)
+	if err != nil {
+		_, rollbackErr := s.exec(ctx, "ROLLBACK TO SAVEPOINT "+name)
+		if rollbackErr == nil {
+			// savepoint is kept after rolling back to it, so it must be released anyway
+			_, rollbackErr = s.exec(ctx, "RELEASE SAVEPOINT "+name)
+		}
+		hooks.rollback()
+		if rollbackErr != nil {
+			return &RollbackError{Err: err, RollbackErr: rollbackErr}
 		}
-		*results = append(*results, clone)
+		s.Log("Rolled back to savepoint %s", name)
+		return err
+	}
+	if _, err = s.exec(ctx, "RELEASE SAVEPOINT "+name); err != nil {
+		hooks.rollback()
+		return err
+	}
+	// changes of nested transaction are commited (or rolled back) along with outer one
+	s.hooks.onCommit = append(s.hooks.onCommit, hooks.onCommit...)
+	s.hooks.onRollback = append(s.hooks.onRollback, hooks.onRollback...)
+	s.hooks.states = append(s.hooks.states, hooks.states...)
+	return nil
+}
+
+// Remembers state of item, that is going to be changed inside of transaction: if transaction is rolled back,
+// item is restored (otherwise it would keep id, version, etc., assigned by rolled back queries)
+func (s *SqlStorage) track(item Loadable) {
+	if s.hooks == nil {
+		return
+	}
+	s.hooks.states = append(s.hooks.states, saveItemState(item))
+}
+
+func (s *SqlStorage) makeSelectSql(proto Loadable, order Orderer, skip, limit int, condition string, columns []string) string {
+	conditionSql := ""
+	if condition != "" {
+		conditionSql = "WHERE " + condition
+	}
+	orderSql := ""
+	if order != nil {
+		orderSql = "ORDER BY " + order.OrderString()
+	}
+	return joinSql(
+		"SELECT "+columnsSql(s.dialect, proto, columns)+" FROM "+s.dialect.Quote(proto.CollectionName()),
+		conditionSql,
+		orderSql,
+		s.dialect.LimitOffset(limit, skip))
+}
+
+func (s *SqlStorage) loadByQuery(ctx context.Context, proto Loadable, sql string, args []interface{}, limit int, columns []string, results *[]Loadable) error {
+	cursor, err := s.openCursor(ctx, proto, sql, args, limit, columns)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close()
+	for cursor.Next() {
+		*results = append(*results, cursor.Item())
+	}
+	return cursor.Err()
+}
+
+// Items are marked as partially loaded, if selected columns are given (see PartiallyLoadable)
+func (s *SqlStorage) openCursor(ctx context.Context, proto Loadable, sql string, args []interface{}, limit int, selected []string) (*sqlCursor, error) {
+	rows, columns, err := s.queryRows(ctx, sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	return &sqlCursor{storage: s, rows: rows, columns: columns, selected: selected, proto: proto, limit: limit}, nil
+}
+
+// Returns columns, selected by query builder (nil means "all columns")
+func selectedColumns(builder SqlQueryBilder) []string {
+	if projecting, ok := builder.(interface{ SelectedColumns() []string }); ok {
+		return projecting.SelectedColumns()
 	}
 	return nil
 }
@@ -136,161 +740,578 @@ func (s *SqlStorage) fillFromRow(rows *sql.Rows, columns []string, to Loadable)
 		return s.fillFromRowStructured(rows, columns, asStructured)
 	}
 	columnsCnt := len(columns)
-	ifaces := s.makeScanStrPlaceholders(columns, to)
+	ifaces, values := s.makeScanStrPlaceholders(columns, to)
 	if err := rows.Scan(ifaces...); err != nil {
-		//TODO: Custom error type
-		return fmt.Errorf("%s: %s", to.CollectionName(), err.Error())
+		return fmt.Errorf("%s: %w", to.CollectionName(), err)
 	}
 	fields := make(map[string]interface{}, columnsCnt-1)
-	id := uint64(0)
 	for i := 0; i < columnsCnt; i++ {
-		if columns[i] == to.PKName() {
-			if idPtr, ok := ifaces[i].(*uint64); ok {
-				id = *idPtr
-			} else {
-				//TODO: Custom error type
-				return fmt.Errorf("%s: Primary key contains not integer value", to.CollectionName())
-			}
+		if isKeyField(to, columns[i]) {
 			continue
 		}
-		fields[columns[i]] = *(ifaces[i].(*string))
+		value, _, err := values[i]()
+		if err != nil {
+			return fmt.Errorf("%s.%s: %w", to.CollectionName(), columns[i], err)
+		}
+		fields[columns[i]] = value
 	}
-	return to.Fill(id, fields)
+	return fillWithKey(to, columns, ifaces, fields)
 }
 
 func (s *SqlStorage) fillFromRowStructured(rows *sql.Rows, columns []string, to Structured) error {
-	ifaces, structFields := s.makeScanPlaceholders(columns, to)
+	ifaces, values, structFields := s.makeScanPlaceholders(columns, to)
 	if err := rows.Scan(ifaces...); err != nil {
-		//TODO: Custom error type
-		return fmt.Errorf("%s: %s", to.CollectionName(), err.Error())
+		return fmt.Errorf("%s: %w", to.CollectionName(), err)
 	}
-	id := uint64(0)
 	for i := 0; i < len(columns); i++ {
-		if columns[i] == to.PKName() {
-			if idPtr, ok := ifaces[i].(*uint64); ok {
-				id = *idPtr
-			} else {
-				//TODO: Custom error type
-				return fmt.Errorf("%s: Primary key contains not integer value", to.CollectionName())
-			}
+		if isKeyField(to, columns[i]) {
 			continue
 		}
 		if _, present := structFields[columns[i]]; !present {
 			continue
 		}
-		switch ifaces[i].(type) {
-		case *int:
-			structFields[columns[i]] = *(ifaces[i].(*int))
-		case *int64:
-			structFields[columns[i]] = *(ifaces[i].(*int64))
-		case *float64:
-			structFields[columns[i]] = *(ifaces[i].(*float64))
-		case *bool:
-			structFields[columns[i]] = *(ifaces[i].(*bool))
-		case *[]byte:
-			structFields[columns[i]] = *(ifaces[i].(*[]byte))
-		case *time.Time:
-			structFields[columns[i]] = *(ifaces[i].(*time.Time))
-		case *string:
-			structFields[columns[i]] = *(ifaces[i].(*string))
-		case *uint64:
-			structFields[columns[i]] = *(ifaces[i].(*uint64))
-		}
-	}
-	return to.Fill(id, structFields)
-}
-
-func (s *SqlStorage) makeScanStrPlaceholders(columns []string, forValue Loadable) []interface{} {
+		value, notNull, err := values[i]()
+		if err != nil {
+			return fmt.Errorf("%s.%s: %w", to.CollectionName(), columns[i], err)
+		}
+		if notNull {
+			structFields[columns[i]] = value
+		}
+	}
+	return fillWithKey(to, columns, ifaces, structFields)
+}
+
+func (s *SqlStorage) makeScanStrPlaceholders(columns []string, forValue Loadable) ([]interface{}, []scannedValue) {
 	columnsCnt := len(columns)
 	ifaces := make([]interface{}, columnsCnt)
+	values := make([]scannedValue, columnsCnt)
 	for i := 0; i < columnsCnt; i++ {
-		if columns[i] == forValue.PKName() {
-			ifaces[i] = new(uint64)
+		if isKeyField(forValue, columns[i]) {
+			ifaces[i] = keyScanTarget(forValue)
 			continue
 		}
-		ifaces[i] = new(string)
+		ifaces[i], values[i] = untypedScanTarget()
 	}
-	return ifaces
+	return ifaces, values
 }
 
-func (s *SqlStorage) makeScanPlaceholders(columns []string, forValue Structured) ([]interface{}, map[string]interface{}) {
+func (s *SqlStorage) makeScanPlaceholders(columns []string, forValue Structured) ([]interface{}, []scannedValue, map[string]interface{}) {
 	columnsCnt := len(columns)
 	ifaces := make([]interface{}, columnsCnt)
+	values := make([]scannedValue, columnsCnt)
 	structFields := forValue.FieldsStruct()
 	for i := 0; i < columnsCnt; i++ {
-		if columns[i] == forValue.PKName() {
-			ifaces[i] = new(uint64)
+		if isKeyField(forValue, columns[i]) {
+			ifaces[i] = keyScanTarget(forValue)
 			continue
 		}
 		if val, present := structFields[columns[i]]; present {
-			switch val.(type) {
-			case int:
-				ifaces[i] = new(int)
-			case int64:
-				ifaces[i] = new(int64)
-			case float64:
-				ifaces[i] = new(float64)
-			case bool:
-				ifaces[i] = new(bool)
-			case []byte:
-				ifaces[i] = new([]byte)
-			case time.Time:
-				ifaces[i] = new(time.Time)
-			case uint64:
-				ifaces[i] = new(uint64)
-			default: // trying to convert all other types to string
-				ifaces[i] = new(string)
+			ifaces[i], values[i] = typedScanTarget(val)
+			continue
+		}
+		ifaces[i], values[i] = untypedScanTarget()
+	}
+	return ifaces, values, structFields
+}
+
+func (s *SqlStorage) createNewEntry(ctx context.Context, item Storable) error {
+	id, err := s.generateId(ctx, item)
+	if err != nil {
+		return err
+	}
+	sql, values, err := s.makeInsertSqlFor(item, id)
+	if err != nil {
+		return err
+	}
+	if id != 0 {
+		if _, err := s.exec(ctx, sql, values...); err != nil {
+			return err
+		}
+		item.Fill(id, nil)
+		resetChanges(item)
+		return nil
+	}
+	if returning := s.dialect.ReturningId(item.PKName()); returning != "" {
+		id, err := s.queryId(ctx, sql+" "+returning, values...)
+		if err != nil {
+			return err
+		}
+		item.Fill(id, nil)
+		resetChanges(item)
+		return nil
+	}
+	res, err := s.exec(ctx, sql, values...)
+	if err != nil {
+		return err
+	}
+	lastId, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	item.Fill(uint64(lastId), nil)
+	resetChanges(item)
+	return nil
+}
+
+// Saves item with non-integer or composite key (see Keyed): entry is inserted, or updated, if it's already exists
+// (entry is found by conflictFields, which are key fields by default). Versions of Versioned items are checked
+// on saving (but not on upsert, same as for items with integer ids).
+func (s *SqlStorage) saveKeyed(ctx context.Context, item Storable, conflictFields []string) error {
+	keyed := item.(Keyed)
+	key := keyed.Key()
+	keyNames := keyed.KeyNames()
+	if key.IsZero() || len(key) != len(keyNames) {
+		return newError(ErrInvalidPrimaryKey, "%s: Key %v must be set before saving", item.CollectionName(), key)
+	}
+	values, err := insertValues(item)
+	if err != nil {
+		return err
+	}
+	for i, name := range keyNames {
+		if values[name], err = toDbValue(key[i]); err != nil {
+			return fmt.Errorf("%s.%s: %w", item.CollectionName(), name, err)
+		}
+	}
+	var versioned Versioned
+	if len(conflictFields) == 0 {
+		versioned, _ = item.(Versioned)
+		conflictFields = keyNames
+	}
+	return s.updateOrInsert(ctx, item, values, conflictFields, versioned)
+}
+
+// Updates entry with the same values of conflictFields, or inserts new one, if there is no such entry.
+// Existence of entry is checked explicitly, so it's never matched by other unique keys (as it would be
+// with MySQL's ON DUPLICATE KEY UPDATE). If versioned is given, version of entry is checked & incremented:
+// StaleObjectError is returned, if entry exists, but it has another version.
+func (s *SqlStorage) updateOrInsert(ctx context.Context, item Storable, values map[string]interface{}, conflictFields []string, versioned Versioned) error {
+	versionField := ""
+	if versioned != nil {
+		versionField = versioned.VersionField()
+	}
+	fieldsSet := make([]string, 0, len(values))
+	args := make([]interface{}, 0, len(values)+len(conflictFields)+1)
+	for field := range s.updatedFields(item) {
+		if field == versionField || isKeyField(item, field) {
+			continue
+		}
+		fieldsSet = append(fieldsSet, s.dialect.Quote(field)+"=?")
+		args = append(args, values[field])
+	}
+	if versioned != nil {
+		fieldsSet = append(fieldsSet, s.dialect.Quote(versionField)+"=?")
+		args = append(args, versioned.Version()+1)
+	}
+	condition := equalsCondition(s.dialect, conflictFields)
+	conditionArgs := make([]interface{}, 0, len(conflictFields)+1)
+	for _, field := range conflictFields {
+		conditionArgs = append(conditionArgs, values[field])
+	}
+	if len(fieldsSet) > 0 {
+		sql := fmt.Sprintf("UPDATE %s SET %s WHERE %s", s.dialect.Quote(item.CollectionName()), strings.Join(fieldsSet, ","), condition)
+		args = append(args, conditionArgs...)
+		if versioned != nil {
+			sql += fmt.Sprintf(" AND %s=?", s.dialect.Quote(versionField))
+			args = append(args, versioned.Version())
+		}
+		res, err := s.exec(ctx, sql, args...)
+		if err != nil {
+			return err
+		}
+		if affected, err := res.RowsAffected(); err != nil {
+			return err
+		} else if affected > 0 {
+			if versioned != nil {
+				versioned.SetVersion(versioned.Version() + 1)
+			}
+			resetChanges(item)
+			return nil
+		}
+	}
+	// nothing is updated: either there is no entry, or it has another version, or it's values are the same
+	// (MySQL doesn't count rows, that are not changed)
+	exists, err := s.ExistsContext(ctx, item, condition, append(conditionArgs, WithDeleted())...)
+	if err != nil {
+		return err
+	}
+	if exists && versioned != nil {
+		return newStaleObjectError(item, versioned.Version())
+	}
+	if !exists {
+		sql, args := s.makeInsertSql(item.CollectionName(), values)
+		if _, err := s.exec(ctx, sql, args...); err != nil {
+			return err
+		}
+	}
+	resetChanges(item)
+	return nil
+}
+
+// Builds "insert or update" query (see Dialect.UpsertClause())
+func (s *SqlStorage) makeUpsertSql(collection string, values map[string]interface{}, conflictFields, updateColumns []string) (string, []interface{}) {
+	columns := make([]string, 0, len(values))
+	for field := range values {
+		columns = append(columns, field)
+	}
+	sort.Strings(columns)
+	sort.Strings(updateColumns)
+	columnsSql := make([]string, 0, len(columns))
+	placeholders := make([]string, 0, len(columns))
+	args := make([]interface{}, 0, len(columns))
+	for _, column := range columns {
+		columnsSql = append(columnsSql, s.dialect.Quote(column))
+		placeholders = append(placeholders, "?")
+		args = append(args, values[column])
+	}
+	sql := fmt.Sprintf(
+		"INSERT INTO %s (%s) VALUES (%s) %s",
+		s.dialect.Quote(collection),
+		strings.Join(columnsSql, ","),
+		strings.Join(placeholders, ","),
+		s.dialect.UpsertClause(conflictFields, updateColumns))
+	return sql, args
+}
+
+// Group of new items, that could be inserted with one query
+type insertBatch struct {
+	collection string
+	pkName     string
+	columns    []string
+	items      []Storable
+	values     []map[string]interface{}
+	ids        []uint64 // generated ids of items (nil, if ids are assigned by DB)
+}
+
+func (s *SqlStorage) saveAll(ctx context.Context, items []Storable) error {
+	batches := make([]*insertBatch, 0)
+	batchesByKey := make(map[string]*insertBatch)
+	for _, item := range items {
+		if _, isKeyed := item.(Keyed); isKeyed {
+			if err := s.saveKeyed(ctx, item, nil); err != nil {
+				return s.uniqueViolation(item.CollectionName(), err)
+			}
+			continue
+		}
+		if item.Id() != 0 {
+			if err := s.updateEntry(ctx, item); err != nil {
+				return s.uniqueViolation(item.CollectionName(), err)
+			}
+			continue
+		}
+		fields, err := insertValues(item)
+		if err != nil {
+			return err
+		}
+		id, err := s.generateId(ctx, item)
+		if err != nil {
+			return err
+		}
+		if id != 0 {
+			fields[item.PKName()] = id
+		}
+		if len(fields) == 0 {
+			if err := s.createNewEntry(ctx, item); err != nil {
+				return s.uniqueViolation(item.CollectionName(), err)
 			}
 			continue
 		}
-		ifaces[i] = new(string)
+		columns := make([]string, 0, len(fields))
+		for field := range fields {
+			columns = append(columns, field)
+		}
+		sort.Strings(columns)
+		key := item.CollectionName() + ":" + strings.Join(columns, ",")
+		batch, exists := batchesByKey[key]
+		if !exists {
+			batch = &insertBatch{collection: item.CollectionName(), pkName: item.PKName(), columns: columns}
+			batchesByKey[key] = batch
+			batches = append(batches, batch)
+		}
+		batch.items = append(batch.items, item)
+		batch.values = append(batch.values, fields)
+		if id != 0 {
+			batch.ids = append(batch.ids, id)
+		}
+	}
+	for _, batch := range batches {
+		chunkSize := s.dialect.MaxParams() / len(batch.columns)
+		if chunkSize < 1 {
+			chunkSize = 1
+		}
+		for from := 0; from < len(batch.items); from += chunkSize {
+			to := from + chunkSize
+			if to > len(batch.items) {
+				to = len(batch.items)
+			}
+			if err := s.insertBatchChunk(ctx, batch, from, to); err != nil {
+				return s.uniqueViolation(batch.collection, err)
+			}
+		}
 	}
-	return ifaces, structFields
+	return nil
 }
 
-func (s *SqlStorage) createNewEntry(item Storable) error {
-	sql, values := s.makeInsertSqlFor(item)
-	res, err := s.exec(sql, values...)
+func (s *SqlStorage) insertBatchChunk(ctx context.Context, batch *insertBatch, from, to int) error {
+	rowsCnt := to - from
+	returning := s.dialect.ReturningId(batch.pkName)
+	if batch.ids == nil && returning == "" && !s.dialect.ConsecutiveBatchIds() {
+		// ids of rows, inserted by one query, are unknown
+		for i := from; i < to; i++ {
+			if err := s.createNewEntry(ctx, batch.items[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	columnsSql := make([]string, 0, len(batch.columns))
+	placeholders := make([]string, 0, len(batch.columns))
+	for _, column := range batch.columns {
+		columnsSql = append(columnsSql, s.dialect.Quote(column))
+		placeholders = append(placeholders, "?")
+	}
+	rowSql := "(" + strings.Join(placeholders, ",") + ")"
+	rowsSql := make([]string, 0, rowsCnt)
+	values := make([]interface{}, 0, rowsCnt*len(batch.columns))
+	for i := from; i < to; i++ {
+		rowsSql = append(rowsSql, rowSql)
+		for _, column := range batch.columns {
+			values = append(values, batch.values[i][column])
+		}
+	}
+	sql := fmt.Sprintf(
+		"INSERT INTO %s (%s) VALUES %s",
+		s.dialect.Quote(batch.collection),
+		strings.Join(columnsSql, ","),
+		strings.Join(rowsSql, ","))
+	if batch.ids != nil {
+		if _, err := s.exec(ctx, sql, values...); err != nil {
+			return err
+		}
+		for i := from; i < to; i++ {
+			batch.items[i].Fill(batch.ids[i], nil)
+			resetChanges(batch.items[i])
+		}
+		return nil
+	}
+	if returning != "" {
+		rows, _, err := s.queryRows(ctx, sql+" "+returning, values...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		ids := make([]uint64, 0, rowsCnt)
+		for rows.Next() {
+			var id uint64
+			if err := rows.Scan(&id); err != nil {
+				return err
+			}
+			ids = append(ids, id)
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if len(ids) != rowsCnt {
+			return fmt.Errorf("Got %d ids of %d rows, inserted to %s", len(ids), rowsCnt, batch.collection)
+		}
+		for i, id := range ids {
+			batch.items[from+i].Fill(id, nil)
+			resetChanges(batch.items[from+i])
+		}
+		return nil
+	}
+	res, err := s.exec(ctx, sql, values...)
 	if err != nil {
 		return err
 	}
-	id, err := res.LastInsertId()
+	lastId, err := res.LastInsertId()
 	if err != nil {
 		return err
 	}
-	item.Fill(uint64(id), nil)
+	firstId := s.dialect.BatchFirstId(lastId, rowsCnt)
+	for i := from; i < to; i++ {
+		batch.items[i].Fill(uint64(firstId)+uint64(i-from), nil)
+		resetChanges(batch.items[i])
+	}
 	return nil
 }
 
-func (s *SqlStorage) updateEntry(item Storable) error {
-	fieldsCnt := len(item.Fields())
-	fieldsSet := make([]string, 0, fieldsCnt)
-	values := make([]interface{}, 0, fieldsCnt+1)
-	for field, v := range item.Fields() {
-		fieldsSet = append(fieldsSet, fmt.Sprintf("`%s`=?", field))
-		values = append(values, v)
+func (s *SqlStorage) updateEntry(ctx context.Context, item Storable) error {
+	fields := s.updatedFields(item)
+	tracked, isTracked := item.(ChangeTracked)
+	versioned, isVersioned := item.(Versioned)
+	versionField := ""
+	if isVersioned {
+		versionField = versioned.VersionField()
+	}
+	fieldsCnt := len(fields)
+	fieldsSet := make([]string, 0, fieldsCnt+1)
+	values := make([]interface{}, 0, fieldsCnt+3)
+	for field, v := range fields {
+		if field == versionField {
+			continue
+		}
+		fieldsSet = append(fieldsSet, s.dialect.Quote(field)+"=?")
+		dbValue, err := toDbValue(v)
+		if err != nil {
+			return fmt.Errorf("%s.%s: %w", item.CollectionName(), field, err)
+		}
+		values = append(values, dbValue)
+	}
+	if isTracked && len(fieldsSet) == 0 {
+		s.Log("%s#%d has no changes; update skipped", item.CollectionName(), item.Id())
+		return nil
+	}
+	if isVersioned {
+		fieldsSet = append(fieldsSet, s.dialect.Quote(versionField)+"=?")
+		values = append(values, versioned.Version()+1)
 	}
 	values = append(values, item.Id())
 	setStr := strings.Join(fieldsSet, ",")
-	sql := fmt.Sprintf("UPDATE `%s` SET %s WHERE `%s`=?", item.CollectionName(), setStr, item.PKName())
-	_, err := s.exec(sql, values...)
+	sql := fmt.Sprintf(
+		"UPDATE %s SET %s WHERE %s=?",
+		s.dialect.Quote(item.CollectionName()),
+		setStr,
+		s.dialect.Quote(item.PKName()))
+	if isVersioned {
+		sql += fmt.Sprintf(" AND %s=?", s.dialect.Quote(versionField))
+		values = append(values, versioned.Version())
+	}
+	res, err := s.exec(ctx, sql, values...)
+	if err != nil {
+		return err
+	}
+	if isVersioned {
+		if err := checkNotStale(res, item, versioned); err != nil {
+			return err
+		}
+		versioned.SetVersion(versioned.Version() + 1)
+	}
+	if isTracked {
+		tracked.ResetChanges()
+	}
+	return nil
+}
+
+// Returns StaleObjectError, if query didn't affect any entry
+func checkNotStale(res sql.Result, item Loadable, versioned Versioned) error {
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return newStaleObjectError(item, versioned.Version())
+	}
+	return nil
+}
+
+// Returns values of item's fields, that must be inserted to DB
+func insertValues(item Storable) (map[string]interface{}, error) {
+	fields := item.Fields()
+	values := make(map[string]interface{}, len(fields)+1)
+	for field, value := range fields {
+		dbValue, err := toDbValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s.%s: %w", item.CollectionName(), field, err)
+		}
+		values[field] = dbValue
+	}
+	if versioned, isVersioned := item.(Versioned); isVersioned {
+		values[versioned.VersionField()] = versioned.Version()
+	}
+	return values, nil
+}
+
+func runCallbacks(callbacks []func()) {
+	for _, f := range callbacks {
+		f()
+	}
+}
+
+// Returns fields of item, that must be written on update: changed ones (see ChangeTracked),
+// or loaded ones (see PartiallyLoadable), or all of them
+func (s *SqlStorage) updatedFields(item Storable) map[string]interface{} {
+	fields := item.Fields()
+	if tracked, isTracked := item.(ChangeTracked); isTracked {
+		return tracked.ChangedFields()
+	}
+	if isPartiallyLoaded(item) {
+		// other fields have initial values, that must not overwrite stored ones
+		loaded := make(map[string]interface{})
+		for _, field := range item.(PartiallyLoadable).LoadedFields() {
+			if v, present := fields[field]; present {
+				loaded[field] = v
+			}
+		}
+		return loaded
+	}
+	return fields
+}
+
+// Converts error of unique constraint violation (reported by DB driver) to UniqueViolationError
+func (s *SqlStorage) uniqueViolation(collection string, err error) error {
+	if err == nil || errors.Is(err, ErrUniqueViolation) {
+		return err
+	}
+	if fields, isViolation := s.dialect.UniqueViolation(err); isViolation {
+		return &UniqueViolationError{Collection: collection, Fields: fields, Err: err}
+	}
 	return err
 }
 
-func (s *SqlStorage) exec(sql string, values ...interface{}) (sql.Result, error) {
+// Resets changes of item, if it tracks them (see ChangeTracked)
+func resetChanges(item Loadable) {
+	if tracked, isTracked := item.(ChangeTracked); isTracked {
+		tracked.ResetChanges()
+	}
+}
+
+// Returns context of transaction for transaction-scoped storage, or background context otherwise
+func (s *SqlStorage) context() context.Context {
+	if s.ctx != nil {
+		return s.ctx
+	}
+	return context.Background()
+}
+
+// Returns query of given builder, built with storage's dialect (if builder supports dialects)
+func (s *SqlStorage) queryOf(builder SqlQueryBilder) string {
+	if dialectAware, ok := builder.(DialectQueryBuilder); ok {
+		return dialectAware.QueryFor(s.dialect)
+	}
+	return builder.Query()
+}
+
+func (s *SqlStorage) exec(ctx context.Context, sql string, values ...interface{}) (sql.Result, error) {
+	sql = s.dialect.Rebind(sql)
 	s.Log("Executing '%s' with %d args", sql, len(values))
+	if s.stmts != nil {
+		stmt, release, err := s.statement(ctx, sql)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+		return stmt.ExecContext(ctx, values...)
+	}
 	if s.tx != nil {
-		return s.tx.Exec(sql, values...)
+		return s.tx.ExecContext(ctx, sql, values...)
 	}
-	return s.db.Exec(sql, values...)
+	return s.db.ExecContext(ctx, sql, values...)
 }
 
-func (s *SqlStorage) queryRows(sql string, values ...interface{}) (rows *sql.Rows, columns []string, err error) {
+func (s *SqlStorage) queryRows(ctx context.Context, sql string, values ...interface{}) (rows *sql.Rows, columns []string, err error) {
+	sql = s.dialect.Rebind(sql)
 	s.Log("Executing '%s' with %d args", sql, len(values))
-	if s.tx != nil {
-		rows, err = s.tx.Query(sql, values...)
+	if s.stmts != nil {
+		stmt, release, stmtErr := s.statement(ctx, sql)
+		if stmtErr != nil {
+			return nil, nil, stmtErr
+		}
+		rows, err = stmt.QueryContext(ctx, values...)
+		release()
+	} else if s.tx != nil {
+		rows, err = s.tx.QueryContext(ctx, sql, values...)
 	} else {
-		rows, err = s.db.Query(sql, values...)
+		rows, err = s.db.QueryContext(ctx, sql, values...)
 	}
 	if err != nil {
 		return
@@ -301,22 +1322,82 @@ func (s *SqlStorage) queryRows(sql string, values ...interface{}) (rows *sql.Row
 	return
 }
 
-func (s *SqlStorage) makeInsertSqlFor(item Storable) (string, []interface{}) {
-	fieldsCnt := len(item.Fields())
+// Returns cached prepared statement, bound to transaction of storage (if any), and func, that releases it
+func (s *SqlStorage) statement(ctx context.Context, query string) (*sql.Stmt, func(), error) {
+	if s.tx != nil && s.txStmts != nil {
+		return s.txStmts.get(ctx, s.tx, query)
+	}
+	return s.stmts.Get(ctx, query)
+}
+
+// Performs query, that returns single integer value (like id of created entry)
+func (s *SqlStorage) queryId(ctx context.Context, sql string, values ...interface{}) (uint64, error) {
+	rows, _, err := s.queryRows(ctx, sql, values...)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return 0, err
+		}
+		return 0, newError(ErrNotFound, "Query returned no rows: %s", sql)
+	}
+	var id uint64
+	if err := rows.Scan(&id); err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// Returns id for new item from generator of it's collection (zero, if id must be assigned by DB)
+func (s *SqlStorage) generateId(ctx context.Context, item Storable) (uint64, error) {
+	if s.idGens == nil {
+		return 0, nil
+	}
+	g, isSet := s.idGens.byCollection[item.CollectionName()]
+	if !isSet {
+		g = s.idGens.common
+	}
+	if g == nil {
+		return 0, nil
+	}
+	id, err := g.NextId(ctx, s, item.CollectionName())
+	if err != nil {
+		return 0, fmt.Errorf("Can't generate id for %s: %w", item.CollectionName(), err)
+	}
+	return id, nil
+}
+
+// Generated id (if it's not zero) is included into inserted values
+func (s *SqlStorage) makeInsertSqlFor(item Storable, id uint64) (string, []interface{}, error) {
+	itemValues, err := insertValues(item)
+	if err != nil {
+		return "", nil, err
+	}
+	if id != 0 {
+		itemValues[item.PKName()] = id
+	}
+	sql, values := s.makeInsertSql(item.CollectionName(), itemValues)
+	return sql, values, nil
+}
+
+func (s *SqlStorage) makeInsertSql(collection string, itemValues map[string]interface{}) (string, []interface{}) {
+	fieldsCnt := len(itemValues)
 	if fieldsCnt == 0 {
-		return fmt.Sprintf("INSERT INTO `%s` values ()", item.CollectionName()), []interface{}{}
+		return fmt.Sprintf("INSERT INTO %s %s", s.dialect.Quote(collection), s.dialect.EmptyInsertValues()), []interface{}{}
 	}
 	fields := make([]string, 0, fieldsCnt)
 	placeholders := make([]string, 0, fieldsCnt)
 	values := make([]interface{}, 0, fieldsCnt)
-	for field, value := range item.Fields() {
-		fields = append(fields, "`"+field+"`")
+	for field, value := range itemValues {
+		fields = append(fields, s.dialect.Quote(field))
 		values = append(values, value)
 		placeholders = append(placeholders, "?")
 	}
 	sql := fmt.Sprintf(
-		"INSERT INTO %s (%s) values (%s)",
-		item.CollectionName(),
+		"INSERT INTO %s (%s) VALUES (%s)",
+		s.dialect.Quote(collection),
 		strings.Join(fields, ","),
 		strings.Join(placeholders, ","))
 	return sql, values
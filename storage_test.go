@@ -1,9 +1,13 @@
 package ldbl_test
 
 import (
+	"context"
+	"database/sql"
+	"errors"
 	"ldbl"
 	"strings"
 	"testing"
+	"time"
 )
 
 var testFields = struct {
@@ -46,7 +50,8 @@ func TestDeleting(t *testing.T) {
 	ok(t, S.Load(img, 1))
 	ok(t, S.Delete(img))
 	equals(t, uint64(0), img.Id())
-	assert(t, S.Load(&Image{}, 1) != nil, "Loading of deleted item must return non-nil error")
+	err := S.Load(&Image{}, 1)
+	assert(t, errors.Is(err, ldbl.ErrNotFound), "Loading of deleted item must return ErrNotFound (got: %v)", err)
 }
 
 func TestSelecting(t *testing.T) {
@@ -98,3 +103,368 @@ func TestSelecting(t *testing.T) {
 
 	removeTestDb()
 }
+
+func TestContextCancelling(t *testing.T) {
+	// cleanup after previous tests
+	removeTestDb()
+	// and bootstraping some test data
+	ok(t, makeTestData(provideTestDb()))
+	S := provideSqlStorage()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ok(t, S.LoadContext(ctx, &Image{}, 1))
+	cancel()
+	assert(t, S.LoadContext(ctx, &Image{}, 1) != nil, "Loading with cancelled context must return non-nil error")
+	images := make([]ldbl.Loadable, 0)
+	assert(t, S.SelectContext(ctx, &Image{}, &images, nil, 0, "") != nil, "Selecting with cancelled context must return non-nil error")
+	err := S.TransactionContext(ctx, func(tx ldbl.Transaction) error {
+		return nil
+	})
+	assert(t, err != nil, "Starting transaction with cancelled context must return non-nil error")
+
+	removeTestDb()
+}
+
+// SQLite dialect, that doesn't guarantee consecutive ids of rows, inserted by one query (as MySQL by default)
+type gappedIdsDialect struct {
+	ldbl.SQLiteDialect
+}
+
+func (d gappedIdsDialect) ConsecutiveBatchIds() bool {
+	return false
+}
+func (d gappedIdsDialect) BatchFirstId(lastInsertId int64, rowsCnt int) int64 {
+	return 0 // must not be used
+}
+
+func TestBatchSaving(t *testing.T) {
+	// cleanup after previous tests
+	removeTestDb()
+	// and bootstraping some test data
+	ok(t, makeTestData(provideTestDb()))
+	S := provideSqlStorage()
+
+	// Enough items for splitting insert into several queries
+	itemsCnt := 500
+	items := make([]ldbl.Storable, 0, itemsCnt+1)
+	for i := 0; i < itemsCnt; i++ {
+		img := &Image{}
+		img.SetField("filename", "batch.jpg")
+		img.SetField("filesize", uint64(i))
+		img.SetField("users_id", uint64(1))
+		items = append(items, img)
+	}
+	user := &User{}
+	ok(t, S.Load(user, 1))
+	user.Email = "batch@test.com"
+	items = append(items, user)
+	ok(t, S.SaveAll(items))
+
+	for i := 0; i < itemsCnt; i++ {
+		img := items[i].(*Image)
+		assert(t, img.Id() > 0, "Item #%d got no id after batch saving", i)
+		loaded := &Image{}
+		ok(t, S.Load(loaded, img.Id()))
+		equals(t, uint64(i), loaded.Filesize())
+	}
+	ok(t, S.Load(user, 1))
+	equals(t, "batch@test.com", user.Email)
+
+	// Items are inserted one by one, if ids of inserted rows can't be got
+	S = provideSqlStorage().SetDialect(gappedIdsDialect{})
+	items = items[:0]
+	for i := 0; i < 3; i++ {
+		img := &Image{}
+		img.SetField("filename", "gapped.jpg")
+		img.SetField("filesize", uint64(i))
+		img.SetField("users_id", uint64(1))
+		items = append(items, img)
+	}
+	ok(t, S.SaveAll(items))
+	for i, img := range items {
+		loaded := &Image{}
+		ok(t, S.Load(loaded, img.Id()))
+		equals(t, uint64(i), loaded.Filesize())
+	}
+
+	removeTestDb()
+}
+
+func TestUpdatingChangedFields(t *testing.T) {
+	// cleanup after previous tests
+	removeTestDb()
+	// and bootstraping some test data
+	db := provideTestDb()
+	ok(t, makeTestData(db))
+	S := provideStorage()
+
+	img := &Image{}
+	ok(t, S.Load(img, 1))
+	// concurrent change of other field must not be overwritten
+	_, err := db.Exec("UPDATE images SET filename='concurrent.jpg' WHERE id=1")
+	ok(t, err)
+	img.SetField("filesize", uint64(100500))
+	ok(t, S.Save(img))
+	loaded := &Image{}
+	ok(t, S.Load(loaded, 1))
+	equals(t, uint64(100500), loaded.Filesize())
+	equals(t, "concurrent.jpg", loaded.Filename())
+
+	// saving of unchanged item must not touch DB
+	_, err = db.Exec("UPDATE images SET filesize=1 WHERE id=1")
+	ok(t, err)
+	ok(t, S.Save(img))
+	ok(t, S.Load(loaded, 1))
+	equals(t, uint64(1), loaded.Filesize())
+
+	removeTestDb()
+}
+
+func TestOptimisticLocking(t *testing.T) {
+	// cleanup after previous tests
+	removeTestDb()
+	// and bootstraping some test data
+	ok(t, makeTestData(provideTestDb()))
+	S := provideStorage()
+
+	first, second := &VersionedImage{}, &VersionedImage{}
+	ok(t, S.Load(first, 1))
+	ok(t, S.Load(second, 1))
+	first.SetField("filesize", uint64(1))
+	ok(t, S.Save(first))
+	equals(t, uint64(1), first.Version())
+
+	// Second copy is outdated now
+	second.SetField("filesize", uint64(2))
+	err := S.Save(second)
+	assert(t, errors.Is(err, ldbl.ErrStaleObject), "Saving of outdated item must return ErrStaleObject (got: %v)", err)
+	err = S.Delete(second)
+	assert(t, errors.Is(err, ldbl.ErrStaleObject), "Deleting of outdated item must return ErrStaleObject (got: %v)", err)
+
+	// Reloaded copy is actual
+	ok(t, S.Load(second, 1))
+	equals(t, uint64(1), second.Filesize())
+	ok(t, S.Delete(second))
+
+	removeTestDb()
+}
+
+func TestNullValues(t *testing.T) {
+	// cleanup after previous tests
+	removeTestDb()
+	// and bootstraping some test data
+	ok(t, makeTestData(provideTestDb()))
+	S := provideStorage()
+
+	// NULLs of untyped items are represented as nil
+	raw := &RawImage{}
+	ok(t, S.Load(raw, 1))
+	equals(t, nil, raw.Field("description"))
+	equals(t, nil, raw.Field("rating"))
+
+	// Typed items are able to keep NULLs in pointers & sql.Null* types
+	img := &NullableImage{}
+	ok(t, S.Load(img, 1))
+	equals(t, (*string)(nil), img.Field("description"))
+	equals(t, sql.NullInt64{}, img.Field("rating"))
+
+	// Filled values
+	description := "A cute kitty"
+	img.SetField("description", &description)
+	img.SetField("rating", sql.NullInt64{Int64: 5, Valid: true})
+	ok(t, S.Save(img))
+	ok(t, S.Load(img, 1))
+	loadedDescription, _ := img.Field("description").(*string)
+	assert(t, loadedDescription != nil && *loadedDescription == description, "Wrong value of 'description' field: %v", img.Field("description"))
+	equals(t, sql.NullInt64{Int64: 5, Valid: true}, img.Field("rating"))
+
+	// nil is written as NULL
+	raw.SetField("description", nil)
+	raw.SetField("rating", nil)
+	ok(t, S.Save(raw))
+	ok(t, S.Load(img, 1))
+	equals(t, (*string)(nil), img.Field("description"))
+	equals(t, sql.NullInt64{}, img.Field("rating"))
+
+	removeTestDb()
+}
+
+func TestFieldConverters(t *testing.T) {
+	// cleanup after previous tests
+	removeTestDb()
+	// and bootstraping some test data
+	ok(t, makeTestData(provideTestDb()))
+	S := provideStorage()
+	ldbl.RegisterConverter(ImageMeta{}, ldbl.NewJSONConverter(ImageMeta{}))
+	ldbl.RegisterConverter(Draft, ldbl.NewEnumConverter(map[string]interface{}{
+		"draft":     Draft,
+		"published": Published,
+	}))
+
+	// Initial values are kept for NULLs
+	img := &ConvertedImage{}
+	ok(t, S.Load(img, 1))
+	equals(t, ImageMeta{}, img.Field("meta"))
+	equals(t, Draft, img.Field("status"))
+	equals(t, time.Duration(0), img.Field("duration"))
+	equals(t, Price{}, img.Field("price"))
+
+	img.SetField("meta", ImageMeta{Width: 640, Height: 480})
+	img.SetField("status", Published)
+	img.SetField("duration", 90*time.Second)
+	img.SetField("price", Price{Cents: 1999})
+	ok(t, S.Save(img))
+
+	loaded := &ConvertedImage{}
+	ok(t, S.Load(loaded, 1))
+	equals(t, ImageMeta{Width: 640, Height: 480}, loaded.Field("meta"))
+	equals(t, Published, loaded.Field("status"))
+	equals(t, 90*time.Second, loaded.Field("duration"))
+	equals(t, Price{Cents: 1999}, loaded.Field("price"))
+
+	// Values are stored in DB representation
+	raw := &RawImage{}
+	ok(t, S.Load(raw, 1))
+	equals(t, `{"Width":640,"Height":480}`, raw.Field("meta"))
+	equals(t, "published", raw.Field("status"))
+	equals(t, "19.99", raw.Field("price"))
+
+	removeTestDb()
+}
+
+func TestKeyedItems(t *testing.T) {
+	// cleanup after previous tests
+	removeTestDb()
+	// and bootstraping some test data
+	ok(t, makeTestData(provideTestDb()))
+
+	S := provideSqlStorage()
+	setting := &Setting{uuid: "0b9a5c3e-6a2f-4bb8-9d5a-1f0c6e6a3b71"}
+	setting.SetField("name", "theme")
+	setting.SetField("value", "dark")
+	ok(t, S.Save(setting))
+
+	loaded := &Setting{}
+	ok(t, S.LoadByKey(loaded, setting.Key()))
+	equals(t, setting.Key(), loaded.Key())
+	equals(t, "dark", loaded.Field("value"))
+
+	// saving of item with existing key updates it
+	loaded.SetField("value", "light")
+	ok(t, S.Save(loaded))
+	tag := &ImageTag{imageId: 1, tag: "cats"}
+	tag.SetField("weight", int64(3))
+	ok(t, S.Save(tag))
+	cnt, err := S.Count(&Setting{}, "")
+	ok(t, err)
+	equals(t, int64(1), cnt)
+
+	loadedTag := &ImageTag{}
+	ok(t, S.LoadByKey(loadedTag, ldbl.Key{1, "cats"}))
+	equals(t, uint64(1), loadedTag.imageId)
+	equals(t, int64(3), loadedTag.Field("weight"))
+	err = S.LoadByKey(&ImageTag{}, ldbl.Key{2, "cats"})
+	assert(t, errors.Is(err, ldbl.ErrNotFound), "Loading by missing key must return ErrNotFound (got: %v)", err)
+
+	results := make([]ldbl.Loadable, 0)
+	ok(t, S.Select(&Setting{}, &results, nil, 0, "name=?", "theme"))
+	equals(t, 1, len(results))
+	equals(t, "light", results[0].(*Setting).Field("value"))
+
+	err = S.Save(&ImageTag{})
+	assert(t, errors.Is(err, ldbl.ErrInvalidPrimaryKey), "Saving of item without key must return ErrInvalidPrimaryKey (got: %v)", err)
+
+	ok(t, S.Delete(loadedTag))
+	assert(t, loadedTag.Key().IsZero(), "Key of deleted item must be reset (got: %v)", loadedTag.Key())
+	err = S.LoadByKey(&ImageTag{}, ldbl.Key{1, "cats"})
+	assert(t, errors.Is(err, ldbl.ErrNotFound), "Loading of deleted item must return ErrNotFound (got: %v)", err)
+
+	// string parts of keys are represented unambiguously
+	assert(t, ldbl.Key{"a/b", "c"}.String() != ldbl.Key{"a", "b/c"}.String(), "Different keys must have different string representations")
+
+	// versions of Keyed items are checked on saving
+	versioned := &VersionedSetting{Setting{uuid: "5d1c2b8e-0f3a-4c6e-8b7d-2a9e4f1c3d50"}}
+	versioned.SetField("name", "locale")
+	ok(t, S.Save(versioned))
+	first, second := &VersionedSetting{}, &VersionedSetting{}
+	ok(t, S.LoadByKey(first, versioned.Key()))
+	ok(t, S.LoadByKey(second, versioned.Key()))
+	first.SetField("value", "en")
+	ok(t, S.Save(first))
+	equals(t, versioned.Version()+1, first.Version())
+	second.SetField("value", "de")
+	err = S.Save(second)
+	assert(t, errors.Is(err, ldbl.ErrStaleObject), "Saving of stale Keyed item must return ErrStaleObject (got: %v)", err)
+	var stale *ldbl.StaleObjectError
+	assert(t, errors.As(err, &stale) && stale.Key.String() == versioned.Key().String(), "Key of stale item must be reported (got: %v)", err)
+	ok(t, S.LoadByKey(second, versioned.Key()))
+	equals(t, "en", second.Field("value"))
+
+	removeTestDb()
+}
+
+func TestSoftDeleting(t *testing.T) {
+	// cleanup after previous tests
+	removeTestDb()
+	// and bootstraping some test data
+	ok(t, makeTestData(provideTestDb()))
+
+	S := provideSqlStorage()
+	img := &SoftImage{}
+	ok(t, S.Load(img, 1))
+	ok(t, S.Delete(img))
+	equals(t, uint64(1), img.Id())
+	deletedAt, isTime := img.Field("deleted_at").(time.Time)
+	assert(t, isTime && !deletedAt.IsZero(), "Time of deletion must be set to item (got: %v)", img.Field("deleted_at"))
+	err := S.Load(&SoftImage{}, 1)
+	assert(t, errors.Is(err, ldbl.ErrNotFound), "Loading of soft-deleted item must return ErrNotFound (got: %v)", err)
+
+	countOf := func(args ...interface{}) int {
+		results := make([]ldbl.Loadable, 0)
+		ok(t, S.Select(&SoftImage{}, &results, nil, 0, "users_id=?", append([]interface{}{1}, args...)...))
+		return len(results)
+	}
+	equals(t, 6, countOf())
+	equals(t, 7, countOf(ldbl.WithDeleted()))
+	equals(t, 1, countOf(ldbl.OnlyDeleted()))
+	cnt, err := S.Count(&SoftImage{}, "")
+	ok(t, err)
+	equals(t, int64(8), cnt)
+	cnt, err = S.Count(&Image{}, "") // items, that are not SoftDeletable, are not filtered
+	ok(t, err)
+	equals(t, int64(9), cnt)
+	results := make([]ldbl.Loadable, 0)
+	ok(t, S.Query(ldbl.Select(&SoftImage{}).OnlyDeleted(), &results))
+	equals(t, 1, len(results))
+	equals(t, uint64(1), results[0].Id())
+
+	ok(t, S.Restore(img))
+	assert(t, img.Field("deleted_at") == nil, "Time of deletion must be reset (got: %v)", img.Field("deleted_at"))
+	ok(t, S.Load(&SoftImage{}, 1))
+
+	ok(t, S.Delete(img))
+	ok(t, S.Purge(img))
+	equals(t, 6, countOf(ldbl.WithDeleted()))
+
+	removeTestDb()
+}
+
+func TestUniqueViolationErrors(t *testing.T) {
+	// cleanup after previous tests
+	removeTestDb()
+	// and bootstraping some test data
+	ok(t, makeTestData(provideTestDb()))
+
+	S := provideSqlStorage()
+	err := S.Save(&User{Email: "me@safron.su"})
+	assert(t, errors.Is(err, ldbl.ErrUniqueViolation), "Error of DB driver must be translated to ErrUniqueViolation (got: %v)", err)
+	var violation *ldbl.UniqueViolationError
+	assert(t, errors.As(err, &violation), "UniqueViolationError expected (got: %T)", err)
+	equals(t, "users", violation.Collection)
+	equals(t, []string{"email"}, violation.Fields)
+
+	err = S.SaveAll([]ldbl.Storable{&User{Email: "new@test.com"}, &User{Email: "new@test.com"}})
+	assert(t, errors.Is(err, ldbl.ErrUniqueViolation), "Errors of batch saving must be translated too (got: %v)", err)
+
+	removeTestDb()
+}
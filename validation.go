@@ -0,0 +1,291 @@
+package ldbl
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Names of validation rules (see FieldError)
+const (
+	RuleRequired = "required"
+	RuleLength   = "length"
+	RuleRange    = "range"
+	RuleRegexp   = "regexp"
+	RuleEnum     = "enum"
+	RuleUnique   = "unique"
+	RuleValidate = "validate" // error, returned by Validatable.Validate()
+)
+
+// Describes failed validation rule
+type FieldError struct {
+	Field   string // empty for errors of whole item
+	Rule    string
+	Message string
+}
+
+func (e FieldError) Error() string {
+	if e.Field == "" {
+		return e.Message
+	}
+	return e.Field + ": " + e.Message
+}
+
+// Returned by DispatchedStorage, when item is not valid (see Validatable & RegisterValidation()).
+// Lists all failed rules; matches ErrValidationFailed.
+type ValidationErrors []FieldError
+
+func (e ValidationErrors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, fe := range e {
+		msgs = append(msgs, fe.Error())
+	}
+	return "Validation failed: " + strings.Join(msgs, "; ")
+}
+
+func (e ValidationErrors) Is(target error) bool {
+	return target == ErrValidationFailed
+}
+
+// Returns errors of given field
+func (e ValidationErrors) For(field string) ValidationErrors {
+	var found ValidationErrors
+	for _, fe := range e {
+		if fe.Field == field {
+			found = append(found, fe)
+		}
+	}
+	return found
+}
+
+// Declarative rules of validation of collection's items (see DispatchedStorage.RegisterValidation()):
+//
+//	ldbl.NewValidationRules().
+//		Required("filename").
+//		Length("filename", 1, 255).
+//		Unique("filename")
+//
+// Rules (except Required()) are skipped for empty values. Fields of partially loaded items,
+// that were not loaded, are not checked.
+type ValidationRules struct {
+	rules []validationRule
+}
+
+type validationRule struct {
+	fields []string
+	name   string
+	check  func(value interface{}) string // returns message, if value is not valid
+}
+
+func NewValidationRules() *ValidationRules {
+	return &ValidationRules{}
+}
+
+// Fields must have not empty values (nil, empty string or zero time are empty)
+func (r *ValidationRules) Required(fields ...string) *ValidationRules {
+	for _, field := range fields {
+		r.add(field, RuleRequired, func(value interface{}) string {
+			if isEmptyValue(value) {
+				return "Value is required"
+			}
+			return ""
+		})
+	}
+	return r
+}
+
+// Length of string (in runes) or slice must be in range [min, max]; max <= 0 means "no limit"
+func (r *ValidationRules) Length(field string, min, max int) *ValidationRules {
+	return r.add(field, RuleLength, func(value interface{}) string {
+		length := -1
+		v := indirectValue(value)
+		switch v.Kind() {
+		case reflect.String:
+			length = utf8.RuneCountInString(v.String())
+		case reflect.Slice, reflect.Array, reflect.Map:
+			length = v.Len()
+		}
+		if length < 0 {
+			return fmt.Sprintf("Length of %T can't be checked", value)
+		}
+		if length < min || (max > 0 && length > max) {
+			return fmt.Sprintf("Length must be in range [%d, %d] (got: %d)", min, max, length)
+		}
+		return ""
+	})
+}
+
+// Value (number, string or time) must be in range [min, max]; nil bound means "no limit"
+func (r *ValidationRules) Range(field string, min, max interface{}) *ValidationRules {
+	return r.add(field, RuleRange, func(value interface{}) string {
+		if !isComparableValue(value) {
+			return fmt.Sprintf("Range of %T can't be checked", value)
+		}
+		for _, bound := range []interface{}{min, max} {
+			if _, comparable := compareValuesOf(value, bound); bound != nil && !comparable {
+				return fmt.Sprintf("Range of %T can't be checked against %T bound", value, bound)
+			}
+		}
+		if (min != nil && compareValues(value, min) < 0) || (max != nil && compareValues(value, max) > 0) {
+			return fmt.Sprintf("Value must be in range [%v, %v] (got: %v)", min, max, indirectValue(value))
+		}
+		return ""
+	})
+}
+
+// String value must match regular expression
+func (r *ValidationRules) Matches(field string, re *regexp.Regexp) *ValidationRules {
+	return r.add(field, RuleRegexp, func(value interface{}) string {
+		v := indirectValue(value)
+		if v.Kind() != reflect.String || !re.MatchString(v.String()) {
+			return fmt.Sprintf("Value must match %s", re)
+		}
+		return ""
+	})
+}
+
+// Value must be equal to one of given values
+func (r *ValidationRules) OneOf(field string, values ...interface{}) *ValidationRules {
+	return r.add(field, RuleEnum, func(value interface{}) string {
+		for _, allowed := range values {
+			if valuesEqual(value, allowed) {
+				return ""
+			}
+		}
+		return fmt.Sprintf("Value must be one of %v (got: %v)", values, indirectValue(value))
+	})
+}
+
+// Combination of values of fields must be unique in collection. Rule is checked by storage
+// (with query inside of saving transaction); for stored items it's checked only when fields are changed.
+func (r *ValidationRules) Unique(fields ...string) *ValidationRules {
+	r.rules = append(r.rules, validationRule{fields: fields, name: RuleUnique})
+	return r
+}
+
+// Adds custom rule: check returns error, if value is not valid
+func (r *ValidationRules) Custom(field, rule string, check func(value interface{}) error) *ValidationRules {
+	return r.add(field, rule, func(value interface{}) string {
+		if err := check(value); err != nil {
+			return err.Error()
+		}
+		return ""
+	})
+}
+
+func (r *ValidationRules) add(field, name string, check func(value interface{}) string) *ValidationRules {
+	r.rules = append(r.rules, validationRule{fields: []string{field}, name: name, check: check})
+	return r
+}
+
+// Checks rules, that don't need DB (unique rules are returned for checking by storage)
+func (r *ValidationRules) validate(item Storable) (ValidationErrors, []validationRule) {
+	var errs ValidationErrors
+	var unique []validationRule
+	for _, rule := range r.rules {
+		if !areFieldsKnown(item, rule.fields) {
+			continue
+		}
+		if rule.name == RuleUnique {
+			unique = append(unique, rule)
+			continue
+		}
+		field := rule.fields[0]
+		value := validatedValue(item, field)
+		if rule.name != RuleRequired && isEmptyValue(value) {
+			continue
+		}
+		if msg := rule.check(value); msg != "" {
+			errs = append(errs, FieldError{Field: field, Rule: rule.name, Message: msg})
+		}
+	}
+	return errs, unique
+}
+
+// Returns true, if some of fields was changed (or if item doesn't track changes)
+func isAnyFieldChanged(item Storable, fields []string) bool {
+	if _, isTracked := item.(ChangeTracked); !isTracked {
+		return true
+	}
+	for _, field := range fields {
+		if isFieldChanged(item, field) {
+			return true
+		}
+	}
+	return false
+}
+
+// Converts error of Validatable.Validate() to ValidationErrors
+func validationErrorsOf(err error) ValidationErrors {
+	var errs ValidationErrors
+	if errors.As(err, &errs) {
+		return errs
+	}
+	var fe FieldError
+	if errors.As(err, &fe) {
+		return ValidationErrors{fe}
+	}
+	return ValidationErrors{{Rule: RuleValidate, Message: err.Error()}}
+}
+
+// Returns value of field (it could be a part of item's key)
+func validatedValue(item Storable, field string) interface{} {
+	if keyed, isKeyed := item.(Keyed); isKeyed {
+		for i, name := range keyed.KeyNames() {
+			if name == field {
+				return keyed.Key()[i]
+			}
+		}
+	}
+	return item.Fields()[field]
+}
+
+func indirectValue(value interface{}) reflect.Value {
+	v := reflect.ValueOf(value)
+	for v.Kind() == reflect.Ptr && !v.IsNil() {
+		v = v.Elem()
+	}
+	return v
+}
+
+func isEmptyValue(value interface{}) bool {
+	v := indirectValue(value)
+	switch {
+	case !v.IsValid(), v.Kind() == reflect.Ptr:
+		return true
+	case v.Kind() == reflect.String, v.Kind() == reflect.Slice, v.Kind() == reflect.Map:
+		return v.Len() == 0
+	}
+	if t, isTime := v.Interface().(time.Time); isTime {
+		return t.IsZero()
+	}
+	return false
+}
+
+func isComparableValue(value interface{}) bool {
+	v := indirectValue(value)
+	if !v.IsValid() {
+		return false
+	}
+	if _, isTime := v.Interface().(time.Time); isTime {
+		return true
+	}
+	return isNumberKind(v.Kind()) || v.Kind() == reflect.String
+}
+
+// Values are equal, if they are deeply equal, or they are numbers (strings, times) with the same value.
+// Values of different kinds (like 5 & "5") are never equal.
+func valuesEqual(a, b interface{}) bool {
+	if reflect.DeepEqual(a, b) {
+		return true
+	}
+	if !isComparableValue(a) || !isComparableValue(b) {
+		return false
+	}
+	cmp, comparable := compareValuesOf(a, b)
+	return comparable && cmp == 0
+}